@@ -2,7 +2,6 @@ package mariner
 
 import (
 	"fmt"
-	"os/exec"
 	"reflect"
 	"sort"
 	"strconv"
@@ -36,6 +35,7 @@ type CommandElement struct {
 	Position    int      // position from binding
 	ArgPosition int      // index from arguments list, if argument
 	Value       []string // representation of this input/arg on the commandline (after any/all valueFrom, eval, prefix, separators, shellQuote, etc. has been resolved)
+	Unquoted    bool     // true if `shellQuote: false` under ShellCommandRequirement - the value goes to the shell as is, e.g., a pipe or a redirection
 }
 
 // CommandElements is an array of CommandElements
@@ -47,6 +47,29 @@ func (cmdElts CommandElements) Len() int           { return len(cmdElts) }
 func (cmdElts CommandElements) Swap(i, j int)      { cmdElts[i], cmdElts[j] = cmdElts[j], cmdElts[i] }
 func (cmdElts CommandElements) Less(i, j int) bool { return cmdElts[i].Position < cmdElts[j].Position }
 
+// TaskCommand is the command for the task container, as sent to the s3sidecar in the tool's working dir - see writeCommandToS3()
+// the sidecar writes run.sh from this, quoting each argument, so the tool gets exactly these arguments
+// i.e., spaces, quotes and `$` in an argument are not interpreted by the shell
+// except for the arguments marked unquoted, which the shell does interpret - see CommandElement.Unquoted
+type TaskCommand struct {
+	Args   []string          `json:"args"`
+	Env    map[string]string `json:"env,omitempty"`    // exported by run.sh before running the command
+	Stdin  string            `json:"stdin,omitempty"`  // path of a file to redirect to stdin
+	Stdout string            `json:"stdout,omitempty"` // path of a file to which stdout gets appended
+	Stderr string            `json:"stderr,omitempty"` // path of a file to which stderr gets appended
+
+	// paths of the files to which stdout and stderr get tee'd, if not redirected by the CWL - see taskLogs()
+	StdoutLog string `json:"stdoutLog,omitempty"`
+	StderrLog string `json:"stderrLog,omitempty"`
+
+	// Unquoted[i] is true if Args[i] goes to the shell as is - nil if every argument gets quoted
+	Unquoted []bool `json:"unquoted,omitempty"`
+
+	// the files for the sidecar to upload from the working dir, once the tool exits - see outputPatterns()
+	// nil means upload the whole working dir
+	Outputs []*OutputPattern `json:"outputs"`
+}
+
 // GenerateCommand ..
 func (tool *Tool) generateCommand() (err error) {
 	tool.Task.infof("begin generate command")
@@ -58,65 +81,76 @@ func (tool *Tool) generateCommand() (err error) {
 	// Sort the command elements by position
 	sort.Sort(cmdElts)
 
-	// capture stdout if specified - tool.Task.Root.Stdout resolves to a file name where stdout will be redirected
-	if tool.Task.Root.Stdout != "" {
-		// append "1> stdout_file" to end of command
-		stdoutElts, err := tool.stdElts(1)
-		if err != nil {
-			return tool.Task.errorf("%v", err)
+	cmd := append([]string{}, tool.Task.Root.BaseCommands...) // BaseCommands is []string - empty array if no BaseCommand specified
+	unquoted := make([]bool, len(cmd))
+	anyUnquoted := false
+	for _, cmdElt := range cmdElts {
+		for _, v := range cmdElt.Value {
+			cmd = append(cmd, v)
+			unquoted = append(unquoted, cmdElt.Unquoted)
 		}
-		cmdElts = append(cmdElts, stdoutElts...)
+		anyUnquoted = anyUnquoted || cmdElt.Unquoted
+	}
+	if len(cmd) == 0 {
+		return tool.Task.errorf("empty command")
+	}
+	tool.Command = &TaskCommand{Args: cmd}
+	if anyUnquoted {
+		tool.Command.Unquoted = unquoted
 	}
 
-	// capture stderr if specified - tool.Task.Root.Stderr resolves to a file name where stderr will be redirected
-	if tool.Task.Root.Stderr != "" {
-		// append "2> stderr_file" to end of command
-		stderrElts, err := tool.stdElts(2)
-		if err != nil {
-			return tool.Task.errorf("%v", err)
+	// redirect stdin, stdout and stderr if specified
+	if tool.Task.Root.Stdin != "" {
+		if tool.Command.Stdin, _, err = tool.resolveExpressions(tool.Task.Root.Stdin); err != nil {
+			return tool.Task.errorf("failed to resolve stdin: %v", err)
 		}
-		cmdElts = append(cmdElts, stderrElts...)
 	}
-
-	cmd := tool.Task.Root.BaseCommands // BaseCommands is []string - empty array if no BaseCommand specified
-	for _, cmdElt := range cmdElts {
-		cmd = append(cmd, cmdElt.Value...)
+	if tool.Command.Stdout, err = tool.stdPath(tool.Task.Root.Stdout); err != nil {
+		return tool.Task.errorf("failed to resolve stdout: %v", err)
 	}
-	tool.Command = exec.Command(cmd[0], cmd[1:]...)
+	if tool.Command.Stderr, err = tool.stdPath(tool.Task.Root.Stderr); err != nil {
+		return tool.Task.errorf("failed to resolve stderr: %v", err)
+	}
+	tool.taskLogs()
+	tool.Command.Outputs = tool.outputPatterns()
 	tool.Task.infof("end generate command")
 	return nil
 }
 
-// i==1 --> stdout; i==2 --> stderr
-func (tool *Tool) stdElts(i int) (cmdElts CommandElements, err error) {
-	tool.Task.infof("begin handle stdout and stderr destinations")
-	cmdElts = make([]*CommandElement, 0)
-	var f string
-	switch i {
-	case 1:
-		f, _, err = tool.resolveExpressions(tool.Task.Root.Stdout)
-	case 2:
-		f, _, err = tool.resolveExpressions(tool.Task.Root.Stderr)
+// stdPath resolves the `stdout` or `stderr` field of the tool to the path of the file where that stream is redirected
+// or "" if the field is not specified
+//
+// NOTE: the launcher appends (">>") to, rather than overwrites (">"), this file, in case multiple steps/tools redirect stdout/stderr to the same file
+// ----- need to decide implementation for scattered tasks
+// ----- if all scattered tasks redirect their output to the same file if a fixed filename specified
+// ----- or if each scattered subtask will have its own individual dir and stdout/stderr file
+func (tool *Tool) stdPath(field string) (string, error) {
+	if field == "" {
+		return "", nil
 	}
+	tool.Task.infof("begin handle stdout and stderr destinations")
+	f, _, err := tool.resolveExpressions(field)
 	if err != nil {
-		return nil, tool.Task.errorf("%v", err)
+		return "", tool.Task.errorf("%v", err)
 	}
+	tool.Task.infof("end handle stdout and stderr destinations")
+	return tool.WorkingDir + f, nil
+}
 
-	prefix := tool.WorkingDir
-
-	// 2>> for stderr, 1>> for stdout
-	// NOTE: presently using ">>" (append) and not ">" (write) in case multiple steps/tools redirect stdout/stderr to the same file
-	// ----- need to decide implementation for scattered tasks
-	// ----- if all scattered tasks redirect their output to the same file if a fixed filename specified
-	// ----- or if each scattered subtask will have its own individual dir and stdout/stderr file
-	stream := fmt.Sprintf("%v>>", i)
-
-	cmdElt := &CommandElement{
-		Value: []string{stream, prefix + f},
+// taskLogs sets the files which capture the tool's stdout and stderr, and records them in the task log
+// a stream which the CWL redirects to a file is captured by that file - otherwise it gets tee'd to a log file in the working dir
+// either way, the file gets uploaded with the working dir, and can be fetched via the task logs endpoint - see tasklogs.go
+func (tool *Tool) taskLogs() {
+	logs := &TaskLogs{Stdout: tool.Command.Stdout, Stderr: tool.Command.Stderr}
+	if logs.Stdout == "" {
+		tool.Command.StdoutLog = tool.WorkingDir + stdoutLogFile
+		logs.Stdout = tool.Command.StdoutLog
 	}
-	cmdElts = append(cmdElts, cmdElt)
-	tool.Task.infof("end handle stdout and stderr destinations")
-	return cmdElts, nil
+	if logs.Stderr == "" {
+		tool.Command.StderrLog = tool.WorkingDir + stderrLogFile
+		logs.Stderr = tool.Command.StderrLog
+	}
+	tool.Task.Log.Logs = logs
 }
 
 func (tool *Tool) cmdElts() (cmdElts CommandElements, err error) {
@@ -166,6 +200,7 @@ func (tool *Tool) inputElts() (cmdElts CommandElements, err error) {
 			cmdElt := &CommandElement{
 				Position: pos,
 				Value:    val,
+				Unquoted: tool.unquoted(input.Binding),
 			}
 			cmdElts = append(cmdElts, cmdElt)
 		}
@@ -415,6 +450,7 @@ func (tool *Tool) argElts() (cmdElts CommandElements, err error) {
 			Position:    pos,
 			ArgPosition: i + 1, // beginning at 1 so that can detect nil/zero value of 0
 			Value:       val,
+			Unquoted:    tool.unquoted(arg.Binding),
 		}
 		cmdElts = append(cmdElts, cmdElt)
 	}
@@ -422,6 +458,13 @@ func (tool *Tool) argElts() (cmdElts CommandElements, err error) {
 	return cmdElts, nil
 }
 
+// unquoted returns true if the value of the binding goes to the shell as is
+// per the CWL spec, `shellQuote: false` only applies under ShellCommandRequirement
+// see: https://www.commonwl.org/v1.0/CommandLineTool.html#ShellCommandRequirement
+func (tool *Tool) unquoted(binding *cwl.Binding) bool {
+	return binding != nil && !binding.ShellQuote && tool.Task.requirement(CWLShellCommandRequirement) != nil
+}
+
 // gets value from an argument - i.e., returns []string containing strings which will be put on the commandline to represent this argument
 func (tool *Tool) argVal(arg cwl.Argument) (val []string, err error) {
 	tool.Task.infof("begin get value from command element argument")
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	k8sv1 "k8s.io/api/core/v1"
 	k8sResource "k8s.io/apimachinery/pkg/api/resource"
@@ -25,12 +26,24 @@ const (
 	// not in the codebase
 	defaultTaskContainerImage = "ubuntu"
 
+	// registry of an image reference which doesn't name one - e.g., "ubuntu"
+	defaultImageRegistry = "docker.io"
+
+	// shell which launches the task container's command script - any image which has a shell has this one
+	posixShell = "/bin/sh"
+
+	// tag of a workflow request which names the project of the run
+	projectTag = "project"
+
 	// volume names
 	engineWorkspaceVolumeName = "engine-workspace"
 	commonsDataVolumeName     = "commons-data"
 	configVolumeName          = "mariner-config"
 	conformanceVolumeName     = "conformance-test"
 
+	// dir in the engine workspace under which remote File inputs get staged - see remote.go
+	remoteDataDir = "_mariner_remote"
+
 	// location of conformance test input files in s3
 	conformanceInputS3Prefix = "conformanceTest/"
 
@@ -53,6 +66,37 @@ const (
 	unknown    = "unknown"
 	success    = "success"
 	cancelled  = "cancelled"
+	timedOut   = "timed-out"
+
+	// k8s reason for a container killed for exceeding its memory limit
+	oomKilled = "OOMKilled"
+
+	// reason for the failure of a task whose pod disappeared
+	podLost = "PodLost"
+
+	// pod condition type set by k8s on a pod which is being terminated due to a disruption
+	podDisruptionTarget = "DisruptionTarget"
+
+	// reason for the failure of a task whose s3sidecar failed to stage inputs or upload outputs
+	sidecarFailed = "SidecarFailed"
+
+	// reason for the failure of a task whose tool exited with a code other than one of its success codes
+	toolFailed = "ToolFailed"
+
+	// reason for the failure of a task whose tool was killed for exceeding its ToolTimeLimit
+	toolTimedOut = "ToolTimedOut"
+
+	// reason for the failure of a task whose job completed without a valid final status - see status.go
+	invalidTaskStatus = "InvalidTaskStatus"
+
+	// memory is multiplied by this factor on each retry of an OOMKilled task, if no factor is configured
+	defaultOOMRetryFactor = 2
+
+	// max reschedules of a task lost to infrastructure failures, if not configured
+	defaultMaxReschedules = 3
+
+	// matches any version of a package in the software mapping - see software.go
+	anyVersion = "*"
 
 	k8sJobAPI     = "k8sJobAPI"
 	k8sPodAPI     = "k8sPodAPI"
@@ -76,8 +120,46 @@ const (
 	CWLResourceRequirement       = "ResourceRequirement"
 	CWLDockerRequirement         = "DockerRequirement"
 	CWLEnvVarRequirement         = "EnvVarRequirement"
+	CWLToolTimeLimit             = "ToolTimeLimit"
+	CWLSchemaDefRequirement      = "SchemaDefRequirement"
+	CWLSoftwareRequirement       = "SoftwareRequirement"
+	CWLShellCommandRequirement   = "ShellCommandRequirement"
 	// add the rest ..
 
+	// mariner-specific hints, e.g., `mariner:Scheduling` where `$namespaces: {mariner: "https://github.com/uc-cdis/mariner#"}`
+	marinerNamespace       = "https://github.com/uc-cdis/mariner#"
+	marinerNamespacePrefix = "mariner:"
+	marinerSchedulingHint  = "Scheduling"
+
+	// ResourceRequirement defaults, per the CWL spec - cores, and mebibytes for the rest
+	defaultCoresMin  = 1
+	defaultRAMMin    = 256
+	defaultTmpdirMin = 1024
+	defaultOutdirMin = 1024
+
+	// task volume defaults - see TaskVolume
+	defaultTaskVolumeSize   = "2Gi"
+	defaultTaskStorageClass = "mariner-storage"
+	emptyDirVolumeType      = "emptydir"
+
+	// storage backends - see Storage
+	s3Backend    = "s3"
+	localBackend = "local"
+
+	// labels (and annotations) for the k8s objects of a run
+	componentLabel    = "mariner-component"
+	runIDLabel        = "run-id"
+	userIDLabel       = "user-id"
+	taskIDLabel       = "task-id"
+	stepIDLabel       = "step-id"
+	scatterIndexLabel = "scatter-index"
+
+	// max length of the readable part of a task job name - see tool.jobName()
+	maxJobNamePrefixLength = 40
+
+	// runtime.tmpdir for task containers
+	taskTmpdir = "/tmp"
+
 	// log levels
 	infoLogLevel    = "INFO"
 	warningLogLevel = "WARNING"
@@ -86,8 +168,36 @@ const (
 	// log file name
 	logFile = "marinerLog.json"
 
-	// done flag - used by engine
-	doneFlag = "done"
+	// max size of a file whose contents can be loaded via loadContents, per the CWL spec
+	maxContentsSize = 64 * 1024
+
+	// file in a tool's working dir which the task container writes the tool's exit code to
+	exitCodeFile = "_mariner_exit_code"
+
+	// file in a tool's working dir which the s3sidecar writes if it fails - contains the reason
+	// the task container doesn't run the tool if this file exists
+	sidecarFailureMarker = "_mariner_sidecar_failed"
+
+	// files in a tool's working dir for the handshake between the s3sidecar and the task container - see status.go
+	taskExitFile   = "_mariner_task_exit.json"   // written by the task container once the tool exits
+	taskStatusFile = "_mariner_task_status.json" // written by the s3sidecar - the final status of the task
+
+	// file in a tool's working dir which the task container touches every taskHeartbeatPeriod seconds while it runs
+	// so the s3sidecar can tell the task container was killed without reporting the tool's exit - see sidecar/status.go
+	// the period is passed to the s3sidecar as TASK_HEARTBEAT_PERIOD, which it derives its heartbeat timeout from
+	taskHeartbeatFile   = "_mariner_task_heartbeat"
+	taskHeartbeatPeriod = 10
+
+	// seconds between the TERM and the KILL of a tool which exceeds its ToolTimeLimit - see containerArgs()
+	toolTimeLimitGracePeriod = 10
+
+	// seconds added to the deadline of a task job with a ToolTimeLimit, for image pull, input staging and output upload
+	// if not configured - see JobConfig.StagingAllowance
+	defaultStagingAllowance = 3600
+
+	// files in a tool's working dir to which the tool's stdout and stderr get tee'd, unless the CWL redirects them - see taskLogs()
+	stdoutLogFile = "_mariner_stdout.log"
+	stderrLogFile = "_mariner_stderr.log"
 
 	// workflow request file name
 	requestFile = "request.json"
@@ -98,18 +208,48 @@ const (
 	// metrics collection sampling period (in seconds)
 	metricsSamplingPeriod = 30
 
+	// period (in seconds) at which the engine flushes the run log, if it was updated - see logwriter.go
+	logFlushPeriod = 10
+
+	// task logs written (or fetched) at once
+	maxConcurrentLogWrites = 8
+
+	// period (in seconds) at which the engine checks the status of a running task job
+	jobStatusPollingPeriod = 5
+
+	// min period (in seconds) at which the engine lists the k8s events of a task pod which isn't progressing - see pods.go
+	podEventsPollingPeriod = 60
+
+	// time (in seconds) for which a task container may fail to pull its image before the task fails - see pods.go
+	// a failing pull may be transient - e.g., a registry rate limit or outage
+	imagePullTimeout = 600
+
+	// period (in seconds) at which the server garbage collects the PVCs of terminated runs
+	pvcReconcilePeriod = 300
+
+	// timeout (in seconds) of the engine's requests for remote files - see remote.go
+	remoteRequestTimeout = 60
+
+	// timeout (in seconds) of the engine's requests to indexd and DRS servers - see resolver.go
+	resolverRequestTimeout = 30
+
+	// the s3-compatible API of google cloud storage, at which gs:// URLs get read
+	gcsEndpoint = "https://storage.googleapis.com"
+
 	// paths for engine
 	//pathToCommonsData = "/commons-data/data/by-guid/"
 	pathToCommonsData = "/commons-data/"
 	pathToRunf        = "/engine-workspace/workflowRuns/%v/" // fill with runID
 	pathToLogf        = pathToRunf + logFile
-	pathToDonef       = pathToRunf + doneFlag
 	pathToRequestf    = pathToRunf + requestFile
 	pathToWorkingDirf = pathToRunf + "%v" // fill with runID
 
 	// paths for server
-	pathToUserRunsf   = "%v/workflowRuns/"                // fill with userID
-	pathToUserRunLogf = pathToUserRunsf + "%v/" + logFile // fill with runID
+	pathToUserRunsf       = "%v/workflowRuns/"                      // fill with userID
+	pathToUserRunLogf     = pathToUserRunsf + "%v/" + logFile       // fill with runID
+	pathToUserRunTaskLogf = pathToUserRunsf + "%v/taskLogs/%v.json" // fill with runID, escaped taskID
+
+	pathToUserRunScatterLogf = pathToUserRunsf + "%v/taskLogs/%v/scatter/%v.json" // fill with runID, escaped taskID, scatter index
 
 	commonsDataPersistentVolumeClaimName = "mariner-nfs-pvc"
 )
@@ -151,8 +291,8 @@ var gen3fusePrestopHook = &k8sv1.Lifecycle{
 	},
 }
 
-// only using jupyter asg for now - will have workflow asg in production
-// FIXME - put this in the manifest config
+// default tolerations for mariner jobs
+// only applied if no tolerations are configured for the component - see JobConfig.Scheduling
 var k8sTolerations = []k8sv1.Toleration{
 	{
 		Key:      "role",
@@ -168,17 +308,220 @@ type MarinerConfig struct {
 	Jobs       Jobs       `json:"jobs"`
 	Secrets    Secrets    `json:"secrets"`
 	Storage    Storage    `json:"storage"`
+	Formats    Formats    `json:"formats"`
+	Retries    Retries    `json:"retries"`
+	Images     Images     `json:"images"`
+	Software   Software   `json:"software"`
+	Resolver   Resolver   `json:"resolver"`
+}
+
+// Resolver .. - resolution of commons files, given as "COMMONS/<guid>" or as DRS URIs - see resolver.go
+type Resolver struct {
+	Indexd    string            `json:"indexd"`    // base URL of indexd - default "http://indexd-service"
+	DRSHosts  map[string]string `json:"drshosts"`  // {prefix: host} for compact DRS URIs, e.g., {"dg.4503": "gen3.biodatacatalyst.nhlbi.nih.gov"}
+	Cloud     string            `json:"cloud"`     // preferred cloud of access URLs - "aws" or "gcp"
+	Region    string            `json:"region"`    // preferred region of access URLs, e.g., "us-east-1"
+	BatchSize int               `json:"batchsize"` // GUIDs looked up per indexd request - default 100
+
+	// the user's token, from wts, is sent to the DRS API of the hosts of drshosts, and of these hosts - and no others
+	TrustedHosts []string `json:"trustedhosts"`
+	WTS          string   `json:"wts"` // base URL of wts - default "http://workspace-token-service"
+}
+
+func (conf *Resolver) indexdURL() string {
+	if conf.Indexd == "" {
+		return defaultIndexdURL
+	}
+	return strings.TrimSuffix(conf.Indexd, "/")
+}
+
+func (conf *Resolver) wtsURL() string {
+	if conf.WTS == "" {
+		return defaultWTSURL
+	}
+	return strings.TrimSuffix(conf.WTS, "/")
+}
+
+// trustedHosts returns the hosts of DRS APIs to which the user's token may be sent
+func (conf *Resolver) trustedHosts() map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range conf.DRSHosts {
+		hosts[host] = true
+	}
+	for _, host := range conf.TrustedHosts {
+		hosts[host] = true
+	}
+	return hosts
+}
+
+func (conf *Resolver) batchSize() int {
+	if conf.BatchSize <= 0 {
+		return defaultResolverBatchSize
+	}
+	return conf.BatchSize
+}
+
+// Images .. - policy for the images of task containers - see images.go
+type Images struct {
+	Default           string      `json:"default"`           // image for a tool with no DockerRequirement - default "ubuntu"
+	RequireDigest     bool        `json:"requiredigest"`     // if true, every image must be pinned to a digest, e.g., "ubuntu@sha256:<digest>"
+	AllowedRegistries []string    `json:"allowedregistries"` // if set, every image must come from one of these registries, e.g., ["quay.io", "docker.io"]
+	PullSecrets       PullSecrets `json:"pullsecrets"`
+}
+
+// PullSecrets .. - names of k8s image pull secrets for task pods, to pull images from private registries
+// the secrets for a run are the defaults, plus those of the user, plus those of the run's project (the "project" tag of the request)
+type PullSecrets struct {
+	Default  []string            `json:"default"`
+	Users    map[string][]string `json:"users"`    // {userID: [secret names]}
+	Projects map[string][]string `json:"projects"` // {project: [secret names]}
+}
+
+func (conf *Images) defaultImage() string {
+	if conf.Default == "" {
+		return defaultTaskContainerImage
+	}
+	return conf.Default
+}
+
+// Retries ..
+type Retries struct {
+	OOM            OOMRetries            `json:"oom"`
+	Infrastructure InfrastructureRetries `json:"infrastructure"`
+}
+
+// InfrastructureRetries .. - reschedules of a task lost to node loss, eviction or preemption
+type InfrastructureRetries struct {
+	MaxReschedules int `json:"maxreschedules"` // default 3 - a negative value disables reschedules
+}
+
+func (conf *InfrastructureRetries) maxReschedules() int {
+	if conf.MaxReschedules == 0 {
+		return defaultMaxReschedules
+	}
+	return conf.MaxReschedules
+}
+
+// OOMRetries .. - retries of a task whose container was OOMKilled, each with more memory than the last
+type OOMRetries struct {
+	MaxRetries int     `json:"maxretries"` // zero disables retries
+	Factor     float64 `json:"factor"`     // memory is multiplied by this factor on each retry - default 2
+	Ceiling    string  `json:"ceiling"`    // memory is never escalated past this quantity, e.g., "64Gi" - no ceiling if not set
+}
+
+// Formats ..
+type Formats struct {
+	// path to a json file of {formatIRI: [superclassIRIs]} pairs, e.g., derived from the EDAM ontology
+	// if not set, the format of a File input must exactly match a declared format
+	Ontology string `json:"ontology"`
+}
+
+// Software .. - resolution of SoftwareRequirement packages to container images - see software.go
+type Software struct {
+	// path to a json file of {package: {version: image}}, e.g., derived from the BioContainers registry
+	// the version "*" matches any version of the package
+	// if not set, a tool with no DockerRequirement runs in the default image
+	Mapping string `json:"mapping"`
 }
 
 // Storage ..
 type Storage struct {
-	S3 S3Config `json:"s3"`
+	Backend    string     `json:"backend"` // where run logs, requests and task working dirs are stored - "s3" (default) or "local"
+	S3         S3Config   `json:"s3"`
+	Local      Local      `json:"local"`
+	TaskVolume TaskVolume `json:"taskvolume"`
+	Transfers  Transfers  `json:"transfers"`
+	Remote     Remote     `json:"remote"`
+}
+
+// Remote .. - credentials with which the s3sidecar fetches File inputs given as remote URLs, and the engine reads them - see remote.go
+type Remote struct {
+	S3    RemoteCredentials `json:"s3"`    // {"id": .., "secret": ..} - if not set, objects are fetched anonymously
+	GS    RemoteCredentials `json:"gs"`    // HMAC key {"id": .., "secret": ..} - if not set, objects are fetched anonymously
+	HTTPS RemoteCredentials `json:"https"` // {"token": ..} - sent as a bearer token, only to the listed hosts
+}
+
+// RemoteCredentials .. - the k8s secret (and key within it) which holds the credentials for one URL scheme
+type RemoteCredentials struct {
+	Name  string   `json:"name"`
+	Key   string   `json:"key"`
+	Hosts []string `json:"hosts"` // https only - the hosts to which the token may be sent
+}
+
+// envVarSource returns the source of the env var holding these credentials, or nil if none are configured
+func (conf *RemoteCredentials) envVarSource() *k8sv1.EnvVarSource {
+	if conf.Name == "" {
+		return nil
+	}
+	return &k8sv1.EnvVarSource{
+		SecretKeyRef: &k8sv1.SecretKeySelector{
+			LocalObjectReference: k8sv1.LocalObjectReference{
+				Name: conf.Name,
+			},
+			Key: conf.Key,
+		},
+	}
+}
+
+// Transfers .. - s3 transfers by the s3sidecar of a task
+type Transfers struct {
+	MaxConcurrentFiles int `json:"maxconcurrentfiles"` // files transferred at once - default 32
+	PartSizeMB         int `json:"partsizemb"`         // part size of multipart transfers - default 64
+	PartConcurrency    int `json:"partconcurrency"`    // parts of a single file transferred at once - default 5
+}
+
+// TaskVolume .. - the volume which holds a task's working dir and staged inputs
+type TaskVolume struct {
+	Type         string `json:"type"`         // "pvc" (default) or "emptydir"
+	StorageClass string `json:"storageclass"` // storage class of the PVC - default "mariner-storage"
+	Size         string `json:"size"`         // size of the volume if the tool specifies no outdirMin/outdirMax - default "2Gi"
+}
+
+func (conf *TaskVolume) isEmptyDir() bool {
+	return strings.ToLower(conf.Type) == emptyDirVolumeType
+}
+
+func (conf *TaskVolume) storageClass() string {
+	if conf.StorageClass == "" {
+		return defaultTaskStorageClass
+	}
+	return conf.StorageClass
+}
+
+func (conf *TaskVolume) size() string {
+	if conf.Size == "" {
+		return defaultTaskVolumeSize
+	}
+	return conf.Size
+}
+
+func (conf *Storage) backend() string {
+	if conf.Backend == "" {
+		return s3Backend
+	}
+	return strings.ToLower(conf.Backend)
+}
+
+// checkTaskBackend returns an error if the storage backend can't back the tasks of a run
+// the s3sidecar of each task pod transfers the task's files to and from s3 - it can't reach the local backend
+func (conf *Storage) checkTaskBackend() error {
+	if backend := conf.backend(); backend != s3Backend {
+		return fmt.Errorf("running workflows requires the %v storage backend - the task pods transfer files via s3, so can't use %v storage", s3Backend, backend)
+	}
+	return nil
 }
 
 // S3Config ..
 type S3Config struct {
-	Name   string `json:"name"`
-	Region string `json:"region"`
+	Name     string `json:"name"`
+	Region   string `json:"region"`
+	Endpoint string `json:"endpoint"` // s3-compatible endpoint, e.g., "http://minio.default:9000" - if not set, aws s3
+}
+
+// Local .. - storage in a dir of the local filesystem, for serving run logs, statuses and task logs offline, e.g., in tests
+// running tasks on it is out of scope - the task pods transfer files via the s3sidecar, so runs get rejected with the local backend - see checkTaskBackend()
+type Local struct {
+	Root string `json:"root"`
 }
 
 // Containers ..
@@ -230,9 +573,36 @@ type Jobs struct {
 
 // JobConfig ..
 type JobConfig struct {
-	Labels         map[string]string `json:"labels"`
-	ServiceAccount string            `json:"serviceaccount"`
-	RestartPolicy  string            `json:"restart_policy"`
+	Labels         map[string]string     `json:"labels"`
+	ServiceAccount string                `json:"serviceaccount"`
+	RestartPolicy  string                `json:"restart_policy"`
+	Scheduling     Scheduling            `json:"scheduling"`
+	Profiles       map[string]Scheduling `json:"profiles"` // named scheduling profiles, which a tool may select via the mariner:Scheduling hint
+	Spot           *Scheduling           `json:"spot"`     // scheduling for tools which opt in to spot/preemptible capacity via the mariner:Scheduling hint
+
+	// seconds added to the job deadline of a task with a ToolTimeLimit - default 3600, a negative value adds none
+	// the deadline counts from job start, so it covers image pull, input staging and output upload as well as the tool
+	StagingAllowance int64 `json:"stagingallowance"`
+}
+
+func (conf *JobConfig) stagingAllowance() int64 {
+	switch {
+	case conf.StagingAllowance == 0:
+		return defaultStagingAllowance
+	case conf.StagingAllowance < 0:
+		return 0
+	}
+	return conf.StagingAllowance
+}
+
+// Scheduling .. - constraints on which nodes the pods of a job may run on
+// for info, see: https://kubernetes.io/docs/concepts/scheduling-eviction/
+type Scheduling struct {
+	Tolerations       []k8sv1.Toleration `json:"tolerations"`
+	NodeSelector      map[string]string  `json:"nodeselector"`
+	Affinity          *k8sv1.Affinity    `json:"affinity"`
+	PriorityClassName string             `json:"priorityclassname"`
+	RuntimeClassName  string             `json:"runtimeclassname"`
 }
 
 // Secrets ..
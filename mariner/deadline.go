@@ -0,0 +1,163 @@
+package mariner
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// this file contains code for enforcing time limits
+// 1. per task - the CWL ToolTimeLimit, which the task container enforces on the tool with `timeout`
+// ---- the task job's activeDeadlineSeconds is the time limit plus an allowance for image pull and file transfers - see taskJob()
+// 2. per run - the optional maxRunDuration of the workflow request, enforced by the engine
+//
+// see: https://www.commonwl.org/v1.1/CommandLineTool.html#ToolTimeLimit
+
+// resolveTimeLimit reads the ToolTimeLimit for the tool, if specified
+// `timelimit` is a number of seconds or an expression which returns one
+// a value of zero means no time limit
+func (tool *Tool) resolveTimeLimit() (err error) {
+	requirement := tool.Task.rawRequirement(CWLToolTimeLimit)
+	if requirement == nil {
+		return nil
+	}
+	tool.Task.infof("begin resolve time limit")
+	v := requirement["timelimit"]
+	if exp, ok := v.(string); ok && strings.HasPrefix(exp, "$") {
+		if v, err = tool.evalExpression(exp); err != nil {
+			return tool.Task.errorf("failed to evaluate timelimit expression: %v", err)
+		}
+	}
+	var seconds float64
+	switch x := v.(type) {
+	case float64:
+		seconds = x
+	case int64:
+		seconds = float64(x)
+	case int:
+		seconds = float64(x)
+	default:
+		return tool.Task.errorf("unexpected timelimit value: %v", v)
+	}
+	if seconds < 0 {
+		return tool.Task.errorf("negative timelimit: %v", seconds)
+	}
+	tool.TimeLimit = int64(math.Ceil(seconds))
+	tool.Task.infof("end resolve time limit: %vs", tool.TimeLimit)
+	return nil
+}
+
+// waitLimit returns the bound in seconds on the sidecar's wait for the tool to exit - zero means no bound
+// the tool gets killed toolTimeLimitGracePeriod after its time limit - the rest is slack for the task container to report its exit
+func (tool *Tool) waitLimit() int64 {
+	if tool.TimeLimit == 0 {
+		return 0
+	}
+	return tool.TimeLimit + 2*toolTimeLimitGracePeriod + taskHeartbeatPeriod
+}
+
+// runDeadline returns a channel which fires once the run exceeds the maxRunDuration of the request
+// if no maxRunDuration is specified, the returned channel never fires
+func (engine *K8sEngine) runDeadline() (<-chan time.Time, error) {
+	if engine.Log.Request.MaxRunDuration == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(engine.Log.Request.MaxRunDuration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxRunDuration: %v", err)
+	}
+	engine.infof("run will be cancelled if it exceeds maxRunDuration of %v", d)
+	return time.After(d), nil
+}
+
+// fail signals the engine that the run has failed
+// only the first failure is kept - the engine stops the run upon receiving it
+func (engine *K8sEngine) fail(err error) {
+	select {
+	case engine.Failures <- err:
+	default:
+	}
+}
+
+// stop stops the run with the given status - no task jobs get dispatched from here on
+// only the first call sets the status
+func (engine *K8sEngine) stop(status string) {
+	engine.stopOnce.Do(func() {
+		// waits for any dispatch in progress - so the job it creates gets cancelled along with the rest
+		engine.dispatchLock.Lock()
+		engine.stopStatus = status
+		close(engine.stopped)
+		engine.dispatchLock.Unlock()
+	})
+	engine.markStopped()
+}
+
+// markStopped sets the status of the main log to that with which the run stopped
+// under the log lock, since the workflow goroutine may still be updating the main log
+// so it gets set again right before the final flush - in case the workflow goroutine got to the main log in the meantime
+func (engine *K8sEngine) markStopped() {
+	if !engine.stopping() {
+		return
+	}
+	engine.Log.Lock()
+	engine.Log.Main.Status = engine.stopStatus
+	engine.Log.Unlock()
+}
+
+// stopping returns true if the run has stopped
+func (engine *K8sEngine) stopping() bool {
+	select {
+	case <-engine.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// cancelTaskJobs deletes all task jobs dispatched by this engine, along with their PVCs
+// and marks any unfinished tasks as cancelled
+// the task objects of the run are selected by label - see taskLabels()
+func (engine *K8sEngine) cancelTaskJobs() {
+	engine.infof("begin cancel task jobs")
+	selector := metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%v=%v,%v=%v", componentLabel, marinerTask, runIDLabel, labelValue(engine.RunID)),
+	}
+	deleteOption := metav1.NewDeleteOptions(0)
+	var deletionPropagation metav1.DeletionPropagation = "Background"
+	deleteOption.PropagationPolicy = &deletionPropagation
+
+	if _, jobsClient, _, _, err := k8sClient(k8sJobAPI); err != nil {
+		engine.warnf("failed to delete task jobs: %v", err)
+	} else if err = jobsClient.DeleteCollection(context.TODO(), *deleteOption, selector); err != nil {
+		engine.warnf("failed to delete task jobs: %v", err)
+	}
+
+	// delete the PVCs of this run's tasks - a task's PVC is otherwise only deleted once the task finishes
+	if coreClient, _, _, _, err := k8sClient(k8sCoreAPI); err != nil {
+		engine.warnf("failed to delete task PVCs: %v", err)
+	} else if err = coreClient.PersistentVolumeClaims(os.Getenv("GEN3_NAMESPACE")).DeleteCollection(context.TODO(), metav1.DeleteOptions{}, selector); err != nil {
+		engine.warnf("failed to delete task PVCs: %v", err)
+	}
+
+	engine.Log.Lock()
+	for _, log := range engine.Log.ByProcess {
+		log.cancel()
+	}
+	engine.Log.Unlock()
+	engine.infof("end cancel task jobs")
+}
+
+// marks this log, and the logs of any scattered subtasks, as cancelled - if not already finished
+func (log *Log) cancel() {
+	if log.Status == running || log.Status == notStarted {
+		log.Status = cancelled
+	}
+	for _, scatterLog := range log.Scatter {
+		scatterLog.cancel()
+	}
+}
@@ -0,0 +1,222 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// this file contains code for working with the raw packed CWL document
+// the cwl.go library doesn't parse every CWL field (e.g., outdirMin and tmpdirMin of ResourceRequirement)
+// so the engine keeps the raw packed document around and reads those fields from here
+//
+// NOTE: same as with Task.Root - it's SAFE TO READ from the document, but NOT SAFE TO WRITE to it
+
+// Document is the raw representation of a packed CWL workflow
+type Document struct {
+	Version    string                            // cwlVersion of the packed document
+	Namespaces map[string]string                 // $namespaces of the packed document
+	Processes  map[string]map[string]interface{} // {processID: raw process object} for each process in the $graph
+}
+
+// document unmarshals a packed CWL workflow into its raw representation
+func document(b []byte) (*Document, error) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal packed workflow: %v", err)
+	}
+	doc := &Document{
+		Namespaces: make(map[string]string),
+		Processes:  make(map[string]map[string]interface{}),
+	}
+	doc.Version, _ = raw["cwlVersion"].(string)
+	if namespaces, ok := raw["$namespaces"].(map[string]interface{}); ok {
+		for prefix, v := range namespaces {
+			if iri, ok := v.(string); ok {
+				doc.Namespaces[prefix] = iri
+			}
+		}
+	}
+	graph, ok := raw["$graph"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("packed workflow has no $graph")
+	}
+	for _, v := range graph {
+		process, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected object in $graph: %v", v)
+		}
+		id, _ := process["id"].(string)
+		doc.Processes[id] = process
+	}
+	return doc, nil
+}
+
+// versionAtLeast returns true if the cwlVersion of the document is at least the given version
+// versions look like "v1.0", "v1.1", "v1.2.0-dev1"
+func (doc *Document) versionAtLeast(version string) bool {
+	major, minor := cwlVersion(doc.Version)
+	wantMajor, wantMinor := cwlVersion(version)
+	if major != wantMajor {
+		return major > wantMajor
+	}
+	return minor >= wantMinor
+}
+
+// returns the major and minor numbers of a cwlVersion string
+func cwlVersion(version string) (major int, minor int) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(strings.SplitN(parts[1], "-", 2)[0])
+	}
+	return major, minor
+}
+
+// raw returns the raw cwl object for this task's process
+func (task *Task) raw() map[string]interface{} {
+	if task.Document == nil {
+		return nil
+	}
+	return task.Document.Processes[task.Root.ID]
+}
+
+// rawRequirement returns the raw requirement (or hint) of the given class
+// from this task's resolved requirements, or nil if none applies
+func (task *Task) rawRequirement(class string) map[string]interface{} {
+	if requirement := task.requirement(class); requirement != nil {
+		return requirement.Raw
+	}
+	return nil
+}
+
+// rawRequirements returns the list of raw requirements (or hints)
+// which may be given in the CWL either as a list or as a map keyed by class
+func rawRequirements(v interface{}) (requirements []map[string]interface{}) {
+	switch x := v.(type) {
+	case []interface{}:
+		for _, r := range x {
+			if requirement, ok := r.(map[string]interface{}); ok {
+				requirements = append(requirements, requirement)
+			}
+		}
+	case map[string]interface{}:
+		for class, r := range x {
+			if requirement, ok := r.(map[string]interface{}); ok {
+				withClass := map[string]interface{}{"class": class}
+				for k, val := range requirement {
+					withClass[k] = val
+				}
+				requirements = append(requirements, withClass)
+			}
+		}
+	}
+	return requirements
+}
+
+// rawInput returns the raw input parameter with the given ID from this task's process, or nil if not found
+func (task *Task) rawInput(id string) map[string]interface{} {
+	return task.rawParameter("inputs", id)
+}
+
+// rawOutput returns the raw output parameter with the given ID from this task's process, or nil if not found
+func (task *Task) rawOutput(id string) map[string]interface{} {
+	return task.rawParameter("outputs", id)
+}
+
+// rawParameter returns the raw parameter with the given ID from the "inputs" or "outputs" field of this task's process
+// parameters may be given in the CWL either as a list or as a map keyed by ID
+func (task *Task) rawParameter(field string, id string) map[string]interface{} {
+	switch params := task.raw()[field].(type) {
+	case []interface{}:
+		for _, v := range params {
+			if param, ok := v.(map[string]interface{}); ok && param["id"] == id {
+				return param
+			}
+		}
+	case map[string]interface{}:
+		for key, v := range params {
+			if param, ok := v.(map[string]interface{}); ok && (key == id || key == lastInPath(id)) {
+				return param
+			}
+		}
+	}
+	return nil
+}
+
+// sanitize returns a copy of the packed workflow without those fields
+// which the cwl.go library would panic on - mariner reads these fields from the raw document instead
+// e.g., `format` of an input parameter given as a list, or a ResourceRequirement field given as an expression
+func sanitize(b []byte) ([]byte, error) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal packed workflow: %v", err)
+	}
+	graph, _ := raw["$graph"].([]interface{})
+	for _, v := range graph {
+		process, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var inputs []interface{}
+		switch x := process["inputs"].(type) {
+		case []interface{}:
+			inputs = x
+		case map[string]interface{}:
+			for _, input := range x {
+				inputs = append(inputs, input)
+			}
+		}
+		for _, v := range inputs {
+			if input, ok := v.(map[string]interface{}); ok {
+				if _, ok := input["format"].(string); !ok {
+					delete(input, "format")
+				}
+			}
+		}
+		sanitizeResources(process)
+		switch steps := process["steps"].(type) {
+		case []interface{}:
+			for _, v := range steps {
+				if step, ok := v.(map[string]interface{}); ok {
+					sanitizeResources(step)
+				}
+			}
+		case map[string]interface{}:
+			for _, v := range steps {
+				if step, ok := v.(map[string]interface{}); ok {
+					sanitizeResources(step)
+				}
+			}
+		}
+	}
+	return json.Marshal(raw)
+}
+
+// removes the non-numeric fields of any ResourceRequirement in the requirements and hints of a process or step
+// cwl.go expects a number for each of these fields
+func sanitizeResources(process map[string]interface{}) {
+	for _, key := range []string{"requirements", "hints"} {
+		switch x := process[key].(type) {
+		case []interface{}:
+			for _, v := range x {
+				if requirement, ok := v.(map[string]interface{}); ok && requirement["class"] == CWLResourceRequirement {
+					sanitizeResourceFields(requirement)
+				}
+			}
+		case map[string]interface{}:
+			if requirement, ok := x[CWLResourceRequirement].(map[string]interface{}); ok {
+				sanitizeResourceFields(requirement)
+			}
+		}
+	}
+}
+
+func sanitizeResourceFields(requirement map[string]interface{}) {
+	for field, v := range requirement {
+		if _, ok := v.(float64); !ok && field != "class" {
+			delete(requirement, field)
+		}
+	}
+}
@@ -6,18 +6,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/robertkrimen/otto"
 	log "github.com/sirupsen/logrus"
 	cwl "github.com/uc-cdis/cwl.go"
+	"github.com/uc-cdis/mariner/storage"
 
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -42,6 +43,25 @@ type K8sEngine struct {
 	Manifest        *Manifest           // to pass the manifest to the gen3fuse container of each task pod
 	Log             *MainLog            //
 	KeepFiles       map[string]bool     // all the paths to not delete during basic file cleanup
+	FormatChecker   FormatChecker       // for checking the format of File inputs against the formats declared by tools
+	Failures        chan error          // the first task failure gets sent here, which stops the run
+
+	stopped      chan struct{} // closed once the run stops - on a failure, the deadline, or SIGTERM - see stop()
+	stopOnce     sync.Once
+	stopStatus   string       // the status with which the run stopped - set once stopped is closed
+	dispatchLock sync.RWMutex // held (read) by each job dispatch, so no job gets created once the run has stopped
+
+	logWriter *logWriter   // flushes the run log - see logwriter.go
+	remote    *remoteFiles // reads remote File inputs - see remote.go
+
+	sizeLock sync.Mutex
+	sizes    map[string]int64 // the sizes of the remote and S3 files of the run, by path - see loadSize()
+
+	podsLock sync.Mutex  // guards the setup of the pod watcher - see podWatcher()
+	pods     *podWatcher // caches the pods of the run, for the diagnosis of task pods - see pods.go
+
+	ownerOnce sync.Once              // guards the lookup of the engine job - see ownerReference()
+	owner     *metav1.OwnerReference // reference to the engine job, which owns the task jobs and PVCs of the run
 }
 
 // Tool represents a leaf in the graph of a workflow
@@ -57,27 +77,45 @@ type Tool struct {
 	JobName          string // if a k8s job (i.e., if a CommandLineTool)
 	JobID            string // if a k8s job (i.e., if a CommandLineTool)
 	WorkingDir       string
-	Command          *exec.Cmd
+	Command          *TaskCommand
 	StepInputMap     map[string]*cwl.StepInput
 	ExpressionResult map[string]interface{}
 	Task             *Task
 	S3Input          []*ToolS3Input
+	Resources        *ToolResources // resolved ResourceRequirement
+	ExitCode         *int           // exit code of the tool process, once it has run
+	TimeLimit        int64          // ToolTimeLimit in seconds; zero means no time limit
+	StagedInputSize  int64          // total size in bytes of the input files staged to the task's volume
+	CommonsData      bool           // true if any input file is a commons file - see usesCommonsData()
+	Failure          *TaskFailure   // diagnosed reason for the failure of the task pod, if any
 
-	// dev'ing
-	// need to load this with runtime context as per CWL spec
-	// https://www.commonwl.org/v1.0/CommandLineTool.html#Runtime_environment
-	// for now, only populating 'runtime.outdir'
+	diagnostics map[string]bool // diagnostics already written to the task's event log - see pods.go
+	podSeen     bool            // true once the pod of the current task job has been observed
+
+	pullFailingSince time.Time // when the task container started failing to pull its image, if it is - see diagnosePodStatus()
+	eventsListed     time.Time // when the k8s events of the task pod were last listed - see diagnosePod()
+
+	// loaded with runtime context as per CWL spec
+	// https://www.commonwl.org/v1.1/CommandLineTool.html#Runtime_environment
 	JSVM     *otto.Otto
 	InputsVM *otto.Otto
 }
 
 // TaskRuntimeJSContext gets loaded into the js vm
 // to allow in-line js expressions and parameter references in the CWL to be resolved
-// see: https://www.commonwl.org/v1.0/CommandLineTool.html#Runtime_environment
+// see: https://www.commonwl.org/v1.1/CommandLineTool.html#Runtime_environment
 //
-// NOTE: not currently supported: tmpdir, cores, ram, outdirSize, tmpdirSize
+// cores and ram are the reserved cores and mebibytes of RAM for the tool process
+// outdirSize and tmpdirSize are the reserved mebibytes of storage
+// exitCode is only populated for output evaluation, for CWL v1.1+
 type TaskRuntimeJSContext struct {
-	Outdir string `json:"outdir"`
+	Outdir     string `json:"outdir"`
+	Tmpdir     string `json:"tmpdir"`
+	Cores      int64  `json:"cores"`
+	RAM        int64  `json:"ram"`
+	OutdirSize int64  `json:"outdirSize"`
+	TmpdirSize int64  `json:"tmpdirSize"`
+	ExitCode   *int   `json:"exitCode,omitempty"`
 }
 
 // ToolS3Input ..
@@ -85,24 +123,81 @@ type ToolS3Input struct {
 	URL         string `json:"url"`           // S3 URL
 	Path        string `json:"path"`          // Local path for dl
 	InitWorkDir bool   `json:"init_work_dir"` // is this an initwkdir requirement?
+
+	// the access URLs of a remote file, if they can't be recovered from its path - tried in order - see remote.go
+	Sources []*AccessURL `json:"sources,omitempty"`
 }
 
 // Engine runs an instance of the mariner engine job
 func Engine(runID string) (err error) {
 	engine := engine(runID)
 
+	// the final state of the run gets flushed however the engine exits - this runs after the recover below
+	engine.logWriter.start()
+	defer func() {
+		engine.markStopped()
+		if e := engine.logWriter.close(); e != nil {
+			log.Errorf("failed to flush run log: %v", e)
+		}
+	}()
+
 	defer func() {
 		if r := recover(); r != nil {
-			engine.Log.Main.Status = failed
+			engine.stop(failed)
 			err = engine.errorf("mariner panicked: %v", r)
 		}
 	}()
 
+	if err = Config.Storage.checkTaskBackend(); err != nil {
+		engine.stop(failed)
+		return engine.errorf("failed to set up engine: %v", err)
+	}
+
 	if err = engine.loadRequest(); err != nil {
 		return engine.errorf("failed to load workflow request: %v", err)
 	}
-	if err = engine.runWorkflow(); err != nil {
-		return engine.errorf("failed to run workflow: %v", err)
+	engine.resolveCommonsFiles()
+	deadline, err := engine.runDeadline()
+	if err != nil {
+		return engine.errorf("failed to load run deadline: %v", err)
+	}
+
+	// the engine job gets SIGTERM'd when the run is cancelled - see cancelRun() in server.go
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	defer signal.Stop(sigterm)
+
+	// the workflow runs in its own goroutine
+	// so that the engine can stop the run as soon as a task fails or the run exceeds its deadline
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("mariner panicked: %v", r)
+			}
+		}()
+		done <- engine.runWorkflow()
+	}()
+
+	// the workflow goroutine may still be running when the run stops, so the run gets stopped before its task jobs get cancelled
+	select {
+	case err = <-done:
+		if err != nil {
+			engine.stop(failed)
+			return engine.errorf("failed to run workflow: %v", err)
+		}
+	case err = <-engine.Failures:
+		engine.stop(failed)
+		engine.cancelTaskJobs()
+		return engine.errorf("workflow run failed: %v", err)
+	case <-deadline:
+		engine.stop(timedOut)
+		engine.cancelTaskJobs()
+		return engine.errorf("workflow run exceeded maxRunDuration: %v", engine.Log.Request.MaxRunDuration)
+	case <-sigterm:
+		engine.stop(cancelled)
+		engine.cancelTaskJobs()
+		return engine.errorf("workflow run cancelled - engine received SIGTERM")
 	}
 
 	// turning off file cleanup because it's busted and must be fixed
@@ -111,6 +206,18 @@ func Engine(runID string) (err error) {
 	return err
 }
 
+// recoverTask is deferred in each goroutine spawned to run a task
+// a panic there would otherwise crash the engine before it flushes the run log
+// instead, the panic fails the task and the run, and the log gets flushed right away
+func (engine *K8sEngine) recoverTask(task *Task) {
+	if r := recover(); r != nil {
+		err := task.errorf("mariner panicked: %v", r)
+		task.Log.Status = failed
+		engine.fail(err)
+		engine.flushLog()
+	}
+}
+
 // get WorkflowRequestJSON from the run working directory in S3
 //
 // location of request:
@@ -120,23 +227,13 @@ func Engine(runID string) (err error) {
 //
 // key := fmt.Sprintf("/%s/workflowRuns/%s/%s", engine.UserID, engine.RunID, requestFile)
 func (engine *K8sEngine) fetchRequestFromS3() (*WorkflowRequest, error) {
-	sess := engine.S3FileManager.newS3Session()
-	downloader := s3manager.NewDownloader(sess)
-	buf := &aws.WriteAtBuffer{}
-
 	key := fmt.Sprintf("/%s/workflowRuns/%s/%s", engine.UserID, engine.RunID, requestFile)
 
-	s3Obj := &s3.GetObjectInput{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Key:    aws.String(key),
-	}
-
-	_, err := downloader.Download(buf, s3Obj)
+	b, err := storage.ReadAll(engine.S3FileManager.Storage, key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file, %v", err)
 	}
 
-	b := buf.Bytes()
 	r := &WorkflowRequest{}
 	err = json.Unmarshal(b, r)
 	if err != nil {
@@ -151,10 +248,14 @@ func engine(runID string) *K8sEngine {
 		FinishedProcs:   make(map[string]bool),
 		UnfinishedProcs: make(map[string]bool),
 		CleanupProcs:    make(map[CleanupKey]bool),
+		Failures:        make(chan error, 1),
+		stopped:         make(chan struct{}),
 		RunID:           runID,
 		UserID:          os.Getenv(userIDEnvVar),
 		Log:             mainLog(fmt.Sprintf(pathToLogf, runID)),
 	}
+	e.logWriter = newLogWriter(e)
+	e.sizes = make(map[string]int64)
 
 	fm := &S3FileManager{}
 
@@ -162,6 +263,19 @@ func engine(runID string) *K8sEngine {
 		log.Error("FAILED TO SETUP S3FILEMANAGER")
 	}
 	e.S3FileManager = fm
+
+	remote, err := newRemoteFiles(fm.AWSConfig)
+	if err != nil {
+		log.Errorf("failed to load credentials for remote files: %v", err)
+	}
+	e.remote = remote
+
+	checker, err := formatChecker()
+	if err != nil {
+		log.Errorf("failed to load format checker, falling back to exact format matching: %v", err)
+		checker = ExactFormatChecker{}
+	}
+	e.FormatChecker = checker
 	return e
 }
 
@@ -188,27 +302,33 @@ func (engine *K8sEngine) dispatchTask(task *Task) (err error) {
 	if err = engine.setupTool(tool); err != nil {
 		return engine.errorf("failed to setup tool: %v; error: %v", task.Root.ID, err)
 	}
+	// the task's PVC gets deleted whether or not the task succeeds
+	defer func() {
+		if err := engine.deletePVC(tool); err != nil {
+			engine.warnf("failed to delete pvc for tool: %v; error: %v", task.Root.ID, err)
+		}
+	}()
 	if err = engine.runTool(tool); err != nil {
 		return engine.errorf("failed to run tool: %v; error: %v", task.Root.ID, err)
 	}
 	if err = engine.collectOutput(tool); err != nil {
 		return engine.errorf("failed to collect output for tool: %v; error: %v", task.Root.ID, err)
 	}
-	if err = engine.deletePVC(tool); err != nil {
-		engine.warnf("failed to delete pvc for tool: %v", task.Root.ID)
-	}
 	engine.infof("end dispatch task: %v", task.Root.ID)
 	return nil
 }
 
+// deletePVC deletes the task's PVC, if one was created
 func (engine *K8sEngine) deletePVC(tool *Tool) error {
-	claimName := fmt.Sprintf("%s-claim", tool.JobName)
+	if tool.JobName == "" || Config.Storage.TaskVolume.isEmptyDir() {
+		return nil
+	}
 	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
 	if err != nil {
 		return err
 	}
-	err = coreClient.PersistentVolumeClaims(os.Getenv("GEN3_NAMESPACE")).Delete(context.TODO(), claimName, metav1.DeleteOptions{})
-	if err != nil {
+	err = coreClient.PersistentVolumeClaims(os.Getenv("GEN3_NAMESPACE")).Delete(context.TODO(), tool.claimName(), metav1.DeleteOptions{})
+	if err != nil && !k8sErrors.IsNotFound(err) {
 		return err
 	}
 	return nil
@@ -217,10 +337,11 @@ func (engine *K8sEngine) deletePVC(tool *Tool) error {
 // move proc from unfinished to finished stack
 func (engine *K8sEngine) finishTask(task *Task) {
 	engine.Lock()
-	defer engine.Unlock()
-
 	delete(engine.UnfinishedProcs, task.Root.ID)
 	engine.FinishedProcs[task.Root.ID] = true
+	engine.Unlock()
+
+	// no storage I/O under the engine lock
 	engine.finishTaskLog(task)
 
 	// task.Lock()
@@ -258,6 +379,9 @@ func (engine *K8sEngine) collectOutput(tool *Tool) (err error) {
 	tool.Task.infof("begin collect output")
 	switch class := tool.Task.Root.Class; class {
 	case CWLCommandLineTool:
+		if err = engine.loadExitCode(tool); err != nil {
+			return tool.Task.errorf("%v", err)
+		}
 		if err = engine.handleCLTOutput(tool); err != nil {
 			return tool.Task.errorf("%v", err)
 		}
@@ -290,23 +414,12 @@ func (task *Task) tool(runID string) *Tool {
 
 // should be called exactly once - when a tool is created in the first place
 // all other vm's created should be copied from this one
-// dev'ing
+// the runtime context here holds the CWL defaults until the tool's resources get resolved
 func (tool *Tool) newJSVM() *otto.Otto {
 	vm := otto.New()
-	runtime := &TaskRuntimeJSContext{Outdir: tool.WorkingDir}
-	/*
-		ctx := struct {
-			Runtime TaskRuntimeJSContext `json:"runtime"`
-		}{
-			*runtime,
-		}
-	*/
-	// runtimeJSVal, err := preProcessContext(ctx)
-	runtimeJSVal, err := preProcessContext(runtime)
-	if err != nil {
-		panic(fmt.Errorf("failed to preprocess runtime js context: %v", err))
+	if err := tool.setRuntime(vm); err != nil {
+		panic(fmt.Errorf("failed to load runtime js context: %v", err))
 	}
-	vm.Set("runtime", runtimeJSVal)
 	return vm
 }
 
@@ -339,26 +452,36 @@ func (task *Task) workingDir(runID string) string {
 
 func (engine *K8sEngine) writeFileInputListToS3(tool *Tool) error {
 	tool.Task.infof("being write file input list to s3")
-	sess := engine.S3FileManager.newS3Session()
-	uploader := s3manager.NewUploader(sess)
+	if err := engine.writeToWorkingDir(tool, inputFileListName, tool.S3Input); err != nil {
+		return fmt.Errorf("failed to upload file list to s3: %v", err)
+	}
+	tool.Task.infof("end write file input list to s3")
+	return nil
+}
+
+// writeCommandToS3 writes the tool's command to its working dir in s3, for the s3sidecar to write run.sh from
+func (engine *K8sEngine) writeCommandToS3(tool *Tool) error {
+	tool.Task.infof("begin write command to s3")
+	if err := engine.writeToWorkingDir(tool, commandFileName, tool.Command); err != nil {
+		return fmt.Errorf("failed to upload command to s3: %v", err)
+	}
+	tool.Task.infof("end write command to s3")
+	return nil
+}
 
-	key := filepath.Join(engine.S3FileManager.s3Key(tool.WorkingDir, engine.UserID), inputFileListName)
+// writeToWorkingDir writes the json representation of v to the file with the given name in the tool's working dir in s3
+func (engine *K8sEngine) writeToWorkingDir(tool *Tool, name string, v interface{}) error {
+	key := filepath.Join(engine.S3FileManager.s3Key(tool.WorkingDir, engine.UserID), name)
 
-	b, err := json.Marshal(tool.S3Input)
+	b, err := json.Marshal(v)
 	if err != nil {
 		return fmt.Errorf("failed to marshal json: %v", err)
 	}
 
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(b),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to upload file list to s3")
+	if err = engine.S3FileManager.Storage.Put(key, bytes.NewReader(b)); err != nil {
+		return err
 	}
-	log.Info("wrote input file list to s3 location:", result.Location)
-	tool.Task.infof("end write file input list to s3")
+	log.Info("wrote ", name, " to storage key:", key)
 	return nil
 }
 
@@ -376,6 +499,21 @@ func (engine *K8sEngine) setupTool(tool *Tool) (err error) {
 		return tool.Task.errorf("failed to load inputs to js vm: %v", err)
 	}
 
+	// resolve ToolTimeLimit, which becomes the deadline of the task job
+	if err = tool.resolveTimeLimit(); err != nil {
+		return tool.Task.errorf("failed to resolve time limit: %v", err)
+	}
+
+	// fail before dispatching the job if any File input has an incompatible format
+	if err = engine.checkInputFormats(tool); err != nil {
+		return tool.Task.errorf("failed input format check: %v", err)
+	}
+
+	// resolve ResourceRequirement and load the full runtime context to js vm
+	if err = tool.resolveResources(); err != nil {
+		return tool.Task.errorf("failed to resolve resource requirements: %v", err)
+	}
+
 	if err = engine.initWorkDirReq(tool); err != nil {
 		return tool.Task.errorf("failed to handle initWorkDir requirement: %v", err)
 	}
@@ -404,8 +542,22 @@ func (engine *K8sEngine) runTool(tool *Tool) (err error) {
 		if err = engine.runCommandLineTool(tool); err != nil {
 			return engine.errorf("failed to run CommandLineTool: %v; error: %v", tool.Task.Root.ID, err)
 		}
-		go engine.collectResourceMetrics(tool)
-		if err = engine.listenForDone(tool); err != nil {
+		for {
+			go engine.collectResourceMetrics(tool)
+			if err = engine.listenForDone(tool); err == nil {
+				break
+			}
+			// a task lost to an infrastructure failure gets rescheduled
+			// an OOMKilled task gets retried with more memory, if configured
+			retried, retryErr := engine.retry(tool)
+			if retryErr != nil {
+				return engine.errorf("failed to retry task: %v; error: %v", tool.Task.Root.ID, retryErr)
+			}
+			if !retried {
+				break
+			}
+		}
+		if err != nil {
 			return engine.errorf("failed to listen for task to finish: %v; error: %v", tool.Task.Root.ID, err)
 		}
 	default:
@@ -434,20 +586,58 @@ func (engine *K8sEngine) runCommandLineTool(tool *Tool) (err error) {
 
 // ListenForDone listens to k8s until the job status is COMPLETED
 // once that happens, calls a function to collect output and update engine's proc stacks
-// TODO: implement error handling, listen for errors and failures, retries as well
-// ----- handle the cases where the job status is not COMPLETED or RUNNING
+// if the job fails or exceeds its deadline, the task status is set accordingly and an error is returned
+// while waiting, the task pod gets diagnosed - a pod which can't recover (e.g., from a bad image) fails the task right away
+// TODO: implement retries
 func (engine *K8sEngine) listenForDone(tool *Tool) (err error) {
 	engine.infof("begin listen for task to finish: %v", tool.Task.Root.ID)
-	status := ""
-	for status != completed {
+	for {
 		jobInfo, err := jobStatusByID(tool.JobID)
 		if err != nil {
 			return engine.errorf("failed to get task job info: %v; error: %v", tool.Task.Root.ID, err)
 		}
-		status = jobInfo.Status
+		// diagnose on every poll, also once completed - the pod status carries the digest of the image which ran
+		failure, err := engine.diagnosePod(tool)
+		if err != nil {
+			tool.Task.warnf("failed to diagnose task pod: %v", err)
+		}
+		if jobInfo.Status != completed {
+			if failure != nil && failure.Fatal {
+				tool.Task.Log.Status = failed
+				if err = engine.deleteTaskJob(tool); err != nil {
+					tool.Task.warnf("failed to delete task job: %v", err)
+				}
+				return engine.errorf("task job failed: %v; reason: %v", tool.Task.Root.ID, failure)
+			}
+		}
+		switch jobInfo.Status {
+		case completed:
+			// the job succeeded, so any failure diagnosed on an earlier poll was transient - e.g., an eviction warning
+			tool.Failure = nil
+			if err = engine.checkTaskStatus(tool); err != nil {
+				tool.Task.Log.Status = failed
+				if tool.Failure != nil && tool.Failure.Reason == toolTimedOut {
+					tool.Task.Log.Status = timedOut
+				}
+				return engine.errorf("task failed: %v; reason: %v", tool.Task.Root.ID, err)
+			}
+			engine.infof("end listen for task to finish: %v", tool.Task.Root.ID)
+			return nil
+		case failed:
+			tool.Task.Log.Status = failed
+			if failure := engine.sidecarFailure(tool); failure != nil {
+				tool.Failure = failure
+			}
+			if tool.Failure != nil {
+				return engine.errorf("task job failed: %v; reason: %v", tool.Task.Root.ID, tool.Failure)
+			}
+			return engine.errorf("task job failed: %v", tool.Task.Root.ID)
+		case timedOut:
+			tool.Task.Log.Status = timedOut
+			return engine.errorf("task job exceeded its time limit of %vs: %v", tool.TimeLimit, tool.Task.Root.ID)
+		}
+		time.Sleep(jobStatusPollingPeriod * time.Second)
 	}
-	engine.infof("end listen for task to finish: %v", tool.Task.Root.ID)
-	return nil
 }
 
 // runExpressionTool uses the engine to dispatch a task job for a given tool to evaluate an expression.
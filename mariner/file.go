@@ -2,14 +2,14 @@ package mariner
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	pathLib "path"
 	"reflect"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 // this file contains code for handling/processing file objects
@@ -31,15 +31,17 @@ import (
 // --- could just create a wrapper around the File type,
 // --- like FileLog or something, which implements the desired, stripped JSON encodings
 type File struct {
-	Class          string  `json:"class"`          // always CWLFileType
-	Location       string  `json:"location"`       // path to file (same as `path`)
-	Path           string  `json:"path"`           // path to file
-	Basename       string  `json:"basename"`       // last element of location path
-	NameRoot       string  `json:"nameroot"`       // basename without file extension
-	NameExt        string  `json:"nameext"`        // file extension of basename
-	DirName        string  `json:"dirname"`        // name of directory containing the file
-	Contents       string  `json:"contents"`       // first 64 KiB of file as a string, if loadContents is true
-	SecondaryFiles []*File `json:"secondaryFiles"` // array of secondaryFiles
+	Class          string  `json:"class"`            // CWLFileType - or CWLDirectoryType, for a dir matched by an output glob
+	Location       string  `json:"location"`         // path to file (same as `path`)
+	Path           string  `json:"path"`             // path to file
+	Basename       string  `json:"basename"`         // last element of location path
+	NameRoot       string  `json:"nameroot"`         // basename without file extension
+	NameExt        string  `json:"nameext"`          // file extension of basename
+	DirName        string  `json:"dirname"`          // name of directory containing the file
+	Contents       string  `json:"contents"`         // contents of file (at most 64 KiB) as a string, if loadContents is true
+	Format         string  `json:"format,omitempty"` // IRI of the file format, if specified
+	Size           int64   `json:"size,omitempty"`   // size of file in bytes, if known
+	SecondaryFiles []*File `json:"secondaryFiles"`   // array of secondaryFiles
 	// S3Key          string  `json:"-"`
 }
 
@@ -62,6 +64,18 @@ func fileObject(path string) (fileObj *File) {
 	return fileObj
 }
 
+// directoryObject returns the CWL Directory object for the given path - e.g., a dir matched by an output glob
+// the Directory's listing isn't loaded
+func directoryObject(path string) *File {
+	path = strings.TrimSuffix(path, "/")
+	return &File{
+		Class:    CWLDirectoryType,
+		Location: path,
+		Path:     path,
+		Basename: lastInPath(path),
+	}
+}
+
 // pedantic splitting regarding leading periods in the basename
 // see: https://www.commonwl.org/v1.0/Workflow.html#File
 // the description of nameroot and nameext
@@ -120,6 +134,10 @@ func (engine *K8sEngine) loadSFilesFromPattern(tool *Tool, fileObj *File, suffix
 	// #no-fuse
 	fileExists, err := engine.fileExists(path)
 	switch {
+	case err != nil:
+		// e.g., a remote file which the engine can't access - which mustn't pass for a secondaryFile that doesn't exist
+		return tool.Task.errorf("failed to check whether secondaryFile %v exists: %v", path, err)
+
 	case fileExists:
 
 		fmt.Println("secondary file exists!!")
@@ -145,20 +163,25 @@ func (engine *K8sEngine) loadSFilesFromPattern(tool *Tool, fileObj *File, suffix
 	return nil
 }
 
-// check if this path exists in S3
+// check if this path exists in S3 - i.e., if it's the key of an object, or a dir which contains some object
+// not just a prefix of some key, since e.g. "a.bam" doesn't exist just because "a.bam.bai" does
 func (engine *K8sEngine) fileExists(path string) (bool, error) {
-	svc := s3.New(engine.S3FileManager.newS3Session())
-	objectList, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Prefix: aws.String(strings.TrimPrefix(engine.localPathToS3Key(path), "/")),
+	if remoteURL(path) != "" {
+		return engine.remote.exists(path)
+	}
+	key := engine.localPathToS3Key(path)
+	exists, err := engine.S3FileManager.Storage.Exists(key)
+	if err != nil || exists {
+		return exists, err
+	}
+	page, err := engine.S3FileManager.Storage.List(storage.ListOptions{
+		Prefix:  strings.TrimSuffix(key, "/") + "/",
+		MaxKeys: 1,
 	})
 	if err != nil {
 		return false, fmt.Errorf("failed to list s3 objects: %v", err)
 	}
-	if len(objectList.Contents) == 0 {
-		return false, nil
-	}
-	return true, nil
+	return len(page.Objects) > 0, nil
 }
 
 func (engine *K8sEngine) localPathToS3Key(path string) string {
@@ -170,22 +193,70 @@ func (engine *K8sEngine) s3KeyToLocalPath(key string) string {
 }
 
 // loadContents downloads contents for a file from the engine's S3 file manager to populate the file contents field.
+// per the CWL spec, it is an error to load the contents of a file larger than 64 KiB
 func (engine *K8sEngine) loadContents(file *File) (err error) {
-	sess := engine.S3FileManager.newS3Session()
-	downloader := s3manager.NewDownloader(sess)
+	if remoteURL(file.Location) != "" {
+		file.Contents, err = engine.remote.contents(file.Location)
+		return err
+	}
 	s3Key := engine.localPathToS3Key(file.Location)
-	buf := &aws.WriteAtBuffer{}
 	log.Debugf("here is the s3 file that we are downloading %s", s3Key)
-	s3Obj := &s3.GetObjectInput{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Key:    aws.String(s3Key),
-		Range:  aws.String(fmt.Sprintf("bytes=%v-%v", 0, 65536)),
+	// requesting one byte past the limit to detect files which are too large
+	body, err := engine.S3FileManager.Storage.GetRange(s3Key, 0, maxContentsSize+1)
+	if err != nil {
+		return fmt.Errorf("failed to download file, %v", err)
 	}
-	_, err = downloader.Download(buf, s3Obj)
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
 	if err != nil {
 		return fmt.Errorf("failed to download file, %v", err)
 	}
-	file.Contents = string(buf.Bytes())
+	if len(b) > maxContentsSize {
+		return fmt.Errorf("failed to load contents of file %v: file is larger than 64 KiB", file.Location)
+	}
+	file.Contents = string(b)
+	return nil
+}
+
+// loadSize populates the size field of a file
+// for commons files, the size comes from indexd - for remote files, from the remote URL - else from the file's object in the engine's S3 bucket
+// the sizes of remote and S3 files get cached for the run, since the same file may be the input of many tasks - e.g., each subtask of a scatter
+// (the records of commons files are cached by the resolver - see resolver.go)
+func (engine *K8sEngine) loadSize(file *File) (err error) {
+	if strings.HasPrefix(file.Path, pathToCommonsData) {
+		record, err := resolveCommonsFile(pathLib.Base(file.Path))
+		if err != nil {
+			return fmt.Errorf("failed to get indexed record: %v", err)
+		}
+		file.Size = record.Size
+		return nil
+	}
+	key := file.Location
+	if remoteURL(file.Path) != "" {
+		key = file.Path
+	}
+	engine.sizeLock.Lock()
+	size, ok := engine.sizes[key]
+	engine.sizeLock.Unlock()
+	if ok {
+		file.Size = size
+		return nil
+	}
+	if remoteURL(file.Path) != "" {
+		if size, err = engine.remote.size(file.Path); err != nil {
+			return err
+		}
+	} else {
+		obj, err := engine.S3FileManager.Storage.Stat(engine.localPathToS3Key(file.Location))
+		if err != nil {
+			return fmt.Errorf("failed to head s3 object: %v", err)
+		}
+		size = obj.Size
+	}
+	engine.sizeLock.Lock()
+	engine.sizes[key] = size
+	engine.sizeLock.Unlock()
+	file.Size = size
 	return nil
 }
 
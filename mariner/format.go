@@ -0,0 +1,181 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+// this file contains code for checking the `format` of File inputs against the format(s) declared by a tool
+// see the `format` field description: https://www.commonwl.org/v1.1/CommandLineTool.html#CommandInputParameter
+//
+// formats are IRIs, commonly abbreviated in the CWL using the $namespaces of the document
+// e.g., "edam:format_1930" -> "http://edamontology.org/format_1930"
+// all formats get expanded to full IRIs before being checked
+
+// FormatChecker decides whether the format of a File is compatible with the formats declared for an input parameter
+type FormatChecker interface {
+	Compatible(format string, declared []string) bool
+}
+
+// ExactFormatChecker requires the format of a File to exactly match one of the declared formats
+type ExactFormatChecker struct{}
+
+// Compatible ..
+func (ExactFormatChecker) Compatible(format string, declared []string) bool {
+	for _, d := range declared {
+		if format == d {
+			return true
+		}
+	}
+	return false
+}
+
+// OntologyFormatChecker additionally accepts a File whose format is a subclass of a declared format
+// e.g., per the EDAM ontology, "FASTQ-sanger" (format_1932) is a subclass of "FASTQ" (format_1930)
+type OntologyFormatChecker struct {
+	SuperClasses map[string][]string // {formatIRI: [IRIs of direct superclasses]}
+}
+
+// Compatible ..
+func (checker *OntologyFormatChecker) Compatible(format string, declared []string) bool {
+	visited := make(map[string]bool)
+	queue := []string{format}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if visited[cur] {
+			continue
+		}
+		visited[cur] = true
+		if (ExactFormatChecker{}).Compatible(cur, declared) {
+			return true
+		}
+		queue = append(queue, checker.SuperClasses[cur]...)
+	}
+	return false
+}
+
+// formatChecker returns the format checker specified in the mariner config
+// if an ontology is configured, formats are checked against it - else formats must match exactly
+func formatChecker() (FormatChecker, error) {
+	if Config.Formats.Ontology == "" {
+		return ExactFormatChecker{}, nil
+	}
+	b, err := ioutil.ReadFile(Config.Formats.Ontology)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read format ontology: %v", err)
+	}
+	checker := &OntologyFormatChecker{}
+	if err = json.Unmarshal(b, &checker.SuperClasses); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal format ontology: %v", err)
+	}
+	return checker, nil
+}
+
+// checkInputFormats validates the format of each File input against the format(s) declared for that input
+// a mismatch is an error, so the tool fails before its job is dispatched
+// a File with no format gets a warning, and is not checked
+func (engine *K8sEngine) checkInputFormats(tool *Tool) (err error) {
+	tool.Task.infof("begin check input formats")
+	for _, input := range tool.Task.Root.Inputs {
+		declared, ok := tool.Task.rawInput(input.ID)["format"]
+		if !ok || input.Provided == nil {
+			continue
+		}
+		formats, err := tool.declaredFormats(declared)
+		if err != nil {
+			return tool.Task.errorf("failed to resolve format for input: %v; error: %v", input.ID, err)
+		}
+		for _, f := range inputFiles(input.Provided.Raw) {
+			if f.Format == "" {
+				tool.Task.warnf("no format specified for file %v of input %v - skipping format check", f.Location, input.ID)
+				continue
+			}
+			format := tool.Task.Document.expandIRI(f.Format)
+			if !engine.FormatChecker.Compatible(format, formats) {
+				return tool.Task.errorf("file %v has format %v, which is incompatible with format(s) %v of input %v", f.Location, format, formats, input.ID)
+			}
+		}
+	}
+	tool.Task.infof("end check input formats")
+	return nil
+}
+
+// declaredFormats resolves the `format` field of an input parameter to a list of full IRIs
+// the field is a string or list of strings, any of which may be an expression
+func (tool *Tool) declaredFormats(declared interface{}) (formats []string, err error) {
+	var values []interface{}
+	switch x := declared.(type) {
+	case []interface{}:
+		values = x
+	default:
+		values = []interface{}{x}
+	}
+	for _, v := range values {
+		if s, ok := v.(string); ok && strings.HasPrefix(s, "$") {
+			if v, err = tool.evalExpression(s); err != nil {
+				return nil, err
+			}
+		}
+		switch x := v.(type) {
+		case string:
+			formats = append(formats, tool.Task.Document.expandIRI(x))
+		case []interface{}:
+			for _, f := range x {
+				s, ok := f.(string)
+				if !ok {
+					return nil, fmt.Errorf("unexpected format value: %v", f)
+				}
+				formats = append(formats, tool.Task.Document.expandIRI(s))
+			}
+		case nil:
+		default:
+			return nil, fmt.Errorf("unexpected format value: %v", v)
+		}
+	}
+	return formats, nil
+}
+
+// expandIRI expands an IRI abbreviated with a namespace prefix of the document
+// e.g., "edam:format_1930" -> "http://edamontology.org/format_1930"
+func (doc *Document) expandIRI(iri string) string {
+	if doc == nil {
+		return iri
+	}
+	parts := strings.SplitN(iri, ":", 2)
+	if len(parts) == 2 {
+		if namespace, ok := doc.Namespaces[parts[0]]; ok {
+			return namespace + parts[1]
+		}
+	}
+	return iri
+}
+
+// outputFormat resolves the `format` field of an output parameter - the format assigned to each File it collects
+// returns "" if the output parameter specifies no format
+func (tool *Tool) outputFormat(output *cwl.Output) (string, error) {
+	declared, ok := tool.Task.rawOutput(output.ID)["format"]
+	if !ok {
+		return "", nil
+	}
+	formats, err := tool.declaredFormats(declared)
+	if err != nil || len(formats) == 0 {
+		return "", err
+	}
+	return formats[0], nil
+}
+
+// returns the File objects of a loaded input value, if any
+func inputFiles(i interface{}) []*File {
+	switch x := i.(type) {
+	case *File:
+		return []*File{x}
+	case []*File:
+		return x
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package mariner
+
+import (
+	"testing"
+
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+// formatTestTool returns a tool with a single File input "#tool/reads" which declares the FASTQ format
+func formatTestTool() *Tool {
+	doc := &Document{
+		Namespaces: map[string]string{"edam": "http://edamontology.org/"},
+		Processes: map[string]map[string]interface{}{
+			"#tool": {
+				"id": "#tool",
+				"inputs": []interface{}{
+					map[string]interface{}{"id": "#tool/reads", "type": "File", "format": "edam:format_1930"},
+				},
+			},
+		},
+	}
+	return &Tool{
+		Task: &Task{
+			Root:     &cwl.Root{ID: "#tool", Inputs: cwl.Inputs{&cwl.Input{ID: "#tool/reads"}}},
+			Document: doc,
+			Log:      logger(),
+		},
+	}
+}
+
+func TestCheckInputFormats(t *testing.T) {
+	cases := []struct {
+		name    string
+		format  interface{}
+		checker FormatChecker
+		wantErr bool
+	}{
+		{"matching format", "edam:format_1930", ExactFormatChecker{}, false},
+		{"matching full IRI", "http://edamontology.org/format_1930", ExactFormatChecker{}, false},
+		{"mismatched format", "edam:format_2572", ExactFormatChecker{}, true},
+		{"no format", nil, ExactFormatChecker{}, false},
+		{
+			"subclass per ontology",
+			"edam:format_1932",
+			&OntologyFormatChecker{SuperClasses: map[string][]string{
+				"http://edamontology.org/format_1932": {"http://edamontology.org/format_1930"},
+			}},
+			false,
+		},
+		{"subclass without ontology", "edam:format_1932", ExactFormatChecker{}, true},
+	}
+	for _, c := range cases {
+		tool := formatTestTool()
+		raw := map[string]interface{}{"class": CWLFileType, "location": "/engine-workspace/reads.fq"}
+		if c.format != nil {
+			raw["format"] = c.format
+		}
+		f, err := processFile(tool, raw)
+		if err != nil {
+			t.Fatalf("%v: failed to process file: %v", c.name, err)
+		}
+		if want, _ := c.format.(string); f.Format != want {
+			t.Errorf("%v: processFile() format = %q, want %q", c.name, f.Format, want)
+		}
+		tool.Task.Root.Inputs[0].Provided = &cwl.Provided{Raw: f}
+		engine := &K8sEngine{FormatChecker: c.checker}
+		if err = engine.checkInputFormats(tool); (err != nil) != c.wantErr {
+			t.Errorf("%v: checkInputFormats() error = %v, want error %v", c.name, err, c.wantErr)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package mariner
+
+import (
+	"fmt"
+	"strings"
+
+	k8sv1 "k8s.io/api/core/v1"
+)
+
+// this file contains code for the image policy of task containers
+// 1. the digest of the image which actually ran gets recorded in the task log, for reproducibility
+// 2. optionally, images must be pinned to a digest - e.g., "ubuntu@sha256:<digest>" rather than "ubuntu"
+// 3. optionally, images must come from an allowlist of registries
+// 4. images from private registries get pulled using the image pull secrets configured for the user or project
+//
+// the policy is enforced for the images declared in a workflow when the run is requested,
+// and again by the engine for the image of each task - which may be a default or resolved image
+
+// check returns an error if the given image reference violates the configured image policy
+func (conf *Images) check(image string) error {
+	if conf.RequireDigest && !strings.Contains(image, "@sha256:") {
+		return fmt.Errorf("image %v is not pinned to a digest - use a reference of the form <image>@sha256:<digest>", image)
+	}
+	if len(conf.AllowedRegistries) > 0 {
+		registry := imageRegistry(image)
+		for _, allowed := range conf.AllowedRegistries {
+			if registry == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("image %v is from registry %v, which is not one of the allowed registries %v", image, registry, conf.AllowedRegistries)
+	}
+	return nil
+}
+
+// imageRegistry returns the registry host of an image reference
+// e.g., "quay.io/biocontainers/samtools:1.9" -> "quay.io"; "ubuntu" -> "docker.io"
+func imageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return defaultImageRegistry
+}
+
+// documentImages returns the images declared in the DockerRequirements (and hints) of a packed CWL document
+func documentImages(doc *Document) (images []string) {
+	var collect func(v interface{})
+	collect = func(v interface{}) {
+		for _, requirement := range rawRequirements(v) {
+			if requirement["class"] != CWLDockerRequirement {
+				continue
+			}
+			for _, field := range []string{"dockerPull", "dockerImageId"} {
+				if image, ok := requirement[field].(string); ok && image != "" {
+					images = append(images, image)
+				}
+			}
+		}
+	}
+	for _, process := range doc.Processes {
+		collect(process["requirements"])
+		collect(process["hints"])
+		var steps []interface{}
+		switch x := process["steps"].(type) {
+		case []interface{}:
+			steps = x
+		case map[string]interface{}:
+			for _, step := range x {
+				steps = append(steps, step)
+			}
+		}
+		for _, v := range steps {
+			if step, ok := v.(map[string]interface{}); ok {
+				collect(step["requirements"])
+				collect(step["hints"])
+			}
+		}
+	}
+	return images
+}
+
+// checkWorkflowImages checks the images declared in a packed CWL workflow against the configured image policy
+// along with the configured default image - which the tools without a DockerRequirement run in,
+// so that the run is rejected up front, rather than failing once one of those tools gets dispatched
+func checkWorkflowImages(workflow []byte) error {
+	if !Config.Images.RequireDigest && len(Config.Images.AllowedRegistries) == 0 {
+		return nil
+	}
+	if err := Config.Images.check(Config.Images.defaultImage()); err != nil {
+		return fmt.Errorf("default image for tools without a DockerRequirement: %v", err)
+	}
+	doc, err := document(workflow)
+	if err != nil {
+		return err
+	}
+	for _, image := range documentImages(doc) {
+		if err = Config.Images.check(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordImageDigest records the digest of the image which the task container actually ran in the task log
+// e.g., "ubuntu" -> "docker.io/library/ubuntu@sha256:<digest>"
+func (tool *Tool) recordImageDigest(status *k8sv1.ContainerStatus) {
+	if status.Name != taskContainerName || status.ImageID == "" {
+		return
+	}
+	imageID := status.ImageID
+	for _, prefix := range []string{"docker-pullable://", "docker://"} {
+		imageID = strings.TrimPrefix(imageID, prefix)
+	}
+	if !strings.Contains(imageID, "@") {
+		// a bare digest - e.g., "sha256:<digest>"
+		image := status.Image
+		if i := strings.Index(image, "@"); i >= 0 {
+			image = image[:i]
+		}
+		imageID = fmt.Sprintf("%v@%v", image, imageID)
+	}
+	if tool.Task.Log.ContainerImage != imageID {
+		tool.Task.infof("task container image %v resolved to %v", tool.Task.Log.ContainerImage, imageID)
+		tool.Task.Log.ContainerImage = imageID
+	}
+}
+
+// imagePullSecrets returns the image pull secrets for the task pods of this run
+func (engine *K8sEngine) imagePullSecrets() (secrets []k8sv1.LocalObjectReference) {
+	conf := Config.Images.PullSecrets
+	names := append([]string{}, conf.Default...)
+	names = append(names, conf.Users[engine.UserID]...)
+	if project := engine.Log.Request.Tags[projectTag]; project != "" {
+		names = append(names, conf.Projects[project]...)
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			secrets = append(secrets, k8sv1.LocalObjectReference{Name: name})
+		}
+	}
+	return secrets
+}
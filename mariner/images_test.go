@@ -0,0 +1,42 @@
+package mariner
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckWorkflowImages(t *testing.T) {
+	defer func(images Images) { Config.Images = images }(Config.Images)
+	const pinned = "quay.io/cdis/tool@sha256:0123456789abcdef"
+	workflow := []byte(`{
+		"cwlVersion": "v1.0",
+		"$graph": [
+			{"class": "Workflow", "id": "#main", "inputs": [], "outputs": [],
+				"steps": [{"id": "#main/a", "run": "#a.cwl", "in": [], "out": []}, {"id": "#main/b", "run": "#b.cwl", "in": [], "out": []}]},
+			{"class": "CommandLineTool", "id": "#a.cwl", "inputs": [], "outputs": [],
+				"requirements": [{"class": "DockerRequirement", "dockerPull": "` + pinned + `"}]},
+			{"class": "CommandLineTool", "id": "#b.cwl", "inputs": [], "outputs": []}
+		]
+	}`)
+
+	for _, c := range []struct {
+		name    string
+		images  Images
+		wantErr string
+	}{
+		{name: "no policy", images: Images{}},
+		{name: "unpinned default image", images: Images{RequireDigest: true}, wantErr: "default image"},
+		{name: "pinned default image", images: Images{RequireDigest: true, Default: "ubuntu@sha256:0123456789abcdef"}},
+		{name: "default image from another registry", images: Images{AllowedRegistries: []string{"quay.io"}}, wantErr: "default image"},
+		{name: "allowed registries", images: Images{AllowedRegistries: []string{"quay.io"}, Default: pinned}},
+	} {
+		Config.Images = c.images
+		err := checkWorkflowImages(workflow)
+		switch {
+		case c.wantErr == "" && err != nil:
+			t.Errorf("%v: checkWorkflowImages() error = %v", c.name, err)
+		case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+			t.Errorf("%v: checkWorkflowImages() error = %v, want %q", c.name, err, c.wantErr)
+		}
+	}
+}
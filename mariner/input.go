@@ -96,11 +96,11 @@ func (engine *K8sEngine) loadInput(tool *Tool, input *cwl.Input) (err error) {
 		return tool.Task.errorf("required input %s value not provided and no default specified", input.ID)
 	}
 	if key, needed := input.Types[0].NeedRequirement(); needed {
-		for _, req := range tool.Task.Root.Requirements {
+		if req := tool.Task.requirement(CWLSchemaDefRequirement); req != nil {
 			for _, requiredtype := range req.Types {
 				if requiredtype.Name == key {
 					input.RequiredType = &requiredtype
-					input.Requirements = tool.Task.Root.Requirements
+					input.Requirements = cwl.Requirements{req.Requirement}
 				}
 			}
 		}
@@ -111,15 +111,15 @@ func (engine *K8sEngine) loadInput(tool *Tool, input *cwl.Input) (err error) {
 
 func appendCommonsFileInfo(filePath string, tool *Tool) (err error) {
 	guid := pathLib.Base(filePath)
-	indexFile, err := getIndexedFileInfo(guid)
+	record, err := resolveCommonsFile(guid)
 	if err != nil {
 		return tool.Task.errorf("Unable to get indexed record: %v", err)
 	}
-	tool.Task.infof("Found indexed metadata: %v", indexFile)
-	// NOTE: we need a smarter way to know which url to get when there are multiple!
+	tool.Task.infof("Found indexed metadata: %+v", record)
+	// the preferred url, per the configured cloud and region - see resolver.go
 	tool.S3Input = append(tool.S3Input, &ToolS3Input{
-		URL:         indexFile.URLs[0],
-		Path:        pathLib.Join(pathToCommonsData, indexFile.Filename),
+		URL:         record.url(),
+		Path:        pathLib.Join(pathToCommonsData, record.Filename),
 		InitWorkDir: false,
 	})
 
@@ -140,8 +140,10 @@ func (tool *Tool) processFile(f interface{}) (file *File, err error) {
 		}
 	} else if !strings.HasPrefix(obj.Path, pathToCommonsData) {
 
-		// user files
+		// user files - and remote files, which have a URL
 		tool.S3Input = append(tool.S3Input, &ToolS3Input{
+			URL:         remoteURL(obj.Path),
+			Sources:     remoteSources(obj.Path),
 			Path:        obj.Path,
 			InitWorkDir: false,
 		})
@@ -159,6 +161,8 @@ func (tool *Tool) processFile(f interface{}) (file *File, err error) {
 
 		} else if !strings.HasPrefix(sf.Path, pathToCommonsData) {
 			tool.S3Input = append(tool.S3Input, &ToolS3Input{
+				URL:         remoteURL(sf.Path),
+				Sources:     remoteSources(sf.Path),
 				Path:        sf.Path,
 				InitWorkDir: false,
 			})
@@ -195,6 +199,8 @@ func processFile(tool *Tool, f interface{}) (*File, error) {
 	// Mapping:
 	// ---- COMMONS/<guid> -> /commons-data/by-guid/<guid>
 	// ---- USER/<path> -> /user-data/<path> // not implemented yet
+	// ---- <scheme>://<path> -> /engine-workspace/_mariner_remote/<scheme>/<path> // staged by the s3sidecar
+	// ---- drs://<id> -> the path of its preferred access URL, as above
 	// ---- <path> -> <path> // no path processing required, implies file lives in engine workspace
 	switch {
 	case strings.HasPrefix(path, commonsPrefix):
@@ -235,8 +241,30 @@ func processFile(tool *Tool, f interface{}) (*File, error) {
 	case strings.HasPrefix(path, conformancePrefix):
 		trimmedPath := strings.TrimPrefix(path, conformancePrefix)
 		path = strings.Join([]string{"/", conformanceVolumeName, "/", trimmedPath}, "")
+
+	case strings.HasPrefix(path, drsPrefix):
+		// a DRS URI gets resolved to its https access URLs, which get staged like any remote URL - the preferred one first
+		// (never its raw s3:// or gs:// URLs, which would get fetched with mariner's credentials - see resolver.go)
+		record, err := resolveCommonsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if path, err = stageRemoteFile(record.URLs); err != nil {
+			return nil, fmt.Errorf("failed to stage DRS object %v: %v", record.ID, err)
+		}
+
+	case isRemoteURL(path):
+		// "s3://bucket/path/to/file" -> "/engine-workspace/_mariner_remote/s3/bucket/path/to/file" - see remote.go
+		if path, err = stageRemoteFile([]*AccessURL{{URL: path}}); err != nil {
+			return nil, err
+		}
+	}
+	fileObj := fileObject(path)
+	// checked against the format(s) declared by the tool - see checkInputFormats()
+	if m, ok := f.(map[string]interface{}); ok {
+		fileObj.Format, _ = m["format"].(string)
 	}
-	return fileObject(path), nil
+	return fileObj, nil
 }
 
 // called in transformInput() routine
@@ -376,6 +404,8 @@ func (engine *K8sEngine) transformInput(tool *Tool, input *cwl.Input) (out inter
 					}
 				} else if !strings.HasPrefix(sf.Location, pathToCommonsData) {
 					tool.S3Input = append(tool.S3Input, &ToolS3Input{
+						URL:         remoteURL(sf.Location),
+						Sources:     remoteSources(sf.Location),
 						Path:        sf.Location,
 						InitWorkDir: false,
 					})
@@ -384,6 +414,39 @@ func (engine *K8sEngine) transformInput(tool *Tool, input *cwl.Input) (out inter
 		}
 	}
 
+	// file sizes are available as `inputs.<id>.size`, e.g., for ResourceRequirement expressions
+	// input files which are not commons files get staged to the task's volume, so they count toward its size
+	for _, fileObj := range inputFiles(out) {
+		for _, f := range append([]*File{fileObj}, fileObj.SecondaryFiles...) {
+			if strings.HasPrefix(f.Path, pathToCommonsData) {
+				// commons files are mounted by gen3fuse - see usesCommonsData()
+				tool.CommonsData = true
+			}
+			if err = engine.loadSize(f); err != nil {
+				if remoteURL(f.Path) != "" {
+					// the engine reads remote files with the same credentials as the s3sidecar - so the task would fail to stage it
+					return nil, tool.Task.errorf("failed to load size for remote file: %v; error: %v", remoteURL(f.Path), err)
+				}
+				tool.Task.warnf("failed to load size for file: %v; error: %v", f.Path, err)
+				continue
+			}
+			if !strings.HasPrefix(f.Path, pathToCommonsData) {
+				tool.StagedInputSize += f.Size
+			}
+		}
+	}
+
+	// loadContents is applied before valueFrom, so the contents are available as `self.contents`
+	if tool.loadContents(input) {
+		for _, fileObj := range inputFiles(out) {
+			tool.Task.infof("begin load contents for file: %v", fileObj.Path)
+			if err = engine.loadContents(fileObj); err != nil {
+				return nil, tool.Task.errorf("failed to load contents for input: %v; error: %v", input.ID, err)
+			}
+			tool.Task.infof("end load contents for file: %v", fileObj.Path)
+		}
+	}
+
 	if input.Binding != nil && input.Binding.ValueFrom != nil {
 		valueFrom := input.Binding.ValueFrom.String
 		if strings.HasPrefix(valueFrom, "$") {
@@ -410,6 +473,16 @@ func (engine *K8sEngine) transformInput(tool *Tool, input *cwl.Input) (out inter
 	return out, nil
 }
 
+// loadContents returns true if the contents of the given File input are to be loaded
+// either via `inputBinding.loadContents` or, for CWL v1.1+, via the input parameter's `loadContents` field
+func (tool *Tool) loadContents(input *cwl.Input) bool {
+	if input.Binding != nil && input.Binding.LoadContents {
+		return true
+	}
+	loadContents, _ := tool.Task.rawInput(input.ID)["loadContents"].(bool)
+	return loadContents
+}
+
 /*
 loadInputValue logic:
 1. take value from params
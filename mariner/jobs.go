@@ -8,6 +8,7 @@ import (
 
 	batchv1 "k8s.io/api/batch/v1"
 	k8sCore "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -102,6 +103,22 @@ func (tool *Tool) resourceUsage(podsClient corev1.PodInterface, label string) (c
 	return cpu, mem, nil
 }
 
+// deleteTaskJob deletes the tool's task job, along with its pod
+func (engine *K8sEngine) deleteTaskJob(tool *Tool) error {
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	deleteOption := metav1.NewDeleteOptions(0)
+	var deletionPropagation metav1.DeletionPropagation = "Background"
+	deleteOption.PropagationPolicy = &deletionPropagation
+	err = jobsClient.Delete(context.TODO(), tool.JobName, *deleteOption)
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
 // this job naming scheme makes the probability of having conflicting job names very low
 func createJobName() string {
 	return fmt.Sprintf("%v-%v", time.Now().Format("010206150405"), getRandString(5))
@@ -130,7 +147,9 @@ func (engine *K8sEngine) collectResourceMetrics(tool *Tool) error {
 		tool.Task.Log.Event.warnf("%v", err)
 		return err
 	}
-	label := fmt.Sprintf("job-name=%v,s3=yes,netnolimit=yes", tool.Task.Log.JobName)
+	// a retried task gets a new job - metrics for each attempt are collected by their own routine
+	jobName := tool.Task.Log.JobName
+	label := fmt.Sprintf("job-name=%v,s3=yes,netnolimit=yes", jobName)
 
 	engine.Lock()
 	tool.Task.Log.Stats.ResourceUsage.init() // #race #ok
@@ -144,13 +163,13 @@ func (engine *K8sEngine) collectResourceMetrics(tool *Tool) error {
 		}
 
 		// update logdb
-		engine.writeLogToS3()
+		engine.logUpdated()
 
 		// wait out sampling period duration to next sample
 		time.Sleep(metricsSamplingPeriod * time.Second)
 
 		tool.Task.Lock()
-		done = *tool.Task.Done // #race #ok
+		done = *tool.Task.Done || tool.Task.Log.JobName != jobName // #race #ok
 		tool.Task.Unlock()
 	}
 
@@ -161,10 +180,20 @@ func (engine *K8sEngine) collectResourceMetrics(tool *Tool) error {
 
 func (engine *K8sEngine) dispatchTaskJob(tool *Tool) error {
 	engine.infof("begin dispatch task job: %v", tool.Task.Root.ID)
+	// no new task jobs once the run has stopped - see stop()
+	engine.dispatchLock.RLock()
+	defer engine.dispatchLock.RUnlock()
+	if engine.stopping() {
+		return engine.errorf("run stopped - not dispatching job for task: %v", tool.Task.Root.ID)
+	}
 	batchJob, err := engine.taskJob(tool)
 	if err != nil {
 		return engine.errorf("failed to load job spec for task: %v; error: %v", tool.Task.Root.ID, err)
 	}
+	// the task's env is resolved along with the job spec, so the command gets written after
+	if err = engine.writeCommandToS3(tool); err != nil {
+		return engine.errorf("failed to write command for task: %v; error: %v", tool.Task.Root.ID, err)
+	}
 	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
 	if err != nil {
 		return engine.errorf("%v", err)
@@ -285,6 +314,19 @@ func k8sClient(k8sAPI string) (coreClient corev1.CoreV1Interface, jobsClient bat
 	return
 }
 
+// k8sClientset returns the clientset for the k8s cluster the engine runs in - e.g., for informers
+func k8sClientset() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get k8s in-cluster config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get k8s clientset: %v", err)
+	}
+	return clientset, nil
+}
+
 func jobByID(jc batchtypev1.JobInterface, jobID string) (*batchv1.Job, error) {
 	jobs, err := listMarinerJobs(jc)
 	if err != nil {
@@ -333,10 +375,16 @@ func jobStatusByID(jobID string) (*JobInfo, error) {
 }
 
 // see: https://kubernetes.io/docs/api-reference/batch/v1/definitions/#_v1_jobstatus
+// a job which was killed for exceeding its activeDeadlineSeconds has status timed-out
 func jobStatusToString(status *batchv1.JobStatus) string {
 	if status == nil {
 		return unknown
 	}
+	for _, condition := range status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == k8sCore.ConditionTrue && condition.Reason == "DeadlineExceeded" {
+			return timedOut
+		}
+	}
 	if status.Succeeded >= 1 {
 		return completed
 	}
@@ -373,6 +421,77 @@ func deleteCompletedJobs() error {
 	}
 }
 
+// background process that garbage collects task PVCs
+// the engine deletes each task's PVC once the task finishes,
+// so this only catches those PVCs leaked by runs which failed, were cancelled, or crashed
+func (server *Server) deleteOrphanedPVCs() {
+	for {
+		if err := server.reconcilePVCs(); err != nil {
+			fmt.Println("PVC garbage collection error: ", err)
+		}
+		time.Sleep(pvcReconcilePeriod * time.Second)
+	}
+}
+
+// reconcilePVCs deletes each task PVC whose run has reached a terminal state
+func (server *Server) reconcilePVCs() error {
+	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
+	if err != nil {
+		return err
+	}
+	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+	if err != nil {
+		return err
+	}
+	pvcClient := coreClient.PersistentVolumeClaims(os.Getenv("GEN3_NAMESPACE"))
+	pvcs, err := pvcClient.List(context.TODO(), metav1.ListOptions{LabelSelector: runIDLabel})
+	if err != nil {
+		return fmt.Errorf("failed to list PVCs: %v", err)
+	}
+	terminalByRun := make(map[string]bool)
+	for _, pvc := range pvcs.Items {
+		runID, userID := pvc.Annotations[runIDLabel], pvc.Annotations[userIDLabel]
+		terminal, ok := terminalByRun[runID]
+		if !ok {
+			terminal = server.runIsTerminal(jobsClient, userID, runID)
+			terminalByRun[runID] = terminal
+		}
+		if !terminal {
+			continue
+		}
+		fmt.Printf("Deleting PVC %v of run %v\n", pvc.Name, runID)
+		err = pvcClient.Delete(context.TODO(), pvc.Name, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			fmt.Println("Error deleting PVC: ", pvc.Name, err)
+		}
+	}
+	return nil
+}
+
+// a run is in a terminal state if the status of its main log is terminal,
+// or if its engine job no longer exists or is no longer active - e.g., if the engine crashed before updating the log
+func (server *Server) runIsTerminal(jobsClient batchtypev1.JobInterface, userID, runID string) bool {
+	if runLog, err := server.fetchRunLogIndex(userID, runID); err == nil && runLog.Main != nil {
+		switch runLog.Main.Status {
+		case completed, failed, cancelled, timedOut:
+			return true
+		}
+	}
+	// the engine job name is the run ID
+	job, err := jobsClient.Get(context.TODO(), runID, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	switch jobStatusToString(&job.Status) {
+	case completed, failed, timedOut:
+		return true
+	}
+	return false
+}
+
 // 'condition' is a jobStatus, as in a value returned by jobStatusToString()
 // NOTE: probably should pass a list of conditions, not a single string
 func deleteJobs(jobs []batchv1.Job, condition string, jobsClient batchtypev1.JobInterface) error {
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/robertkrimen/otto"
@@ -37,8 +36,7 @@ func (tool *Tool) evaluateExpression() (err error) {
 		return tool.Task.errorf("ExpressionTool expression did not return a JSON object: %v", tool.Task.Root.ID)
 	}
 	cmdPath := tool.WorkingDir + "expression.txt"
-	cmd := []string{"touch", cmdPath}
-	tool.Command = exec.Command(cmd[0], cmd[1:]...)
+	tool.Command = &TaskCommand{Args: []string{"touch", cmdPath}}
 	tool.Task.infof("end evaluate expression")
 	return nil
 }
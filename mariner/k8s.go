@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"strconv"
 	"strings"
 
 	batchv1 "k8s.io/api/batch/v1"
@@ -28,6 +29,9 @@ func workflowJob(workflowRequest *WorkflowRequest) (*batchv1.Job, error) {
 	// get job spec all populated except for pod volumes and containers
 	workflowJob := jobSpec(marinerEngine, workflowRequest.UserID, workflowRequest.JobName)
 
+	// the engine job name is the run ID
+	labelJob(workflowJob, map[string]string{runIDLabel: labelValue(workflowRequest.JobName)})
+
 	// fill in the rest of the spec
 	workflowJob.Spec.Template.Spec.Volumes = engineVolumes()
 
@@ -130,7 +134,8 @@ func engineEnv(r *WorkflowRequest) (env []k8sv1.EnvVar) {
 			ValueFrom: envVarAWSUserCreds,
 		},
 	}
-	return env
+	// the engine reads the sizes, contents and existence of remote inputs with the same credentials as the s3sidecar
+	return append(env, remoteCredsEnv()...)
 }
 
 type TokenPayload struct {
@@ -149,15 +154,42 @@ type TokenUser struct {
 
 func (engine *K8sEngine) taskJob(tool *Tool) (job *batchv1.Job, err error) {
 	engine.infof("begin load job spec for task: %v", tool.Task.Root.ID)
-	tool.JobName = createJobName()
+	tool.JobName = tool.jobName()
 	job = jobSpec(marinerTask, engine.UserID, tool.JobName)
+	labelJob(job, engine.taskLabels(tool))
+
+	// deleting the engine job cascades to the task jobs, via k8s garbage collection
+	if owner := engine.ownerReference(); owner != nil {
+		job.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+
+	// ToolTimeLimit - the launcher kills the tool once it has run this long - see containerArgs()
+	// k8s kills the job once it has been active for the time limit plus the staging allowance
+	// since the deadline counts from job start, so it includes image pull, input staging and output upload
+	if tool.TimeLimit > 0 {
+		deadline := tool.TimeLimit + Config.Jobs.Task.stagingAllowance()
+		job.Spec.ActiveDeadlineSeconds = &deadline
+	}
 
 	if engine.Log.Request.ServiceAccountName != "" {
 		job.Spec.Template.Spec.ServiceAccountName = engine.Log.Request.ServiceAccountName
 	}
 
+	// for pulling images from private registries
+	job.Spec.Template.Spec.ImagePullSecrets = engine.imagePullSecrets()
+
+	// per-tool scheduling overrides - e.g., to pin a memory-heavy step to a high-memory node group
+	scheduling, err := tool.scheduling()
+	if err != nil {
+		return nil, engine.errorf("failed to load scheduling constraints for task: %v; error: %v", tool.Task.Root.ID, err)
+	}
+	scheduling.apply(&job.Spec.Template.Spec)
+
 	// #ebs
-	job.Spec.Template.Spec.Volumes = engine.taskVolumes(tool)
+	job.Spec.Template.Spec.Volumes, err = engine.taskVolumes(tool)
+	if err != nil {
+		return nil, engine.errorf("failed to load volumes for task: %v; error: %v", tool.Task.Root.ID, err)
+	}
 
 	job.Spec.Template.Spec.Containers, err = engine.taskContainers(tool)
 	if err != nil {
@@ -174,14 +206,21 @@ func (engine *K8sEngine) taskContainers(tool *Tool) (containers []k8sv1.Containe
 		return nil, engine.errorf("failed to load task main container: %v; error: %v", tool.Task.Root.ID, err)
 	}
 	s3sidecar := engine.s3SidecarContainer(tool)
-	gen3fuse := gen3fuseContainer(engine.Manifest, marinerTask, engine.RunID)
 	workingDir := k8sv1.EnvVar{
 		Name:  "TOOL_WORKING_DIR",
-		Value: tool.WorkingDir, // #runtime - per CWL spec, this envVar in task should be "HOME"
+		Value: tool.WorkingDir, // HOME and TMPDIR for the task are set in tool.env()
 	}
-	gen3fuse.Env = append(gen3fuse.Env, workingDir)
 	task.Env = append(task.Env, workingDir)
-	containers = []k8sv1.Container{*task, *s3sidecar, *gen3fuse}
+	containers = []k8sv1.Container{*task, *s3sidecar}
+
+	// gen3fuse only runs in the pods of tasks which read commons data - see manifest.go
+	if tool.usesCommonsData() {
+		gen3fuse := gen3fuseContainer(engine.Manifest, marinerTask, engine.RunID)
+		gen3fuse.Env = append(gen3fuse.Env, workingDir)
+		containers = append(containers, *gen3fuse)
+	} else {
+		tool.Task.infof("task reads no commons data - not attaching gen3fuse")
+	}
 	engine.infof("end load container spec for tool: %v", tool.Task.Root.ID)
 	return containers, nil
 }
@@ -203,35 +242,84 @@ func (tool *Tool) taskContainer() (container *k8sv1.Container, err error) {
 	container.VolumeMounts = volumeMounts(marinerTask)
 	container.ImagePullPolicy = conf.pullPolicy()
 	container.Image = tool.dockerImage()
+	if err = Config.Images.check(container.Image); err != nil {
+		return nil, tool.Task.errorf("image not permitted: %v", err)
+	}
 	tool.Task.Log.ContainerImage = container.Image
 	if container.Resources, err = tool.resourceReqs(); err != nil {
 		return nil, tool.Task.errorf("failed to load cpu/mem info: %v", err)
 	}
+	if mount := tool.outputDirectoryMount(); mount != nil {
+		tool.Task.infof("mounting working dir at dockerOutputDirectory: %v", mount.MountPath)
+		container.VolumeMounts = append(container.VolumeMounts, *mount)
+	}
 	container.Args = tool.containerArgs()
-	container.Command = []string{tool.cltBash()}
+	container.Command = []string{posixShell}
 	if container.Env, err = tool.env(); err != nil {
 		return nil, tool.Task.errorf("failed to load env info: %v", err)
 	}
+	tool.Command.Env = make(map[string]string)
+	for _, envVar := range container.Env {
+		tool.Command.Env[envVar.Name] = envVar.Value
+	}
 	tool.Task.infof("end load main container spec")
 	return container, nil
 }
 
 // containerArgs creates the necessary command arguments in a tool container for sidecar.
+// the launcher is POSIX sh, since not every image has bash
+// the command script runs with bash if the image has it, otherwise with sh
+//
+// the task container waits for the sidecar to write run.sh, checking every second - or exits, if the sidecar failed
+// once the tool exits, its exit code and timestamps get written for the sidecar - see status.go
+// while the container runs, it touches a heartbeat file, so the sidecar notices if the container is killed outright
+// a tool with a ToolTimeLimit runs under `timeout`, if the image has one which supports `-k` - and gets killed once it exceeds its limit
 func (tool *Tool) containerArgs() []string {
 	tool.Task.infof("begin load container args")
 	args := []string{
 		"-c",
 		fmt.Sprintf(`
-			while [[ ! -f %vrun.sh ]]; do
-				echo "Waiting for sidecar to finish setting up..";
-				sleep 5
+			(while true; do touch %[1]v%[6]v; sleep %[7]v; done) &
+			heartbeat=$!
+			trap 'kill $heartbeat 2> /dev/null' EXIT
+			trap 'exit 143' TERM
+			echo "Waiting for sidecar to finish setting up.."
+			while [ ! -f %[1]vrun.sh ]; do
+				if [ -f %[1]v%[2]v ]; then
+					echo "Sidecar failed, not running command: $(cat %[1]v%[2]v)"
+					exit 1
+				fi
+				sleep 1
 			done
 			echo "Sidecar setup complete! Running command script now.."
-			cd %v
-			echo "running command $(cat %vrun.sh)"
-			%v %vrun.sh
-			touch %vdone
-			`, tool.WorkingDir, tool.WorkingDir, tool.WorkingDir, tool.cltBash(), tool.WorkingDir, tool.WorkingDir),
+			cd %[3]v
+			echo "running command $(cat %[1]vrun.sh)"
+			limit=""
+			if [ %[8]v -gt 0 ]; then
+				if timeout -k 1 1 true > /dev/null 2>&1; then
+					limit="timeout -k %[9]v %[8]v"
+				else
+					echo "timeout not found in image - the time limit of %[8]vs is only enforced by the job deadline"
+				fi
+			fi
+			started=$(date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ)
+			start=$(date +%%s)
+			if command -v bash > /dev/null 2>&1; then
+				$limit bash %[1]vrun.sh
+			else
+				echo "bash not found in image - running command script with sh"
+				$limit sh %[1]vrun.sh
+			fi
+			code=$?
+			timedout=false
+			if [ -n "$limit" ] && [ $code -ne 0 ] && [ $(($(date +%%s) - start)) -ge %[8]v ]; then
+				echo "tool exceeded its time limit of %[8]vs"
+				timedout=true
+			fi
+			echo $code > %[1]v%[4]v
+			printf '{"exitCode":%%s,"timedOut":%%s,"startedAt":"%%s","finishedAt":"%%s"}' "$code" "$timedout" "$started" "$(date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ)" > %[1]v%[5]v.tmp
+			mv %[1]v%[5]v.tmp %[1]v%[5]v
+			`, tool.WorkingDir, sidecarFailureMarker, tool.outputDirectory(), exitCodeFile, taskExitFile, taskHeartbeatFile, taskHeartbeatPeriod, tool.TimeLimit, toolTimeLimitGracePeriod),
 	}
 	tool.Task.infof("end load container args")
 	return args
@@ -243,26 +331,34 @@ func (tool *Tool) containerArgs() []string {
 // and: https://godoc.org/k8s.io/api/core/v1#EnvVar
 // and: https://kubernetes.io/docs/tasks/inject-data-application/define-environment-variable-container/
 //
-// todo: load in these required runtime envvars, per CWL spec
-// https://www.commonwl.org/v1.0/CommandLineTool.html#Runtime_environment
+// HOME and TMPDIR are always set, per CWL spec
+// https://www.commonwl.org/v1.1/CommandLineTool.html#Runtime_environment
 func (tool *Tool) env() (env []k8sv1.EnvVar, err error) {
 	tool.Task.infof("begin load environment variables")
-	env = []k8sv1.EnvVar{}
-	for _, requirement := range tool.Task.Root.Requirements {
-		if requirement.Class == CWLEnvVarRequirement {
-			for _, envDef := range requirement.EnvDef {
-				tool.Task.infof("begin handle envVar: %v", envDef.Name)
-				varValue, _, err := tool.resolveExpressions(envDef.Value) // resolves any expression(s) - if no expressions, returns original text
-				if err != nil {
-					return nil, tool.Task.errorf("failed to resolve expression: %v; error: %v", envDef.Value, err)
-				}
-				envVar := k8sv1.EnvVar{
-					Name:  envDef.Name,
-					Value: varValue,
-				}
-				env = append(env, envVar)
-				tool.Task.infof("end handle envVar: %v", envDef.Name)
+	runtime := tool.runtime()
+	env = []k8sv1.EnvVar{
+		{
+			Name:  "HOME",
+			Value: runtime.Outdir,
+		},
+		{
+			Name:  "TMPDIR",
+			Value: runtime.Tmpdir,
+		},
+	}
+	if requirement := tool.Task.requirement(CWLEnvVarRequirement); requirement != nil {
+		for _, envDef := range requirement.EnvDef {
+			tool.Task.infof("begin handle envVar: %v", envDef.Name)
+			varValue, _, err := tool.resolveExpressions(envDef.Value) // resolves any expression(s) - if no expressions, returns original text
+			if err != nil {
+				return nil, tool.Task.errorf("failed to resolve expression: %v; error: %v", envDef.Value, err)
 			}
+			envVar := k8sv1.EnvVar{
+				Name:  envDef.Name,
+				Value: varValue,
+			}
+			env = append(env, envVar)
+			tool.Task.infof("end handle envVar: %v", envDef.Name)
 		}
 	}
 	tool.Task.infof("end load environment variables")
@@ -289,10 +385,6 @@ func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 			Name:  "MARINER_COMPONENT", // flag to tell setup sidecar script this is a task, not an engine job
 			Value: marinerTask,
 		},
-		{
-			Name:  "TOOL_COMMAND", // the command from the commandlinetool to actually execute
-			Value: strings.Join(tool.Command.Args, " "),
-		},
 		{
 			Name:  "TOOL_WORKING_DIR", // the tool's working directory - e.g., '/engine-workspace/workflowRuns/{runID}/{taskID}/'
 			Value: tool.WorkingDir,
@@ -305,10 +397,26 @@ func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 			Name:  "S3_BUCKET_NAME",
 			Value: Config.Storage.S3.Name,
 		},
+		{
+			Name:  "MAX_CONCURRENT_TRANSFERS",
+			Value: strconv.Itoa(Config.Storage.Transfers.MaxConcurrentFiles),
+		},
+		{
+			Name:  "TRANSFER_PART_SIZE_MB",
+			Value: strconv.Itoa(Config.Storage.Transfers.PartSizeMB),
+		},
+		{
+			Name:  "TRANSFER_PART_CONCURRENCY",
+			Value: strconv.Itoa(Config.Storage.Transfers.PartConcurrency),
+		},
 		{
 			Name:  "S3_REGION",
 			Value: Config.Storage.S3.Region,
 		},
+		{
+			Name:  "S3_ENDPOINT",
+			Value: Config.Storage.S3.Endpoint,
+		},
 		{
 			Name:  "CONFORMANCE_INPUT_S3_PREFIX",
 			Value: conformanceInputS3Prefix,
@@ -317,6 +425,14 @@ func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 			Name:  "CONFORMANCE_INPUT_DIR",
 			Value: conformanceVolumeName,
 		},
+		{
+			Name:  "TASK_TIME_LIMIT", // bounds the sidecar's wait on the task container - zero means the default bound
+			Value: strconv.FormatInt(tool.waitLimit(), 10),
+		},
+		{
+			Name:  "TASK_HEARTBEAT_PERIOD", // how often the task container touches its heartbeat file, in seconds - see containerArgs()
+			Value: strconv.Itoa(taskHeartbeatPeriod),
+		},
 	}
 
 	conformanceTestFlag := k8sv1.EnvVar{
@@ -330,52 +446,118 @@ func (engine *K8sEngine) s3SidecarEnv(tool *Tool) (env []k8sv1.EnvVar) {
 
 	env = append(env, conformanceTestFlag)
 
+	// credentials for fetching remote inputs - see remote.go
+	env = append(env, remoteCredsEnv()...)
+
+	return env
+}
+
+// remoteCredsEnv returns the env vars holding the credentials for remote inputs, per URL scheme - see remote.go
+func remoteCredsEnv() (env []k8sv1.EnvVar) {
+	remote := Config.Storage.Remote
+	for _, creds := range []struct {
+		name string
+		conf *RemoteCredentials
+	}{
+		{remoteS3CredsEnvVar, &remote.S3},
+		{remoteGSCredsEnvVar, &remote.GS},
+		{remoteHTTPSCredsEnvVar, &remote.HTTPS},
+	} {
+		if source := creds.conf.envVarSource(); source != nil {
+			env = append(env, k8sv1.EnvVar{Name: creds.name, ValueFrom: source})
+		}
+	}
+	if len(remote.HTTPS.Hosts) > 0 {
+		env = append(env, k8sv1.EnvVar{Name: remoteHTTPSHostsEnvVar, Value: strings.Join(remote.HTTPS.Hosts, ",")})
+	}
 	return env
 }
 
 // for marinerTask job
-// replace disallowed job name characters
-// Q: is there a better job-naming scheme?
-// fixme - #shared-root
+// returns a readable, DNS-safe job name - the step name, the scatter index (if a scattered subtask), and a random suffix
+// e.g., "#main/align_reads" -> "main-align-reads-3-xkcdq"
+// job names are kept short, since the names of the job's pod and PVC are derived from it
 func (tool *Tool) jobName() string {
 	tool.Task.infof("begin resolve k8s job name")
-	taskID := tool.Task.Root.ID
-	jobName := strings.ReplaceAll(taskID, "#", "")
-	jobName = strings.ReplaceAll(jobName, "_", "-")
-	jobName = strings.ToLower(jobName)
+	jobName := strings.ToLower(labelValue(tool.Task.stepID()))
+	jobName = strings.NewReplacer("_", "-", ".", "-").Replace(jobName)
 	if tool.Task.ScatterIndex != 0 {
 		// indicates this task is a scattered subtask of a task which was scattered
-		// in order to not dupliate k8s job names - append suffix with ScatterIndex to job name
-		jobName = fmt.Sprintf("%v-scattered-%v", jobName, tool.Task.ScatterIndex)
+		jobName = fmt.Sprintf("%v-%v", jobName, tool.Task.ScatterIndex)
+	}
+	if len(jobName) > maxJobNamePrefixLength {
+		jobName = jobName[len(jobName)-maxJobNamePrefixLength:]
+	}
+	jobName = strings.Trim(jobName, "-")
+	if jobName == "" {
+		jobName = marinerTask
 	}
+	// in order to not duplicate k8s job names - e.g., across runs of the same workflow
+	jobName = fmt.Sprintf("%v-%v", jobName, getRandString(5))
 	tool.Task.infof("end resolve k8s job name. resolved job name: %v", jobName)
 	return jobName
 }
 
 // handles the DockerRequirement if specified and returns the image to be used for the CommandLineTool
-// note: presently only supporting use of the `dockerPull` CWL field
-// fixme - handle remaining DockerRequirement options
+// `dockerPull` takes precedence over `dockerImageId`, which is taken as an image reference
+// with no DockerRequirement, the image may be resolved from the tool's SoftwareRequirement - see software.go
+// note: `dockerLoad`, `dockerFile` and `dockerImport` are not supported
 func (tool *Tool) dockerImage() string {
 	tool.Task.infof("begin load docker image")
-	for _, requirement := range tool.Task.Root.Requirements {
-		if requirement.Class == CWLDockerRequirement {
-			if requirement.DockerPull != "" {
-				tool.Task.infof("end load docker image. loaded image: %v", string(requirement.DockerPull))
-				return string(requirement.DockerPull)
-			}
+	if requirement := tool.Task.requirement(CWLDockerRequirement); requirement != nil {
+		if requirement.DockerPull != "" {
+			tool.Task.infof("end load docker image. loaded image: %v", string(requirement.DockerPull))
+			return string(requirement.DockerPull)
+		}
+		// cwl.go doesn't parse `dockerImageId`
+		if imageID, ok := requirement.Raw["dockerImageId"].(string); ok && imageID != "" {
+			tool.Task.infof("end load docker image. loaded image from dockerImageId: %v", imageID)
+			return imageID
 		}
 	}
-	tool.Task.infof("end load docker image. loaded default task image: %v", defaultTaskContainerImage)
-	return defaultTaskContainerImage
+	image, err := tool.softwareImage()
+	switch {
+	case err != nil:
+		tool.Task.warnf("failed to resolve SoftwareRequirement to an image: %v", err)
+	case image != "":
+		tool.Task.infof("end load docker image. loaded image resolved from SoftwareRequirement: %v", image)
+		return image
+	}
+	image = Config.Images.defaultImage()
+	tool.Task.infof("end load docker image. loaded default task image: %v", image)
+	return image
 }
 
-// fixme
-// Q: how to handle case of different possible bash, depending on CLT image specified in CWL?
-func (tool *Tool) cltBash() string {
-	if tool.dockerImage() == "alpine" {
-		return "/bin/sh"
+// outputDirectory returns the tool's designated output directory, as seen from inside the task container
+// this is the DockerRequirement's `dockerOutputDirectory` if specified, otherwise the tool's working dir
+// the working dir gets mounted at the `dockerOutputDirectory` path, so outputs are still collected from the working dir
+func (tool *Tool) outputDirectory() string {
+	if requirement := tool.Task.requirement(CWLDockerRequirement); requirement != nil && requirement.DockerOutputDirectory != "" {
+		return strings.TrimSuffix(requirement.DockerOutputDirectory, "/") + "/"
+	}
+	return tool.WorkingDir
+}
+
+// workingDirPath maps a path under the tool's `dockerOutputDirectory` to the same path under the tool's working dir
+// paths elsewhere are returned unchanged
+func (tool *Tool) workingDirPath(path string) string {
+	if outdir := tool.outputDirectory(); outdir != tool.WorkingDir && strings.HasPrefix(path, outdir) {
+		return tool.WorkingDir + strings.TrimPrefix(path, outdir)
+	}
+	return path
+}
+
+// outputDirectoryMount mounts the tool's working dir at its `dockerOutputDirectory`, if specified
+func (tool *Tool) outputDirectoryMount() *k8sv1.VolumeMount {
+	outdir := tool.outputDirectory()
+	if outdir == tool.WorkingDir {
+		return nil
+	}
+	return &k8sv1.VolumeMount{
+		Name:      engineWorkspaceVolumeName,
+		MountPath: strings.TrimSuffix(outdir, "/"),
+		SubPath:   strings.Trim(strings.TrimPrefix(tool.WorkingDir, fmt.Sprintf("/%v", engineWorkspaceVolumeName)), "/"),
 	}
-	return "/bin/bash"
 }
 
 // only set limits when they are specified in the CWL
@@ -383,7 +565,9 @@ func (tool *Tool) cltBash() string {
 // the `Resources` field
 // for k8s resource info see: https://kubernetes.io/docs/concepts/configuration/manage-compute-resources-container/
 //
-// NOTE: presently only supporting req's for cpu cores and RAM - need to implement outdir and tmpdir and whatever other fields are allowed
+// NOTE: cpu cores and RAM map to the task container's resources, tmpdir to its ephemeral-storage
+// ----- outdir sizes the task's PVC - see tool.volumeSize()
+// ----- the requirement itself gets resolved in tool.resolveResources()
 func (tool *Tool) resourceReqs() (k8sv1.ResourceRequirements, error) {
 	tool.Task.infof("begin handle resource requirements")
 	var cpuReq, cpuLim int64
@@ -393,36 +577,53 @@ func (tool *Tool) resourceReqs() (k8sv1.ResourceRequirements, error) {
 	resourceReqs := Config.Containers.Task.resourceRequirements()
 
 	// discern user specified settings
+	// for info on quantities, see: https://godoc.org/k8s.io/apimachinery/pkg/api/resource#Quantity
 	requests, limits := make(k8sv1.ResourceList), make(k8sv1.ResourceList)
-	for _, requirement := range tool.Task.Root.Requirements {
-		if requirement.Class == CWLResourceRequirement {
-			// for info on quantities, see: https://godoc.org/k8s.io/apimachinery/pkg/api/resource#Quantity
-			if requirement.CoresMin > 0 {
-				cpuReq = int64(requirement.CoresMin)
-				tool.Task.Log.Stats.CPUReq.Min = cpuReq
-				requests[k8sv1.ResourceCPU] = *k8sResource.NewQuantity(cpuReq, k8sResource.DecimalSI)
-			}
+	resources := tool.Resources
+	if resources == nil {
+		return resourceReqs, tool.Task.errorf("resource requirements not resolved")
+	}
+	// fractional cores are allowed - expressed to k8s in millicores
+	// NOTE: CPUReq in the task stats stays in whole cores (rounded up) - CPUReqMillicores holds the exact request
+	if resources.CoresMin > 0 {
+		cpuReq = int64(math.Ceil(resources.CoresMin * 1000))
+		tool.Task.Log.Stats.CPUReq.Min = int64(math.Ceil(resources.CoresMin))
+		tool.Task.Log.Stats.CPUReqMillicores.Min = cpuReq
+		requests[k8sv1.ResourceCPU] = *k8sResource.NewMilliQuantity(cpuReq, k8sResource.DecimalSI)
+	}
 
-			if requirement.CoresMax > 0 {
-				cpuLim = int64(requirement.CoresMax)
-				tool.Task.Log.Stats.CPUReq.Max = cpuLim
-				limits[k8sv1.ResourceCPU] = *k8sResource.NewQuantity(cpuLim, k8sResource.DecimalSI)
-			}
+	if resources.CoresMax > 0 {
+		cpuLim = int64(math.Ceil(resources.CoresMax * 1000))
+		tool.Task.Log.Stats.CPUReq.Max = int64(math.Ceil(resources.CoresMax))
+		tool.Task.Log.Stats.CPUReqMillicores.Max = cpuLim
+		limits[k8sv1.ResourceCPU] = *k8sResource.NewMilliQuantity(cpuLim, k8sResource.DecimalSI)
+	}
 
-			// Memory is provided in mebibytes (1 mebibyte is 2**20 bytes)
-			// here we convert mebibytes to bytes
-			if requirement.RAMMin > 0 {
-				memReq = int64(requirement.RAMMin * int(math.Pow(2, 20)))
-				tool.Task.Log.Stats.MemoryReq.Min = memReq
-				requests[k8sv1.ResourceMemory] = *k8sResource.NewQuantity(memReq, k8sResource.DecimalSI)
-			}
+	// Memory is provided in mebibytes (1 mebibyte is 2**20 bytes)
+	// here we convert mebibytes to bytes
+	if resources.RAMMin > 0 {
+		memReq = resources.RAMMin * int64(math.Pow(2, 20))
+		tool.Task.Log.Stats.MemoryReq.Min = memReq
+		requests[k8sv1.ResourceMemory] = *k8sResource.NewQuantity(memReq, k8sResource.DecimalSI)
+	}
 
-			if requirement.RAMMax > 0 {
-				memLim = int64(requirement.RAMMax * int(math.Pow(2, 20)))
-				tool.Task.Log.Stats.MemoryReq.Max = memLim
-				limits[k8sv1.ResourceMemory] = *k8sResource.NewQuantity(memLim, k8sResource.DecimalSI)
-			}
-		}
+	if resources.RAMMax > 0 {
+		memLim = resources.RAMMax * int64(math.Pow(2, 20))
+		tool.Task.Log.Stats.MemoryReq.Max = memLim
+		limits[k8sv1.ResourceMemory] = *k8sResource.NewQuantity(memLim, k8sResource.DecimalSI)
+	}
+
+	// tmpdir is on the container's filesystem, so it maps to the ephemeral-storage of the task container
+	if resources.TmpdirMin > 0 {
+		requests[k8sv1.ResourceEphemeralStorage] = *k8sResource.NewQuantity(resources.TmpdirMin*int64(math.Pow(2, 20)), k8sResource.BinarySI)
+	}
+
+	if resources.TmpdirMax > 0 {
+		limits[k8sv1.ResourceEphemeralStorage] = *k8sResource.NewQuantity(resources.TmpdirMax*int64(math.Pow(2, 20)), k8sResource.BinarySI)
+	}
+
+	if resources.TmpdirMin > 0 && resources.TmpdirMax > 0 && resources.TmpdirMax < resources.TmpdirMin {
+		return resourceReqs, tool.Task.errorf("tmpdir maximum specified less than tmpdir minimum specified")
 	}
 
 	// sanity check for negative requirements
@@ -478,26 +679,31 @@ func baseContainer(conf *Container, component string) (container *k8sv1.Containe
 }
 
 // two volumes:
-// 1. engine workspace
+// 1. engine workspace - a PVC (or an emptyDir, per the task volume config) which holds the tool's working dir and staged inputs
 // 2. commons data
 // #ebs
-func (engine *K8sEngine) taskVolumes(tool *Tool) []k8sv1.Volume {
+func (engine *K8sEngine) taskVolumes(tool *Tool) ([]k8sv1.Volume, error) {
 	vols := []k8sv1.Volume{}
-	var claimName string
 	var v *k8sv1.Volume
-	var err error
 	for _, volName := range workflowVolumeList {
 		v = new(k8sv1.Volume)
 		v.Name = volName
 		if volName == engineWorkspaceVolumeName {
-			claimName = fmt.Sprintf("%s-claim", tool.JobName)
-			if err = engine.createPVC(claimName); err != nil {
-				// only for debugging / dev'ing
-				// don't actually handle the err like this
-				panic(fmt.Sprintf("failed to create PVC: %v", err))
+			size, err := tool.volumeSize()
+			if err != nil {
+				return nil, engine.errorf("failed to compute task volume size: %v", err)
 			}
-			v.PersistentVolumeClaim = &k8sv1.PersistentVolumeClaimVolumeSource{
-				ClaimName: claimName,
+			if Config.Storage.TaskVolume.isEmptyDir() {
+				v.EmptyDir = &k8sv1.EmptyDirVolumeSource{
+					SizeLimit: &size,
+				}
+			} else {
+				if err = engine.createPVC(tool, size); err != nil {
+					return nil, engine.errorf("failed to create PVC: %v", err)
+				}
+				v.PersistentVolumeClaim = &k8sv1.PersistentVolumeClaimVolumeSource{
+					ClaimName: tool.claimName(),
+				}
 			}
 		} else if volName == commonsDataVolumeName {
 			v.PersistentVolumeClaim = &k8sv1.PersistentVolumeClaimVolumeSource{
@@ -508,43 +714,139 @@ func (engine *K8sEngine) taskVolumes(tool *Tool) []k8sv1.Volume {
 		}
 		vols = append(vols, *v)
 	}
-	return vols
+	return vols, nil
 }
 
-func (engine *K8sEngine) createPVC(claimName string) error {
+// volumeSize returns the size of the task's volume
+// which holds both the tool's working dir (outdir) and the input files staged by the s3sidecar
+// so the size is the outdir reservation (or the configured default size, if no outdirMin/outdirMax) plus the size of the staged inputs
+func (tool *Tool) volumeSize() (size k8sResource.Quantity, err error) {
+	if size, err = k8sResource.ParseQuantity(Config.Storage.TaskVolume.size()); err != nil {
+		return size, fmt.Errorf("invalid task volume size: %v", err)
+	}
+	if tool.Resources != nil {
+		if outdir := reserved(tool.Resources.OutdirMin, tool.Resources.OutdirMax, 0); outdir > 0 {
+			size = *k8sResource.NewQuantity(outdir*int64(math.Pow(2, 20)), k8sResource.BinarySI)
+		}
+	}
+	size.Add(*k8sResource.NewQuantity(tool.StagedInputSize, k8sResource.BinarySI))
+	return size, nil
+}
 
-	// todo - add to config or at least don't hardcode here
-	storageClassName := "mariner-storage"
+// the name of the task's PVC
+func (tool *Tool) claimName() string {
+	return fmt.Sprintf("%s-claim", tool.JobName)
+}
 
+// createPVC creates the task's PVC
+// PVCs are labelled with the run ID and task ID, so that the server can garbage collect them - see deleteOrphanedPVCs()
+func (engine *K8sEngine) createPVC(tool *Tool, size k8sResource.Quantity) error {
+	storageClassName := Config.Storage.TaskVolume.storageClass()
 	pvc := &k8sv1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: claimName, // todo: add annotations, labels
+			Name:   tool.claimName(),
+			Labels: engine.taskLabels(tool),
+			// label values are restricted, so keep the exact IDs in annotations
+			Annotations: map[string]string{
+				runIDLabel:  engine.RunID,
+				taskIDLabel: tool.Task.Root.ID,
+				userIDLabel: engine.UserID,
+			},
 		},
 		Spec: k8sv1.PersistentVolumeClaimSpec{
 			StorageClassName: &storageClassName,
 			AccessModes:      []k8sv1.PersistentVolumeAccessMode{k8sv1.ReadWriteOnce},
 			Resources: k8sv1.ResourceRequirements{
 				Requests: k8sv1.ResourceList{
-					// todo - don't hardcode here - put in manifest config
-					k8sv1.ResourceStorage: k8sResource.MustParse("2Gi"),
+					k8sv1.ResourceStorage: size,
 				},
 			},
 		},
 	}
+	// deleting the engine job cascades to the PVC, via k8s garbage collection
+	if owner := engine.ownerReference(); owner != nil {
+		pvc.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
 	coreClient, _, _, _, err := k8sClient(k8sCoreAPI)
 	if err != nil {
-		// todo: actually handle this err
-		fmt.Println("failed to fetch podsClient:", err)
+		return fmt.Errorf("failed to fetch core client: %v", err)
 	}
 	_, err = coreClient.PersistentVolumeClaims(os.Getenv("GEN3_NAMESPACE")).Create(context.TODO(), pvc, metav1.CreateOptions{})
 	if err != nil {
-		// and this one
-		fmt.Println("FAILED TO CREATE PVC:", err)
 		return err
 	}
+	engine.infof("created PVC %v of size %v for task: %v", pvc.Name, size.String(), tool.Task.Root.ID)
 	return nil
 }
 
+// taskLabels returns the labels for the k8s objects of a task - i.e., its job, pod and PVC
+// so that all the objects of a run can be selected by label - e.g., `kubectl get jobs,pods,pvc -l run-id=<runID>`
+func (engine *K8sEngine) taskLabels(tool *Tool) map[string]string {
+	labels := map[string]string{
+		componentLabel: marinerTask,
+		runIDLabel:     labelValue(engine.RunID),
+		userIDLabel:    labelValue(engine.UserID),
+		taskIDLabel:    labelValue(tool.Task.Root.ID),
+		stepIDLabel:    labelValue(tool.Task.stepID()),
+	}
+	if tool.Task.ScatterIndex != 0 {
+		labels[scatterIndexLabel] = strconv.Itoa(tool.Task.ScatterIndex)
+	}
+	return labels
+}
+
+// adds the given labels to a job and to its pod template
+func labelJob(job *batchv1.Job, labels map[string]string) {
+	for _, meta := range []*metav1.ObjectMeta{&job.ObjectMeta, &job.Spec.Template.ObjectMeta} {
+		if meta.Labels == nil {
+			meta.Labels = make(map[string]string)
+		}
+		for k, v := range labels {
+			meta.Labels[k] = v
+		}
+	}
+}
+
+// ownerReference returns a reference to the engine job, for the k8s objects created by the engine
+// the engine job is looked up once - if it can't be found, objects are created without an owner
+func (engine *K8sEngine) ownerReference() *metav1.OwnerReference {
+	engine.ownerOnce.Do(func() {
+		_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
+		if err != nil {
+			engine.warnf("failed to fetch engine job - task objects will have no owner: %v", err)
+			return
+		}
+		// the engine job name is the run ID
+		job, err := jobsClient.Get(context.TODO(), engine.RunID, metav1.GetOptions{})
+		if err != nil {
+			engine.warnf("failed to fetch engine job - task objects will have no owner: %v", err)
+			return
+		}
+		engine.owner = &metav1.OwnerReference{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+			Name:       job.Name,
+			UID:        job.UID,
+		}
+	})
+	return engine.owner
+}
+
+// labelValue converts a string to a valid k8s label value
+// i.e., at most 63 characters, alphanumerics, '-', '_' or '.', beginning and ending with an alphanumeric
+func labelValue(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			b[i] = '-'
+		}
+	}
+	if len(b) > 63 {
+		b = b[len(b)-63:]
+	}
+	return strings.Trim(string(b), "-_.")
+}
+
 // returns marinerEngine/marinerTask job spec with all fields populated EXCEPT volumes and containers
 func jobSpec(component string, userID string, jobName string) (job *batchv1.Job) {
 
@@ -552,12 +854,20 @@ func jobSpec(component string, userID string, jobName string) (job *batchv1.Job)
 	job = new(batchv1.Job)
 	job.Kind, job.APIVersion = "Job", "v1"
 	// meta for pod and job objects are same
-	job.Name, job.Labels = jobName, jobConfig.Labels
-	job.Labels["s3"] = "yes"
-	job.Labels["netnolimit"] = "yes"
-	job.Spec.Template.Name, job.Spec.Template.Labels = jobName, jobConfig.Labels
+	// copy the configured labels, so as not to modify the config across jobs
+	labels := make(map[string]string)
+	for k, v := range jobConfig.Labels {
+		labels[k] = v
+	}
+	labels["s3"] = "yes"
+	labels["netnolimit"] = "yes"
+	labels[componentLabel] = component
+	labels[userIDLabel] = labelValue(userID)
+	job.Name, job.Labels = jobName, labels
+	job.Spec.Template.Name, job.Spec.Template.Labels = jobName, labels
 	job.Spec.Template.Spec.RestartPolicy = jobConfig.restartPolicy()
 	job.Spec.Template.Spec.Tolerations = k8sTolerations
+	jobConfig.Scheduling.apply(&job.Spec.Template.Spec)
 
 	if component == marinerEngine {
 		job.Spec.Template.Spec.ServiceAccountName = jobConfig.ServiceAccount
@@ -0,0 +1,73 @@
+package mariner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runLauncher runs the task container's launcher under sh, with the given command script, and returns the exit it reports
+func runLauncher(t *testing.T, script string, timeLimit int64) map[string]interface{} {
+	dir := t.TempDir() + "/"
+	if err := ioutil.WriteFile(filepath.Join(dir, "run.sh"), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tool := &Tool{WorkingDir: dir, TimeLimit: timeLimit, Task: &Task{Log: logger()}}
+	args := tool.containerArgs()
+	cmd := exec.Command("sh", args...)
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("launcher didn't exit")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, taskExitFile))
+	if err != nil {
+		t.Fatalf("failed to read task exit file: %v", err)
+	}
+	exit := make(map[string]interface{})
+	if err = json.Unmarshal(b, &exit); err != nil {
+		t.Fatalf("failed to unmarshal task exit file %s: %v", b, err)
+	}
+	return exit
+}
+
+func TestLauncher(t *testing.T) {
+	exit := runLauncher(t, "exit 3\n", 0)
+	if exit["exitCode"] != float64(3) || exit["timedOut"] != false {
+		t.Errorf("exit = %v, want exit code 3, not timed out", exit)
+	}
+	exit = runLauncher(t, "exit 3\n", 60)
+	if exit["exitCode"] != float64(3) || exit["timedOut"] != false {
+		t.Errorf("exit within time limit = %v, want exit code 3, not timed out", exit)
+	}
+
+	if err := exec.Command("timeout", "-k", "1", "1", "true").Run(); err != nil {
+		t.Skipf("no timeout which supports -k: %v", err)
+	}
+	start := time.Now()
+	exit = runLauncher(t, "sleep 30\n", 1)
+	if exit["timedOut"] != true || exit["exitCode"] == float64(0) {
+		t.Errorf("exit of tool over its time limit = %v, want timed out", exit)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("tool over its time limit of 1s ran for %v", elapsed)
+	}
+}
+
+func TestStagingAllowance(t *testing.T) {
+	for allowance, want := range map[int64]int64{0: defaultStagingAllowance, 600: 600, -1: 0} {
+		conf := &JobConfig{StagingAllowance: allowance}
+		if got := conf.stagingAllowance(); got != want {
+			t.Errorf("stagingAllowance() with %v configured = %v, want %v", allowance, got, want)
+		}
+	}
+}
@@ -1,16 +1,13 @@
 package mariner
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 // TODO - write json encodings for all this AFTER implementing it
@@ -19,68 +16,66 @@ import (
 // MainLog is the interface for writing logs to workflowHistorydb
 type MainLog struct {
 	sync.RWMutex `json:"-"`
-	Path         string           `json:"path"` // tentative  - maybe can't write this - path to log file to write/update
-	Request      *WorkflowRequest `json:"request"`
-	Main         *Log             `json:"main"`
-	ByProcess    map[string]*Log  `json:"byProcess"`
+	Path         string                 `json:"path"` // tentative  - maybe can't write this - path to log file to write/update
+	Request      *WorkflowRequest       `json:"request"`
+	Main         *Log                   `json:"main"`
+	ByProcess    map[string]*Log        `json:"byProcess"`
+	Tasks        map[string]*TaskLogRef `json:"tasks,omitempty"` // index of the task logs, which are stored as their own objects - see logwriter.go
 }
 
 // MainLogJSON gets written to workflowHistorydb
 type MainLogJSON struct {
-	Path      string           `json:"path"` // tentative  - maybe can't write this - path to log file to write/update
-	Request   *WorkflowRequest `json:"request"`
-	Main      *Log             `json:"main"`
-	ByProcess map[string]*Log  `json:"byProcess"`
+	Path      string                 `json:"path"` // tentative  - maybe can't write this - path to log file to write/update
+	Request   *WorkflowRequest       `json:"request"`
+	Main      *Log                   `json:"main"`
+	ByProcess map[string]*Log        `json:"byProcess,omitempty"` // only in logs written before task logs were stored as their own objects
+	Tasks     map[string]*TaskLogRef `json:"tasks"`
 }
 
 // TODO - sort list - latest to oldest request
 func (server *Server) listRuns(userID string) ([]string, error) {
-	sess := server.S3FileManager.newS3Session()
-	svc := s3.New(sess)
-	prefix := fmt.Sprintf(pathToUserRunsf, userID)
-	query := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(Config.Storage.S3.Name),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String("/"),
-	}
-	result, err := svc.ListObjectsV2(query)
-	if err != nil {
-		return nil, err
+	options := storage.ListOptions{
+		Prefix:    fmt.Sprintf(pathToUserRunsf, userID),
+		Delimiter: "/",
 	}
 	runIDs := []string{}
-	for _, v := range result.CommonPrefixes {
-		runID := strings.Split(v.String(), "/")[2]
-		runIDs = append(runIDs, runID)
+	for {
+		page, err := server.S3FileManager.Storage.List(options)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range page.Prefixes {
+			runID := strings.Split(v, "/")[2]
+			runIDs = append(runIDs, runID)
+		}
+		if page.Next == "" {
+			return runIDs, nil
+		}
+		options.Token = page.Next
 	}
-	return runIDs, nil
 }
 
 // split this out into smaller, more atomic functions as soon as it's working - refactor
 // most API endpoint handlers will call this function
 func (server *Server) fetchMainLog(userID, runID string) (*MainLog, error) {
-	var err error
-
-	sess := server.S3FileManager.newS3Session()
-
-	// Create a downloader with the session and default options
-	downloader := s3manager.NewDownloader(sess)
-
-	// Create a buffer to write the S3 Object contents to.
-	// see: https://stackoverflow.com/questions/41645377/golang-s3-download-to-buffer-using-s3manager-downloader
-	buf := &aws.WriteAtBuffer{}
+	log, err := server.fetchRunLogIndex(userID, runID)
+	if err != nil {
+		return nil, err
+	}
+	if err = fetchTaskLogs(server.S3FileManager.Storage, log); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
 
+// fetchRunLogIndex fetches marinerLog.json only - i.e., the request, the main log and the index of the task logs
+// for when the task logs aren't needed, e.g., to check the status of a run
+func (server *Server) fetchRunLogIndex(userID, runID string) (*MainLog, error) {
 	objKey := fmt.Sprintf(pathToUserRunLogf, userID, runID)
-
-	// Write the contents of S3 Object to the buffer
-	s3Obj := &s3.GetObjectInput{
-		Bucket: aws.String(Config.Storage.S3.Name),
-		Key:    aws.String(objKey),
-	}
-	_, err = downloader.Download(buf, s3Obj)
+	b, err := storage.ReadAll(server.S3FileManager.Storage, objKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file, %v", err)
 	}
-	b := buf.Bytes()
 	log := &MainLog{}
 	err = json.Unmarshal(b, log)
 	if err != nil {
@@ -98,87 +93,8 @@ func mainLog(path string) *MainLog {
 	return log
 }
 
-func (engine *K8sEngine) writeLogToS3() error {
-	// apply/update timestamps on the main log
-	// not sure if I should collect timestamps of all writes
-	// or just the times of first write and latest writes
-	//
-	// presently only applying timestamps at the top-level workflow (i.e., engine) level
-	// NOT applying timestamps to individual tasks/subworkflows, but that would be easy to do
-	// just not sure if it's useful/necessary right now
-
-	// do this BY PROCESS
-	// the "engine" corresponds to the top level workflow task
-	// and should not be treated specially here
-	/*
-		t := ts()
-		if log.Engine.Created == "" {
-			log.Engine.Created = t
-		}
-		log.Engine.LastUpdated = t
-	*/
-
-	engine.Log.RLock()
-	defer engine.Log.RUnlock()
-
-	sess := engine.S3FileManager.newS3Session()
-	uploader := s3manager.NewUploader(sess)
-
-	mainLogJSON := MainLogJSON{
-		Path:      engine.Log.Path,
-		Request:   engine.Log.Request,
-		Main:      engine.Log.Main,
-		ByProcess: engine.Log.ByProcess,
-	}
-	j, err := json.Marshal(mainLogJSON)
-	if err != nil {
-		return fmt.Errorf("failed to marshal log to json: %v", err)
-	}
-
-	objKey := fmt.Sprintf(pathToUserRunLogf, engine.UserID, engine.RunID)
-
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(Config.Storage.S3.Name),
-		Key:    aws.String(objKey),
-		Body:   bytes.NewReader(j),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to upload file, %v", err)
-	}
-
-	return nil
-}
-
 func (server *Server) writeLog(mainLog *MainLog, userID string, runID string) error {
-	sess := server.S3FileManager.newS3Session()
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploader(sess)
-
-	mainLogJSON := MainLogJSON{
-		Path:      mainLog.Path,
-		Request:   mainLog.Request,
-		Main:      mainLog.Main,
-		ByProcess: mainLog.ByProcess,
-	}
-	j, err := json.Marshal(mainLogJSON)
-	if err != nil {
-		return fmt.Errorf("failed to marshal log to json: %v", err)
-	}
-
-	objKey := fmt.Sprintf(pathToUserRunLogf, userID, runID)
-
-	// Upload the file to S3.
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(Config.Storage.S3.Name),
-		Key:    aws.String(objKey),
-		Body:   bytes.NewReader(j),
-	})
-
-	if err != nil {
-		return fmt.Errorf("failed to upload file, %v", err)
-	}
-
-	return nil
+	return writeRunLog(server.S3FileManager.Storage, mainLog, userID, runID, nil)
 }
 
 // Log stores the eventLog and runtime stats for a mariner component (i.e., engine or task)
@@ -198,6 +114,8 @@ type Log struct {
 	JobName        string                 `json:"jobName,omitempty"`
 	ContainerImage string                 `json:"containerImage,omitempty"`
 	Status         string                 `json:"status"`
+	TaskStatus     *TaskStatus            `json:"taskStatus,omitempty"` // as reported from within the task pod - see status.go
+	Logs           *TaskLogs              `json:"logs,omitempty"`       // the files capturing the tool's stdout and stderr
 	Stats          *Stats                 `json:"stats"`
 	Event          *EventLog              `json:"eventLog,omitempty"`
 	Input          map[string]interface{} `json:"input"`
@@ -205,6 +123,12 @@ type Log struct {
 	Scatter        map[int]*Log           `json:"scatter,omitempty"`
 }
 
+// TaskLogs are the paths of the files in the task working dir which capture the tool's stdout and stderr
+type TaskLogs struct {
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
 func (r *ResourceUsage) init() {
 	r.Series = ResourceUsageSeries{}         // #race #ok
 	r.SamplingPeriod = metricsSamplingPeriod // #race #ok
@@ -215,25 +139,43 @@ func (s *ResourceUsageSeries) append(p ResourceUsageSamplePoint) {
 }
 
 // called when a task is run
+// under the log lock, since the status of the main task may also be set by stop()
 func (engine *K8sEngine) startTaskLog(task *Task) {
+	engine.Log.Lock()
 	task.Log.start()
-	engine.writeLogToS3()
+	engine.Log.Unlock()
+	engine.taskLogTransition(task)
 }
 
 // called when a task finishes running
 func (engine *K8sEngine) finishTaskLog(task *Task) {
+	engine.Log.Lock()
 	task.Log.finish()
-	engine.writeLogToS3()
+	engine.Log.Unlock()
+	engine.taskLogTransition(task)
+}
+
+// flushes the log on a state transition of a task
+// a scatter may run thousands of subtasks - their transitions get picked up by the next periodic flush
+func (engine *K8sEngine) taskLogTransition(task *Task) {
+	if task.ScatterIndex != 0 {
+		engine.logUpdated()
+		return
+	}
+	engine.flushLog()
 }
 
 // called when a task finishes running
+// a task which failed, timed out or was cancelled keeps that status
 func (log *Log) finish() {
 	t := time.Now()
 	log.LastUpdatedObj = t
 	log.LastUpdated = timef(log.LastUpdatedObj)
 	log.Stats.DurationObj = t.Sub(log.CreatedObj)
 	log.Stats.Duration = log.Stats.DurationObj.Seconds()
-	log.Status = completed
+	if log.Status == running {
+		log.Status = completed
+	}
 }
 
 // called when a task is run
@@ -261,13 +203,25 @@ func logger() *Log {
 // recorded for tasks as well as workflows
 // Runtime for a workflow is the sum of runtime of that workflow's steps
 type Stats struct {
-	CPUReq        ResourceRequirement `json:"cpuReq"` // in-progress
-	MemoryReq     ResourceRequirement `json:"memReq"` // in-progress
+	CPUReq           ResourceRequirement `json:"cpuReq"`           // in-progress - in cores, rounded up
+	CPUReqMillicores ResourceRequirement `json:"cpuReqMillicores"` // the exact cpu request, for fractional cores
+	MemoryReq        ResourceRequirement `json:"memReq"`           // in-progress
+	ResourceUsage    ResourceUsage       `json:"resourceUsage"`
+	Duration         float64             `json:"duration"` // okay - currently measured in minutes
+	DurationObj      time.Duration       `json:"-"`        // okay
+	NFailures        int                 `json:"nfailures"`
+	NRetries         int                 `json:"nretries"`
+	NReschedules     int                 `json:"nreschedules"`       // attempts lost to infrastructure failures - these don't count as retries
+	Attempts         []AttemptStats      `json:"attempts,omitempty"` // stats of the previous attempts of a task which was retried
+}
+
+// AttemptStats holds the stats of one failed attempt of a task
+// the stats of the latest attempt are those of the task itself
+type AttemptStats struct {
+	JobName       string              `json:"jobName"`
+	Failure       string              `json:"failure"`
+	MemoryReq     ResourceRequirement `json:"memReq"`
 	ResourceUsage ResourceUsage       `json:"resourceUsage"`
-	Duration      float64             `json:"duration"`  // okay - currently measured in minutes
-	DurationObj   time.Duration       `json:"-"`         // okay
-	NFailures     int                 `json:"nfailures"` // TODO
-	NRetries      int                 `json:"nretries"`  // TODO
 }
 
 // ResourceRequirement is for logging resource requests vs. actual usage
@@ -297,26 +251,26 @@ type EventLog struct {
 	Events []string `json:"events,omitempty"`
 }
 
-// update log (i.e., write to log file) each time there's an error, to capture point of failure
+// events mark the log as updated - the log writer flushes it shortly after, see logwriter.go
 func (engine *K8sEngine) errorf(f string, v ...interface{}) error {
 	err := engine.Log.Main.Event.errorf(f, v...)
-	engine.writeLogToS3()
+	engine.logUpdated()
 	return err
 }
 
 func (engine *K8sEngine) warnf(f string, v ...interface{}) {
 	engine.Log.Main.Event.warnf(f, v...)
-	engine.writeLogToS3()
+	engine.logUpdated()
 }
 
 func (engine *K8sEngine) infof(f string, v ...interface{}) {
 	engine.Log.Main.Event.infof(f, v...)
-	engine.writeLogToS3()
+	engine.logUpdated()
 }
 
 func (engine *K8sEngine) debugf(f string, v ...interface{}) {
 	engine.Log.Main.Event.infof(f, v...)
-	engine.writeLogToS3()
+	engine.logUpdated()
 }
 
 func (task *Task) errorf(f string, v ...interface{}) error {
@@ -0,0 +1,273 @@
+package mariner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains code for persisting the run log
+//
+// the log of each task is stored as its own object, under "<userID>/workflowRuns/<runID>/taskLogs/"
+// as is the log of each scattered subtask, under ".../taskLogs/<taskID>/scatter/"
+// and marinerLog.json holds the request, the main log and an index of the task logs - see TaskLogRef
+// so an update to one task rewrites that task's log and the (small) index - not the whole run log
+//
+// the engine doesn't write the log on every event - see logUpdated() and flushLog()
+// 1. events (infof, warnf, errorf, resource usage samples) only mark the log as updated
+// 2. the log writer flushes an updated log every logFlushPeriod seconds
+// 3. state transitions (a task starting, finishing, or being retried) flush the log right away
+// ---- except those of scattered subtasks, of which there may be thousands - these only mark the log as updated
+// 4. the engine flushes the log one last time when it exits - including when it panics, or gets SIGTERM'd
+//
+// a flush only uploads the task logs which changed since the last flush
+
+// TaskLogRef is the entry of a task in the index of the run log
+type TaskLogRef struct {
+	Key     string              `json:"key"`               // key of the task log object
+	Status  string              `json:"status"`            // status of the task as of the last flush
+	Scatter map[int]*TaskLogRef `json:"scatter,omitempty"` // the logs of the scattered subtasks of the task, by scatter index
+}
+
+// logWriter flushes the run log of the engine
+type logWriter struct {
+	engine *K8sEngine
+	period time.Duration
+
+	updated int32 // set if the log changed since the last flush - accessed atomically
+
+	flushLock sync.Mutex          // one flush at a time
+	written   map[string][32]byte // checksum of each task log as last written, by key - guarded by flushLock
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newLogWriter(engine *K8sEngine) *logWriter {
+	return &logWriter{
+		engine:  engine,
+		period:  logFlushPeriod * time.Second,
+		written: make(map[string][32]byte),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// start flushes the log every period, if it was updated
+func (w *logWriter) start() {
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if atomic.LoadInt32(&w.updated) == 1 {
+					if err := w.flush(); err != nil {
+						log.Errorf("failed to flush run log: %v", err)
+					}
+				}
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the periodic flushes and flushes the log one last time
+func (w *logWriter) close() error {
+	close(w.stop)
+	<-w.done
+	return w.flush()
+}
+
+// flush writes the task logs which changed since the last flush, then the index
+func (w *logWriter) flush() error {
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+	// updates from here on get picked up by the next flush
+	atomic.StoreInt32(&w.updated, 0)
+	err := writeRunLog(w.engine.S3FileManager.Storage, w.engine.Log, w.engine.UserID, w.engine.RunID, w.written)
+	if err != nil {
+		// try again next period
+		atomic.StoreInt32(&w.updated, 1)
+	}
+	return err
+}
+
+// logUpdated marks the run log as updated, for the log writer to flush
+func (engine *K8sEngine) logUpdated() {
+	if engine.logWriter != nil {
+		atomic.StoreInt32(&engine.logWriter.updated, 1)
+	}
+}
+
+// flushLog writes the run log right away - on a state transition
+func (engine *K8sEngine) flushLog() {
+	if engine.logWriter == nil {
+		return
+	}
+	if err := engine.logWriter.flush(); err != nil {
+		log.Errorf("failed to flush run log: %v", err)
+	}
+}
+
+// taskLogKey returns the key of the log object of the given task
+// the task ID is escaped, e.g., "#main/step" -> ".../taskLogs/main%2Fstep.json"
+func taskLogKey(userID, runID, taskID string) string {
+	return fmt.Sprintf(pathToUserRunTaskLogf, userID, runID, url.PathEscape(strings.TrimPrefix(taskID, "#")))
+}
+
+// scatterLogKey returns the key of the log object of a scattered subtask of the given task
+// e.g., "#main/step", 3 -> ".../taskLogs/main%2Fstep/scatter/3.json"
+func scatterLogKey(userID, runID, taskID string, scatterIndex int) string {
+	return fmt.Sprintf(pathToUserRunScatterLogf, userID, runID, url.PathEscape(strings.TrimPrefix(taskID, "#")), scatterIndex)
+}
+
+// writeRunLog writes the log of each task (and of each scattered subtask), then the index of the run log
+// if written is not nil, it holds the checksums of the task logs as last written - and only the task logs which changed get written
+func writeRunLog(store storage.Storage, mainLog *MainLog, userID, runID string, written map[string][32]byte) error {
+	if store == nil {
+		return fmt.Errorf("no storage to write the run log to")
+	}
+
+	// marshal under the lock, upload outside of it
+	mainLog.RLock()
+	objects := make(map[string][]byte, len(mainLog.ByProcess)) // by key
+	index := make(map[string]*TaskLogRef, len(mainLog.ByProcess))
+	for taskID, taskLog := range mainLog.ByProcess {
+		ref := &TaskLogRef{Key: taskLogKey(userID, runID, taskID), Status: taskLog.Status}
+		// the subtask logs are their own objects, so an update to one subtask doesn't rewrite them all
+		stepLog := *taskLog
+		stepLog.Scatter = nil
+		b, err := json.Marshal(&stepLog)
+		if err != nil {
+			mainLog.RUnlock()
+			return fmt.Errorf("failed to marshal log of task %v to json: %v", taskID, err)
+		}
+		objects[ref.Key] = b
+		for i, scatterLog := range taskLog.Scatter {
+			if ref.Scatter == nil {
+				ref.Scatter = make(map[int]*TaskLogRef, len(taskLog.Scatter))
+			}
+			scatterRef := &TaskLogRef{Key: scatterLogKey(userID, runID, taskID, i), Status: scatterLog.Status}
+			if b, err = json.Marshal(scatterLog); err != nil {
+				mainLog.RUnlock()
+				return fmt.Errorf("failed to marshal log of subtask %v of task %v to json: %v", i, taskID, err)
+			}
+			objects[scatterRef.Key] = b
+			ref.Scatter[i] = scatterRef
+		}
+		index[taskID] = ref
+	}
+	j, err := json.Marshal(MainLogJSON{
+		Path:    mainLog.Path,
+		Request: mainLog.Request,
+		Main:    mainLog.Main,
+		Tasks:   index,
+	})
+	mainLog.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal log to json: %v", err)
+	}
+
+	// the task logs get written first, so the index never refers to a task log which doesn't exist
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var errs []string
+	sums := make(map[string][32]byte) // of the task logs written by this call
+	sem := make(chan struct{}, maxConcurrentLogWrites)
+	for key, b := range objects {
+		sum := sha256.Sum256(b)
+		if last, ok := written[key]; ok && last == sum {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string, b []byte, sum [32]byte) {
+			defer func() { <-sem; wg.Done() }()
+			err := store.Put(key, bytes.NewReader(b))
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", key, err))
+				return
+			}
+			sums[key] = sum
+		}(key, b, sum)
+	}
+	wg.Wait()
+	if written != nil {
+		for key, sum := range sums {
+			written[key] = sum
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to upload task logs: %v", strings.Join(errs, "; "))
+	}
+
+	if err = store.Put(fmt.Sprintf(pathToUserRunLogf, userID, runID), bytes.NewReader(j)); err != nil {
+		return fmt.Errorf("failed to upload file, %v", err)
+	}
+	return nil
+}
+
+// fetchTaskLogs loads the log of each task in the index of the run log into log.ByProcess
+// along with the logs of its scattered subtasks, into the task log's Scatter
+// logs written before task logs were stored as their own objects hold all the task logs in ByProcess, and have no index
+func fetchTaskLogs(store storage.Storage, mainLog *MainLog) error {
+	if len(mainLog.Tasks) == 0 {
+		return nil
+	}
+	// the log objects to fetch, by key - each unmarshals into its own Log, so they can be fetched concurrently
+	logs := make(map[string]*Log)
+	mainLog.ByProcess = make(map[string]*Log, len(mainLog.Tasks))
+	for taskID, ref := range mainLog.Tasks {
+		taskLog := &Log{}
+		mainLog.ByProcess[taskID] = taskLog
+		logs[ref.Key] = taskLog
+		for i, scatterRef := range ref.Scatter {
+			if taskLog.Scatter == nil {
+				taskLog.Scatter = make(map[int]*Log, len(ref.Scatter))
+			}
+			scatterLog := &Log{}
+			taskLog.Scatter[i] = scatterLog
+			logs[scatterRef.Key] = scatterLog
+		}
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var errs []string
+	sem := make(chan struct{}, maxConcurrentLogWrites)
+	for key, l := range logs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string, l *Log) {
+			defer func() { <-sem; wg.Done() }()
+			b, err := storage.ReadAll(store, key)
+			if err == nil {
+				err = json.Unmarshal(b, l)
+			}
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, fmt.Sprintf("%v: %v", key, err))
+				lock.Unlock()
+			}
+		}(key, l)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to fetch task logs: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// countingStore records the keys of the objects put to and got from the underlying storage
+type countingStore struct {
+	storage.Storage
+
+	sync.Mutex
+	puts, gets []string
+}
+
+func (s *countingStore) Put(key string, body io.Reader) error {
+	s.Lock()
+	s.puts = append(s.puts, key)
+	s.Unlock()
+	return s.Storage.Put(key, body)
+}
+
+func (s *countingStore) Get(key string) (io.ReadCloser, error) {
+	s.Lock()
+	s.gets = append(s.gets, key)
+	s.Unlock()
+	return s.Storage.Get(key)
+}
+
+// reset returns the keys put and got since the last reset, sorted
+func (s *countingStore) reset() (puts, gets []string) {
+	s.Lock()
+	defer s.Unlock()
+	puts, gets = s.puts, s.gets
+	s.puts, s.gets = nil, nil
+	sort.Strings(puts)
+	sort.Strings(gets)
+	return puts, gets
+}
+
+func newCountingStore(t *testing.T) *countingStore {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingStore{Storage: local}
+}
+
+// testRunLog returns a run log with a task, and a scattered task of two subtasks
+func testRunLog() *MainLog {
+	runLog := mainLog("")
+	runLog.Main.Status = running
+	runLog.ByProcess["#main/align"] = &Log{Status: completed, Logs: &TaskLogs{Stdout: "/engine-workspace/align/stdout"}}
+	runLog.ByProcess["#main/call"] = &Log{Status: running, Scatter: map[int]*Log{
+		0: {Status: completed, Logs: &TaskLogs{Stdout: "/engine-workspace/call/0/stdout"}},
+		1: {Status: running, Logs: &TaskLogs{Stdout: "/engine-workspace/call/1/stdout"}},
+	}}
+	return runLog
+}
+
+func fetchIndex(t *testing.T, store storage.Storage, userID, runID string) *MainLog {
+	b, err := storage.ReadAll(store, fmt.Sprintf(pathToUserRunLogf, userID, runID))
+	if err != nil {
+		t.Fatalf("failed to read index: %v", err)
+	}
+	index := &MainLog{}
+	if err = json.Unmarshal(b, index); err != nil {
+		t.Fatalf("failed to unmarshal index: %v", err)
+	}
+	return index
+}
+
+func TestWriteRunLogRoundTrip(t *testing.T) {
+	store := newCountingStore(t)
+	runLog := testRunLog()
+	written := make(map[string][32]byte)
+	indexKey := fmt.Sprintf(pathToUserRunLogf, "user", "run")
+	alignKey := taskLogKey("user", "run", "#main/align")
+	callKey := taskLogKey("user", "run", "#main/call")
+	scatterKeys := []string{scatterLogKey("user", "run", "#main/call", 0), scatterLogKey("user", "run", "#main/call", 1)}
+
+	if err := writeRunLog(store, runLog, "user", "run", written); err != nil {
+		t.Fatalf("writeRunLog() error = %v", err)
+	}
+	puts, _ := store.reset()
+	want := append([]string{indexKey, alignKey, callKey}, scatterKeys...)
+	sort.Strings(want)
+	if fmt.Sprint(puts) != fmt.Sprint(want) {
+		t.Errorf("first write put %v, want %v", puts, want)
+	}
+
+	// the index refers to each task log, and to each subtask log
+	index := fetchIndex(t, store, "user", "run")
+	if len(index.ByProcess) != 0 {
+		t.Errorf("index holds task logs %v, want none", index.ByProcess)
+	}
+	call := index.Tasks["#main/call"]
+	if index.Tasks["#main/align"].Key != alignKey || call == nil || call.Key != callKey || call.Status != running {
+		t.Fatalf("index tasks = %+v, want refs of align and call", index.Tasks)
+	}
+	for i, key := range scatterKeys {
+		if ref := call.Scatter[i]; ref == nil || ref.Key != key {
+			t.Errorf("ref of subtask %v = %+v, want key %v", i, ref, key)
+		}
+	}
+	if call.Scatter[1].Status != running {
+		t.Errorf("status of subtask 1 = %v, want %v", call.Scatter[1].Status, running)
+	}
+
+	// nothing changed - only the index gets written
+	if err := writeRunLog(store, runLog, "user", "run", written); err != nil {
+		t.Fatalf("writeRunLog() error = %v", err)
+	}
+	if puts, _ = store.reset(); fmt.Sprint(puts) != fmt.Sprint([]string{indexKey}) {
+		t.Errorf("unchanged write put %v, want only the index", puts)
+	}
+
+	// one subtask changed - only its log and the index get written
+	runLog.ByProcess["#main/call"].Scatter[1].Status = completed
+	if err := writeRunLog(store, runLog, "user", "run", written); err != nil {
+		t.Fatalf("writeRunLog() error = %v", err)
+	}
+	want = []string{indexKey, scatterKeys[1]}
+	sort.Strings(want)
+	if puts, _ = store.reset(); fmt.Sprint(puts) != fmt.Sprint(want) {
+		t.Errorf("write of changed subtask put %v, want %v", puts, want)
+	}
+
+	// the task logs read back as written
+	index = fetchIndex(t, store, "user", "run")
+	if err := fetchTaskLogs(store, index); err != nil {
+		t.Fatalf("fetchTaskLogs() error = %v", err)
+	}
+	align, fetchedCall := index.ByProcess["#main/align"], index.ByProcess["#main/call"]
+	if align == nil || align.Logs == nil || align.Logs.Stdout != "/engine-workspace/align/stdout" {
+		t.Errorf("fetched log of align = %+v", align)
+	}
+	if fetchedCall == nil || len(fetchedCall.Scatter) != 2 || fetchedCall.Scatter[1].Status != completed || fetchedCall.Scatter[0].Logs.Stdout != "/engine-workspace/call/0/stdout" {
+		t.Errorf("fetched log of call = %+v", fetchedCall)
+	}
+
+	// the log of one subtask gets served from the index, reading only that subtask's log
+	index = fetchIndex(t, store, "user", "run")
+	store.reset()
+	log, _, err := taskLog(store, index, "call", "1")
+	if err != nil || log.Logs.Stdout != "/engine-workspace/call/1/stdout" {
+		t.Fatalf("taskLog() = %+v, %v, want log of subtask 1", log, err)
+	}
+	if _, gets := store.reset(); fmt.Sprint(gets) != fmt.Sprint([]string{scatterKeys[1]}) {
+		t.Errorf("taskLog() got %v, want only %v", gets, scatterKeys[1])
+	}
+}
+
+func TestFetchTaskLogsWithoutIndex(t *testing.T) {
+	store := newCountingStore(t)
+	// written before task logs were stored as their own objects
+	old := testRunLog()
+	b, err := json.Marshal(&MainLogJSON{Main: old.Main, ByProcess: old.ByProcess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Put(fmt.Sprintf(pathToUserRunLogf, "user", "run"), bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	store.reset()
+
+	index := fetchIndex(t, store, "user", "run")
+	if err = fetchTaskLogs(store, index); err != nil {
+		t.Fatalf("fetchTaskLogs() error = %v", err)
+	}
+	if _, gets := store.reset(); len(gets) != 1 {
+		t.Errorf("gets = %v, want only the run log", gets)
+	}
+	call := index.ByProcess["#main/call"]
+	if call == nil || len(call.Scatter) != 2 || call.Scatter[0].Status != completed {
+		t.Errorf("log of call = %+v, want it as written", call)
+	}
+}
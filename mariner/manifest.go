@@ -0,0 +1,90 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// this file contains code for deriving the gen3fuse manifest of a run
+// gen3fuse only mounts the commons files whose GUIDs are in the manifest
+// so the server adds every "COMMONS/<guid>" referenced in the request to the manifest given by the user (if any)
+//
+// references are collected from anywhere in the input JSON - nested arrays, records and secondaryFiles included -
+// and from anywhere in the packed workflow, which covers the defaults of inputs and of step inputs
+//
+// the gen3fuse sidecar is attached only to the task pods which read commons data - see usesCommonsData()
+
+// collectStrings returns the strings anywhere in a json value which match the given function
+func collectStrings(v interface{}, match func(string) bool) (matches []string) {
+	var collect func(v interface{})
+	collect = func(v interface{}) {
+		switch x := v.(type) {
+		case string:
+			if match(x) {
+				matches = append(matches, x)
+			}
+		case []interface{}:
+			for _, e := range x {
+				collect(e)
+			}
+		case map[string]interface{}:
+			for _, e := range x {
+				collect(e)
+			}
+		}
+	}
+	collect(v)
+	return matches
+}
+
+// commonsGUIDs returns the GUIDs of the "COMMONS/<guid>" references in the given json documents
+func commonsGUIDs(docs ...json.RawMessage) ([]string, error) {
+	var guids []string
+	for _, doc := range docs {
+		if len(doc) == 0 {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(doc, &v); err != nil {
+			return nil, err
+		}
+		for _, ref := range collectStrings(v, func(s string) bool { return strings.HasPrefix(s, commonsPrefix) }) {
+			guids = append(guids, strings.TrimPrefix(ref, commonsPrefix))
+		}
+	}
+	return guids, nil
+}
+
+// deriveManifest adds the GUID of every commons file referenced in the request to its manifest
+func (request *WorkflowRequest) deriveManifest() error {
+	guids, err := commonsGUIDs(request.Input, request.Workflow)
+	if err != nil {
+		return fmt.Errorf("failed to scan request for commons files: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, entry := range request.Manifest {
+		seen[entry.GUID] = true
+	}
+	for _, guid := range guids {
+		if guid != "" && !seen[guid] {
+			seen[guid] = true
+			request.Manifest = append(request.Manifest, ManifestEntry{GUID: guid})
+		}
+	}
+	return nil
+}
+
+// usesCommonsData returns true if the tool reads any commons files - i.e., if its task pod needs gen3fuse
+// either as input files, or as files staged to its working dir for the InitialWorkDirRequirement
+func (tool *Tool) usesCommonsData() bool {
+	if tool.CommonsData {
+		return true
+	}
+	for _, input := range tool.S3Input {
+		if strings.HasPrefix(input.Path, pathToCommonsData) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// packedWorkflow references commons files in the default of a workflow input and in the default of a step input
+const packedWorkflow = `{
+	"cwlVersion": "v1.0",
+	"$graph": [
+		{
+			"class": "Workflow",
+			"id": "#main",
+			"inputs": [
+				{"id": "#main/reference", "type": "File", "default": {"class": "File", "location": "COMMONS/workflow-default"}}
+			],
+			"outputs": [],
+			"steps": [
+				{
+					"id": "#main/align",
+					"run": "#align.cwl",
+					"in": [
+						{"id": "#main/align/reference", "source": "#main/reference"},
+						{"id": "#main/align/index", "default": {"class": "File", "location": "COMMONS/step-default"}}
+					],
+					"out": []
+				}
+			]
+		},
+		{
+			"class": "CommandLineTool",
+			"id": "#align.cwl",
+			"baseCommand": ["align"],
+			"inputs": [{"id": "#align.cwl/reference", "type": "File"}, {"id": "#align.cwl/index", "type": "File"}],
+			"outputs": []
+		}
+	]
+}`
+
+func TestDeriveManifest(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		workflow string
+		manifest Manifest
+		want     []string
+	}{
+		{
+			name:  "file",
+			input: `{"reads": {"class": "File", "location": "COMMONS/file"}, "other": {"class": "File", "location": "USER/COMMONS/x"}, "n": 1}`,
+			want:  []string{"file"},
+		},
+		{
+			name:  "nested arrays",
+			input: `{"reads": [[{"class": "File", "location": "COMMONS/a"}], [{"class": "File", "location": "COMMONS/b"}, "COMMONS/c"]]}`,
+			want:  []string{"a", "b", "c"},
+		},
+		{
+			name:  "record",
+			input: `{"sample": {"name": "s1", "files": {"reads": {"class": "File", "location": "COMMONS/record"}}}}`,
+			want:  []string{"record"},
+		},
+		{
+			name: "secondaryFiles",
+			input: `{"bam": {"class": "File", "location": "COMMONS/bam",
+				"secondaryFiles": [{"class": "File", "location": "COMMONS/bai"}]}}`,
+			want: []string{"bai", "bam"},
+		},
+		{
+			name:     "defaults",
+			input:    `{}`,
+			workflow: packedWorkflow,
+			want:     []string{"step-default", "workflow-default"},
+		},
+		{
+			name:     "de-duplicated against the user's manifest",
+			input:    `{"a": {"class": "File", "location": "COMMONS/given"}, "b": [{"class": "File", "location": "COMMONS/new"}, "COMMONS/new"]}`,
+			manifest: Manifest{{GUID: "given"}, {GUID: "unreferenced"}},
+			want:     []string{"given", "new", "unreferenced"},
+		},
+		{
+			name:  "empty guid",
+			input: `{"a": "COMMONS/"}`,
+		},
+	}
+	for _, c := range cases {
+		request := &WorkflowRequest{Input: json.RawMessage(c.input), Manifest: c.manifest}
+		if c.workflow != "" {
+			request.Workflow = json.RawMessage(c.workflow)
+		}
+		if err := request.deriveManifest(); err != nil {
+			t.Errorf("%v: deriveManifest() error = %v", c.name, err)
+			continue
+		}
+		// the user's entries come first, as given
+		for i, entry := range c.manifest {
+			if request.Manifest[i] != entry {
+				t.Errorf("%v: manifest[%v] = %v, want %v", c.name, i, request.Manifest[i], entry)
+			}
+		}
+		var got []string
+		for _, entry := range request.Manifest {
+			got = append(got, entry.GUID)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%v: manifest = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	invalid := &WorkflowRequest{Input: json.RawMessage(`{"a": `)}
+	if err := invalid.deriveManifest(); err == nil {
+		t.Errorf("invalid input: want error")
+	}
+}
@@ -2,13 +2,12 @@ package mariner
 
 import (
 	"fmt"
-	"path/filepath"
+	"sort"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	log "github.com/sirupsen/logrus"
 	cwl "github.com/uc-cdis/cwl.go"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 // this file contains code for collecting/processing output from Tools
@@ -48,12 +47,26 @@ func (engine *K8sEngine) handleCLTOutput(tool *Tool) (err error) {
 			}
 		}
 
+		// the output parameter's format, if any, gets assigned to each File it collects
+		format, err := tool.outputFormat(&output)
+		if err != nil {
+			return tool.Task.errorf("failed to resolve format for output: %v; error: %v", output.ID, err)
+		}
+		for _, fileObj := range results {
+			if fileObj.Class == CWLFileType && format != "" {
+				fileObj.Format = format
+			}
+		}
+
 		// 2. Load Contents
 		// no need to handle prefixes here, since the full paths
 		// are already in the File objects stored in `results`
 		if output.Binding.LoadContents {
 			tool.Task.infof("begin load file contents")
 			for _, fileObj := range results {
+				if fileObj.Class != CWLFileType {
+					continue
+				}
 				tool.Task.infof("begin load contents for file :%v", fileObj.Path)
 				err = engine.loadContents(fileObj)
 				if err != nil {
@@ -142,7 +155,7 @@ func (engine *K8sEngine) handleCLTOutput(tool *Tool) (err error) {
 		// at this point we have file results captured in `results`
 		// output should be a CWLFileType or "array of Files"
 		// fixme - make this case handling more specific in the else condition - don't just catch anything
-		if output.Types[0].Type == CWLFileType {
+		if t := output.Types[0].Type; t == CWLFileType || t == CWLDirectoryType {
 
 			// fixme - add error handling for cases len(results) != 1
 			if len(results) > 0 {
@@ -176,13 +189,22 @@ func (engine *K8sEngine) glob(tool *Tool, output *cwl.Output) (results []*File,
 		}
 		patterns = append(patterns, pattern)
 	}
-	paths, err := engine.globS3(tool, patterns)
+	paths, dirs, err := engine.globS3(tool, patterns)
 	if err != nil {
 		return results, tool.Task.errorf("%v", err)
 	}
+	// a File output collects only the files matched, and a Directory output only the dirs
+	wantDirs := outputItemType(output) == CWLDirectoryType
 	for _, path := range paths {
-		fileObj := fileObject(path) // these are full paths, so no need to add working dir to path
-		results = append(results, fileObj)
+		if dirs[path] != wantDirs {
+			continue
+		}
+		// these are full paths, so no need to add working dir to path
+		if dirs[path] {
+			results = append(results, directoryObject(path))
+		} else {
+			results = append(results, fileObject(path))
+		}
 	}
 	tool.Task.infof("end glob")
 	return results, nil
@@ -196,18 +218,12 @@ func (engine *K8sEngine) glob(tool *Tool, output *cwl.Output) (results []*File,
 	your resulting path list
 	consists of all the paths in the working dir which match the pattern
 
-	use this:
-	https://golang.org/pkg/path/filepath/#Match
+	patterns are matched by storage.Match - which supports character classes and "**"
+	dirs aren't objects in s3, so a dir is any path which is a prefix of some key in the working dir
+	results are sorted, as the CWL spec requires
 */
-func (engine *K8sEngine) globS3(tool *Tool, patterns []string) ([]string, error) {
-	svc := s3.New(engine.S3FileManager.newS3Session())
-	objectList, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(engine.S3FileManager.S3BucketName),
-		Prefix: aws.String(strings.TrimPrefix(engine.localPathToS3Key(tool.WorkingDir), "/")),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list keys from tool working dir in s3: %v", err)
-	}
+func (engine *K8sEngine) globS3(tool *Tool, patterns []string) (paths []string, dirs map[string]bool, err error) {
+	s3wkdir := strings.TrimSuffix(strings.TrimPrefix(engine.localPathToS3Key(tool.WorkingDir), "/"), "/") + "/"
 
 	/*
 		note:
@@ -219,42 +235,65 @@ func (engine *K8sEngine) globS3(tool *Tool, patterns []string) ([]string, error)
 
 		see also: https://www.commonwl.org/v1.0/CommandLineTool.html#Runtime_environment
 	*/
-
-	var key string
-	var match bool
-	var collectFile bool
-	var path string
-	globResults := []string{}
-	for _, obj := range objectList.Contents {
-		// match key against pattern
-		key = *obj.Key
-
-		collectFile = false
-		for _, pattern := range patterns {
-			s3Pattern := strings.TrimPrefix(engine.localPathToS3Key(pattern), "/")
-
-			// handle case of glob pattern not resolving to absolute path
-			// fixme: this is not pretty
-			if !strings.HasPrefix(s3Pattern, engine.UserID) {
-				s3wkdir := strings.TrimPrefix(engine.localPathToS3Key(tool.WorkingDir), "/")
-				s3Pattern = fmt.Sprintf("%s/%s", strings.TrimSuffix(s3wkdir, "/"), strings.TrimPrefix(s3Pattern, "/"))
+	s3Patterns := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		// a pattern under the dockerOutputDirectory is matched against the working dir, which is mounted there
+		s3Pattern := strings.TrimPrefix(engine.localPathToS3Key(tool.workingDirPath(pattern)), "/")
+
+		// handle case of glob pattern not resolving to absolute path
+		// fixme: this is not pretty
+		if !strings.HasPrefix(s3Pattern, engine.UserID) {
+			s3Pattern = s3wkdir + strings.TrimPrefix(s3Pattern, "/")
+		}
+		if _, err = storage.Match(s3Pattern, ""); err != nil {
+			return nil, nil, fmt.Errorf("invalid glob pattern %v: %v", pattern, err)
+		}
+		s3Patterns = append(s3Patterns, strings.TrimSuffix(s3Pattern, "/"))
+	}
+	matchesAny := func(key string) bool {
+		for _, pattern := range s3Patterns {
+			if match, _ := storage.Match(pattern, key); match {
+				return true
 			}
+		}
+		return false
+	}
 
-			match, err = filepath.Match(s3Pattern, key)
-			if err != nil {
-				return nil, fmt.Errorf("glob pattern matching failed: %v", err)
-			} else if match {
-				collectFile = true
+	objects, err := storage.ListAll(engine.S3FileManager.Storage, s3wkdir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list keys from tool working dir in s3: %v", err)
+	}
+	matched := make(map[string]bool)
+	dirKeys := make(map[string]bool)
+	for _, obj := range objects {
+		if matchesAny(obj.Key) {
+			matched[obj.Key] = true
+		}
+		for _, dir := range storage.Dirs(s3wkdir, obj.Key) {
+			if !dirKeys[dir] && matchesAny(dir) {
+				matched[dir] = true
+				dirKeys[dir] = true
 			}
 		}
-		if collectFile {
-			// this needs to be represented as a filepath, not a "key"
-			// i.e., it needs a slash at the beginning
-			path = engine.s3KeyToLocalPath(fmt.Sprintf("/%s", key))
-			globResults = append(globResults, path)
+	}
+
+	keys := make([]string, 0, len(matched))
+	for key := range matched {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	dirs = make(map[string]bool)
+	for _, key := range keys {
+		// this needs to be represented as a filepath, not a "key"
+		// i.e., it needs a slash at the beginning
+		path := engine.s3KeyToLocalPath(fmt.Sprintf("/%s", key))
+		paths = append(paths, path)
+		if dirKeys[key] {
+			dirs[path] = true
 		}
 	}
-	return globResults, nil
+	return paths, dirs, nil
 }
 
 func (tool *Tool) pattern(glob string) (pattern string, err error) {
@@ -281,6 +320,49 @@ func (tool *Tool) pattern(glob string) (pattern string, err error) {
 	return glob, nil
 }
 
+// OutputPattern tells the s3sidecar which files in the tool's working dir to upload
+// only the files which may be collected as outputs get uploaded - not staged inputs, nor scratch data
+type OutputPattern struct {
+	Glob           string   `json:"glob"`                     // absolute glob pattern
+	SecondaryFiles []string `json:"secondaryFiles,omitempty"` // secondaryFiles patterns of the matched files - e.g., ".bai" or "^.bai"
+}
+
+// outputPatterns resolves the glob patterns of the tool's outputs before the tool runs, for the s3sidecar
+// stdout, stderr, cwl.output.json and the exit code file are always uploaded, so they aren't listed here
+// returns nil, meaning upload the whole working dir, if the files to upload can't be known before the tool runs
+// e.g., if a glob or a secondaryFiles pattern is an expression which fails to resolve, or depends on `self`
+func (tool *Tool) outputPatterns() (patterns []*OutputPattern) {
+	patterns = []*OutputPattern{}
+	for _, output := range tool.Task.Root.Outputs {
+		if output.Binding == nil {
+			continue
+		}
+		var secondaryFiles []string
+		for _, entry := range output.SecondaryFiles {
+			if strings.HasPrefix(entry.Entry, "$") {
+				tool.Task.infof("secondaryFiles expression for output %v - uploading the whole working dir", output.ID)
+				return nil
+			}
+			secondaryFiles = append(secondaryFiles, entry.Entry)
+		}
+		for _, glob := range output.Binding.Glob {
+			pattern, err := tool.pattern(glob)
+			if err != nil {
+				tool.Task.warnf("failed to resolve glob %v for output %v before running the tool - uploading the whole working dir: %v", glob, output.ID, err)
+				return nil
+			}
+			if !strings.HasPrefix(pattern, "/") {
+				pattern = tool.WorkingDir + pattern
+			}
+			patterns = append(patterns, &OutputPattern{
+				Glob:           tool.workingDirPath(pattern),
+				SecondaryFiles: secondaryFiles,
+			})
+		}
+	}
+	return patterns
+}
+
 // HandleETOutput ..
 // ExpressionTool expression returns a JSON object
 // where the keys are the IDs of the expressionTool output params
@@ -313,7 +395,7 @@ func (tool *Tool) outputEval(output *cwl.Output, fileArray []*File) (err error)
 
 	// here `self` is the file or array of files returned by glob (with contents loaded if so specified)
 	var self interface{}
-	if output.Types[0].Type == CWLFileType {
+	if t := output.Types[0].Type; t == CWLFileType || t == CWLDirectoryType {
 		// indicates `self` should be a file object with keys exposed
 		// should check length fileArray - room for error here
 		self, err = preProcessContext(fileArray[0])
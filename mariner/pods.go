@@ -0,0 +1,248 @@
+package mariner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// this file contains code for diagnosing the pod of a task job
+// the job status only says whether the job is active, succeeded or failed
+// so while the engine waits on a task, it also watches the task pod's status and k8s events
+// and copies meaningful reasons (e.g., ImagePullBackOff, OOMKilled, Evicted, FailedScheduling) into the task's event log
+//
+// the pods of the run are cached by a single watch of the k8s API - see podWatcher
+// so polling the pod of each task is free, however many tasks run at once - e.g., a scatter of thousands
+// the events of a pod are only listed while the pod isn't progressing - i.e., it's pending or failing - and at most once per podEventsPollingPeriod
+//
+// some conditions can never resolve on their own (e.g., an invalid image name) - for these the task fails fast,
+// instead of waiting on the job forever
+// an image which fails to pull may be a transient condition (e.g., a registry rate limit), so it only fails the task if it lasts
+
+// TaskFailure is the diagnosed reason for the failure of a task pod
+type TaskFailure struct {
+	Reason  string // k8s reason - e.g., "OOMKilled", "ImagePullBackOff", "Evicted"
+	Message string
+	Fatal   bool // true if the pod can't recover from this condition, so the task should fail without waiting on the job
+
+	// true if the pod was lost to the infrastructure rather than failed by the tool - e.g., node loss, eviction, preemption
+	// such tasks get rescheduled - see retry.go
+	Infrastructure bool
+}
+
+func (f *TaskFailure) Error() string {
+	return fmt.Sprintf("%v: %v", f.Reason, f.Message)
+}
+
+// waiting reasons of a container which never resolve on their own
+var fatalWaitingReasons = map[string]bool{
+	"InvalidImageName":           true,
+	"ErrImageNeverPull":          true,
+	"CreateContainerConfigError": true,
+}
+
+// waiting reasons of a container whose image fails to pull - fatal only once they've lasted for imagePullTimeout
+var pullFailingReasons = map[string]bool{
+	"ImagePullBackOff": true,
+	"ErrImagePull":     true,
+}
+
+// pod reasons which indicate the pod was lost to the infrastructure
+var infrastructureReasons = map[string]bool{
+	"Evicted":                  true,
+	"Preempting":               true,
+	"NodeLost":                 true,
+	"NodeShutdown":             true,
+	"Shutdown":                 true,
+	"Terminated":               true,
+	"UnexpectedAdmissionError": true,
+}
+
+// podWatcher caches the pods of a run, via a single watch of the k8s API
+type podWatcher struct {
+	client    kubernetes.Interface
+	namespace string
+	pods      corelisters.PodLister
+}
+
+// newPodWatcher starts the watch of the pods of the given run - i.e., the pods labelled with the run ID - until stop is closed
+// and waits for the initial listing of the pods
+func newPodWatcher(client kubernetes.Interface, namespace, runID string, stop <-chan struct{}) (*podWatcher, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = fmt.Sprintf("%v=%v", runIDLabel, labelValue(runID))
+		}),
+	)
+	pods := factory.Core().V1().Pods()
+	informer := pods.Informer()
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		return nil, fmt.Errorf("failed to sync the pods of the run")
+	}
+	return &podWatcher{client: client, namespace: namespace, pods: pods.Lister()}, nil
+}
+
+// podWatcher returns the watcher of the pods of the run - starting it, if it's not yet started
+func (engine *K8sEngine) podWatcher() (*podWatcher, error) {
+	engine.podsLock.Lock()
+	defer engine.podsLock.Unlock()
+	if engine.pods != nil {
+		return engine.pods, nil
+	}
+	client, err := k8sClientset()
+	if err != nil {
+		return nil, err
+	}
+	if engine.pods, err = newPodWatcher(client, os.Getenv("GEN3_NAMESPACE"), engine.RunID, engine.stopped); err != nil {
+		return nil, err
+	}
+	return engine.pods, nil
+}
+
+// diagnosePod inspects the pod and k8s events of the tool's task job
+// records any new diagnostics in the task's event log, and returns the most relevant failure, if any
+func (engine *K8sEngine) diagnosePod(tool *Tool) (failure *TaskFailure, err error) {
+	watcher, err := engine.podWatcher()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := watcher.pods.Pods(watcher.namespace).List(labels.SelectorFromSet(labels.Set{"job-name": tool.JobName}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	if len(pods) == 0 && tool.podSeen {
+		// the pod is gone - e.g., its node was reclaimed and the pod garbage collected
+		failure = &TaskFailure{Reason: podLost, Message: "task pod no longer exists", Infrastructure: true}
+		tool.diagnostic(fmt.Sprintf("task job %v - %v", tool.JobName, failure.Error()))
+	}
+	listEvents := false
+	for _, pod := range pods {
+		tool.podSeen = true
+		f := tool.diagnosePodStatus(pod)
+		if f != nil && (failure == nil || f.Fatal) {
+			failure = f
+		}
+		if pod.Status.Phase == k8sv1.PodPending || pod.Status.Phase == k8sv1.PodFailed || f != nil {
+			listEvents = true
+		}
+	}
+	// the events of a pod which is progressing aren't needed - its status says all there is to say
+	if listEvents && time.Since(tool.eventsListed) >= podEventsPollingPeriod*time.Second {
+		tool.eventsListed = time.Now()
+		for _, pod := range pods {
+			events, err := watcher.client.CoreV1().Events(watcher.namespace).List(context.TODO(), metav1.ListOptions{
+				FieldSelector: fmt.Sprintf("involvedObject.name=%v,type=%v", pod.Name, k8sv1.EventTypeWarning),
+			})
+			if err != nil {
+				tool.Task.warnf("failed to list events for pod %v: %v", pod.Name, err)
+				continue
+			}
+			for _, event := range events.Items {
+				tool.diagnostic(fmt.Sprintf("pod %v - event %v: %v", pod.Name, event.Reason, event.Message))
+			}
+		}
+	}
+	// the failure reflects the latest poll - so a condition which has since cleared doesn't outlive it
+	tool.Failure = failure
+	return failure, nil
+}
+
+// diagnosePodStatus inspects the status of a pod and of its containers
+func (tool *Tool) diagnosePodStatus(pod *k8sv1.Pod) (failure *TaskFailure) {
+	if pod.Status.Reason != "" {
+		// e.g., "Evicted"
+		failure = &TaskFailure{
+			Reason:         pod.Status.Reason,
+			Message:        pod.Status.Message,
+			Infrastructure: infrastructureReasons[pod.Status.Reason],
+		}
+		tool.diagnostic(fmt.Sprintf("pod %v - %v", pod.Name, failure.Error()))
+	}
+	for _, condition := range pod.Status.Conditions {
+		// set by k8s on a pod which is about to be terminated due to a disruption - e.g., preemption, eviction, node taint
+		if condition.Type == podDisruptionTarget && condition.Status == k8sv1.ConditionTrue {
+			failure = &TaskFailure{Reason: condition.Reason, Message: condition.Message, Infrastructure: true}
+			tool.diagnostic(fmt.Sprintf("pod %v - disrupted: %v", pod.Name, failure.Error()))
+		}
+		if condition.Type == k8sv1.PodScheduled && condition.Status == k8sv1.ConditionFalse && condition.Reason != "" {
+			// e.g., "Unschedulable" - not fatal, since the cluster may scale up
+			tool.diagnostic(fmt.Sprintf("pod %v - not scheduled: %v: %v", pod.Name, condition.Reason, condition.Message))
+		}
+	}
+	statuses := append(append([]k8sv1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	pullFailing := false
+	for _, status := range statuses {
+		tool.recordImageDigest(&status)
+		if waiting := status.State.Waiting; waiting != nil && waiting.Reason != "" && waiting.Reason != "ContainerCreating" && waiting.Reason != "PodInitializing" {
+			tool.diagnostic(fmt.Sprintf("pod %v - container %v waiting: %v: %v", pod.Name, status.Name, waiting.Reason, waiting.Message))
+			switch {
+			case fatalWaitingReasons[waiting.Reason]:
+				failure = &TaskFailure{
+					Reason:  waiting.Reason,
+					Message: fmt.Sprintf("container %v: %v", status.Name, waiting.Message),
+					Fatal:   true,
+				}
+			case pullFailingReasons[waiting.Reason]:
+				pullFailing = true
+				if tool.pullFailingSince.IsZero() {
+					tool.pullFailingSince = time.Now()
+				}
+				failure = &TaskFailure{
+					Reason:  waiting.Reason,
+					Message: fmt.Sprintf("container %v: %v", status.Name, waiting.Message),
+					Fatal:   time.Since(tool.pullFailingSince) >= imagePullTimeout*time.Second,
+				}
+				if failure.Fatal {
+					failure.Message = fmt.Sprintf("container %v failed to pull its image for %vs: %v", status.Name, imagePullTimeout, waiting.Message)
+				}
+			}
+		}
+		if terminated := status.State.Terminated; terminated != nil && (terminated.ExitCode != 0 || terminated.Reason == oomKilled) {
+			tool.diagnostic(fmt.Sprintf("pod %v - container %v terminated: %v (exit code %v) %v", pod.Name, status.Name, terminated.Reason, terminated.ExitCode, terminated.Message))
+			if failure == nil || (!failure.Fatal && !failure.Infrastructure && terminated.Reason == oomKilled) {
+				failure = &TaskFailure{
+					Reason:  terminated.Reason,
+					Message: fmt.Sprintf("container %v exited with code %v", status.Name, terminated.ExitCode),
+				}
+			}
+		}
+	}
+	if !pullFailing {
+		tool.pullFailingSince = time.Time{}
+	}
+	return failure
+}
+
+// sidecarFailure returns the failure of the task's s3sidecar, if it failed to stage inputs or upload outputs
+// the sidecar writes the reason to a marker file in the tool's working dir, and uploads it to s3
+func (engine *K8sEngine) sidecarFailure(tool *Tool) *TaskFailure {
+	f := fileObject(tool.WorkingDir + sidecarFailureMarker)
+	if err := engine.loadContents(f); err != nil {
+		return nil
+	}
+	failure := &TaskFailure{Reason: sidecarFailed, Message: f.Contents}
+	tool.diagnostic(fmt.Sprintf("task job %v - %v", tool.JobName, failure.Error()))
+	return failure
+}
+
+// diagnostic writes a diagnostic message to the task's event log - once
+func (tool *Tool) diagnostic(message string) {
+	if tool.diagnostics == nil {
+		tool.diagnostics = make(map[string]bool)
+	}
+	if tool.diagnostics[message] {
+		return
+	}
+	tool.diagnostics[message] = true
+	tool.Task.warnf("%v", message)
+}
@@ -0,0 +1,114 @@
+package mariner
+
+import (
+	"testing"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// waitingPod returns a pod whose task container is waiting for the given reason
+func waitingPod(reason string) *k8sv1.Pod {
+	return &k8sv1.Pod{Status: k8sv1.PodStatus{ContainerStatuses: []k8sv1.ContainerStatus{{
+		Name:  taskContainerName,
+		State: k8sv1.ContainerState{Waiting: &k8sv1.ContainerStateWaiting{Reason: reason, Message: "message"}},
+	}}}}
+}
+
+func TestDiagnosePodStatusWaiting(t *testing.T) {
+	for _, c := range []struct {
+		reason    string
+		wantFatal bool
+	}{
+		{"InvalidImageName", true},
+		{"ErrImageNeverPull", true},
+		{"CreateContainerConfigError", true},
+		// e.g., a registry rate limit - not fatal until it has lasted for imagePullTimeout
+		{"ImagePullBackOff", false},
+		{"ErrImagePull", false},
+	} {
+		tool := &Tool{Task: &Task{Log: logger()}}
+		failure := tool.diagnosePodStatus(waitingPod(c.reason))
+		if failure == nil || failure.Reason != c.reason || failure.Fatal != c.wantFatal {
+			t.Errorf("%v: diagnosePodStatus() = %+v, want fatal %v", c.reason, failure, c.wantFatal)
+		}
+	}
+}
+
+func TestDiagnosePodStatusPullFailing(t *testing.T) {
+	tool := &Tool{Task: &Task{Log: logger()}}
+	if failure := tool.diagnosePodStatus(waitingPod("ImagePullBackOff")); failure.Fatal {
+		t.Fatalf("first failed pull: fatal, want not fatal")
+	}
+	since := tool.pullFailingSince
+	if f := tool.diagnosePodStatus(waitingPod("ErrImagePull")); f.Fatal || !tool.pullFailingSince.Equal(since) {
+		t.Fatalf("failed pull on a later poll: fatal %v, failing since %v, want not fatal, failing since %v", f.Fatal, tool.pullFailingSince, since)
+	}
+
+	// lasted for the timeout
+	tool.pullFailingSince = time.Now().Add(-imagePullTimeout * time.Second)
+	if failure := tool.diagnosePodStatus(waitingPod("ImagePullBackOff")); !failure.Fatal {
+		t.Errorf("failed pull for %vs: not fatal, want fatal", imagePullTimeout)
+	}
+
+	// the pull succeeded - e.g., the rate limit lifted
+	running := &k8sv1.Pod{Status: k8sv1.PodStatus{ContainerStatuses: []k8sv1.ContainerStatus{{
+		Name:  taskContainerName,
+		State: k8sv1.ContainerState{Running: &k8sv1.ContainerStateRunning{}},
+	}}}}
+	if failure := tool.diagnosePodStatus(running); failure != nil || !tool.pullFailingSince.IsZero() {
+		t.Errorf("running pod: diagnosePodStatus() = %+v, failing since %v, want no failure", failure, tool.pullFailingSince)
+	}
+}
+
+func TestDiagnosePod(t *testing.T) {
+	runLabels := map[string]string{runIDLabel: "run-1", "job-name": "task-job"}
+	pending := waitingPod("ImagePullBackOff")
+	pending.ObjectMeta = metav1.ObjectMeta{Name: "task-pod", Namespace: "default", Labels: runLabels}
+	pending.Status.Phase = k8sv1.PodPending
+	client := fake.NewSimpleClientset(pending, &k8sv1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "task-pod.1", Namespace: "default"},
+		InvolvedObject: k8sv1.ObjectReference{Kind: "Pod", Name: "task-pod"},
+		Type:           k8sv1.EventTypeWarning,
+		Reason:         "Failed",
+		Message:        "429 Too Many Requests",
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	watcher, err := newPodWatcher(client, "default", "run-1", stop)
+	if err != nil {
+		t.Fatalf("newPodWatcher() error = %v", err)
+	}
+	engine := &K8sEngine{pods: watcher}
+	tool := &Tool{JobName: "task-job", Task: &Task{Log: logger()}}
+
+	requests := func(verb, resource string) (n int) {
+		for _, action := range client.Actions() {
+			if action.GetVerb() == verb && action.GetResource().Resource == resource {
+				n++
+			}
+		}
+		return n
+	}
+	for i := 0; i < 3; i++ {
+		failure, err := engine.diagnosePod(tool)
+		if err != nil {
+			t.Fatalf("diagnosePod() error = %v", err)
+		}
+		if failure == nil || failure.Reason != "ImagePullBackOff" || failure.Fatal {
+			t.Fatalf("diagnosePod() = %+v, want non-fatal ImagePullBackOff", failure)
+		}
+	}
+	if !tool.diagnostics["pod task-pod - event Failed: 429 Too Many Requests"] {
+		t.Errorf("diagnostics = %v, want the warning event of the pod", tool.diagnostics)
+	}
+	// the pods are listed once, by the watch - and the events of the pending pod at most once per podEventsPollingPeriod
+	if n := requests("list", "pods"); n != 1 {
+		t.Errorf("pod lists = %v, want 1", n)
+	}
+	if n := requests("list", "events"); n != 1 {
+		t.Errorf("event lists = %v, want 1", n)
+	}
+}
@@ -0,0 +1,380 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains code for File inputs given as remote URLs - e.g., public reference data
+// supported schemes are "s3://bucket/key", "gs://bucket/key" and "https://host/path"
+//
+// the engine maps each URL to a local path, under which the s3sidecar of each task that uses the file stages it
+// e.g., "s3://bucket/path/to/file" -> "/engine-workspace/_mariner_remote/s3/bucket/path/to/file"
+// the mapping is reversible, so the URL is recovered from the path of the File wherever the File goes in the workflow
+//
+// the s3sidecar fetches the file with the credentials configured for the URL's scheme - see Storage.Remote
+// and the engine reads the sizes, contents and existence of remote files with those same credentials - see remoteFiles
+// remote files are never read with the engine's own aws creds - with no credentials configured for a scheme, they're read anonymously
+// and the workspace bucket, which holds the working dirs of every user's runs, is never a remote source
+//
+// a file whose access URLs can't be recovered from its path gets them registered as its sources - see registerRemoteSources()
+// i.e., a signed https URL, whose query string isn't part of the path, or the access URLs of a DRS object, which may need headers
+// the sources get tried in order - by the engine, and by the s3sidecar, to which they're passed along with the path
+
+// supported schemes of remote URLs
+const (
+	s3Scheme    = "s3"
+	gsScheme    = "gs"
+	httpsScheme = "https"
+)
+
+// local path under which remote files get staged
+var pathToRemoteData = fmt.Sprintf("/%v/%v/", engineWorkspaceVolumeName, remoteDataDir)
+
+// isRemoteURL returns true if the given location is a URL - i.e., "<scheme>://..."
+func isRemoteURL(location string) bool {
+	return strings.Contains(location, "://")
+}
+
+// remotePath returns the local path at which the file at the given remote URL gets staged
+func remotePath(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse URL %v: %v", location, err)
+	}
+	switch u.Scheme {
+	case s3Scheme, gsScheme, httpsScheme:
+	default:
+		return "", fmt.Errorf("unsupported scheme of URL %v - must be one of %v, %v or %v", location, s3Scheme, gsScheme, httpsScheme)
+	}
+	if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return "", fmt.Errorf("invalid URL %v - must be of the form <scheme>://<bucket or host>/<path>", location)
+	}
+	if u.User != nil {
+		return "", fmt.Errorf("invalid URL %v - credentials are not supported", location)
+	}
+	if u.Scheme == s3Scheme && u.Host == Config.Storage.S3.Name {
+		return "", fmt.Errorf("invalid URL %v - the workspace bucket is not a remote source", location)
+	}
+	// the query string of a signed https URL is not part of the path - the URL gets registered as a source of the path
+	if u.RawQuery != "" && u.Scheme != httpsScheme {
+		return "", fmt.Errorf("invalid URL %v - query strings are only supported for https URLs", location)
+	}
+	return pathToRemoteData + u.Scheme + "/" + u.Host + "/" + strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// the sources of remote files which can't be recovered from their local paths, by local path
+var (
+	remoteSourcesLock   sync.RWMutex
+	remoteSourcesByPath = make(map[string][]*AccessURL)
+)
+
+// registerRemoteSources registers the access URLs of the remote file staged at the given local path, in the order they're to be tried
+func registerRemoteSources(path string, sources []*AccessURL) {
+	remoteSourcesLock.Lock()
+	defer remoteSourcesLock.Unlock()
+	remoteSourcesByPath[path] = sources
+}
+
+// remoteSources returns the registered access URLs of the remote file staged at the given local path, if any
+func remoteSources(path string) []*AccessURL {
+	remoteSourcesLock.RLock()
+	defer remoteSourcesLock.RUnlock()
+	return remoteSourcesByPath[path]
+}
+
+// stageRemoteFile returns the local path at which a file with the given access URLs gets staged
+// the first URL which maps to a path determines the path - any others are fallbacks
+func stageRemoteFile(urls []*AccessURL) (string, error) {
+	var path string
+	var sources []*AccessURL
+	var errs []string
+	for _, u := range urls {
+		p, err := remotePath(u.URL)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if path == "" {
+			path = p
+		}
+		sources = append(sources, u)
+	}
+	if path == "" {
+		return "", fmt.Errorf("no supported access URL: %v", strings.Join(errs, "; "))
+	}
+	if len(sources) > 1 || sources[0].URL != remoteURL(path) || len(sources[0].Headers) > 0 {
+		registerRemoteSources(path, sources)
+	}
+	return path, nil
+}
+
+// remoteURL returns the remote URL of a file staged at the given local path, or "" if it's not a remote file
+func remoteURL(path string) string {
+	if !strings.HasPrefix(path, pathToRemoteData) {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, pathToRemoteData), "/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return fmt.Sprintf("%v://%v", parts[0], parts[1])
+}
+
+// remoteFiles reads remote files for the engine, with the credentials configured for each URL scheme
+// s3:// and gs:// objects are read via the storage of their bucket - gcs has an s3-compatible API, which accepts HMAC keys
+// for a scheme without credentials configured, objects are read anonymously - never with the engine's own aws creds
+type remoteFiles struct {
+	s3Config *aws.Config
+	gsConfig *aws.Config
+	client   *http.Client
+	token    string          // https bearer token
+	hosts    map[string]bool // the hosts to which the token may be sent
+
+	sync.Mutex
+	buckets map[string]storage.Storage // by "<scheme>://<bucket>"
+}
+
+type httpsCredentials struct {
+	Token string `json:"token"`
+}
+
+// newRemoteFiles loads the credentials for remote files from the env of the engine - see remoteCredsEnv()
+func newRemoteFiles(awsConfig *aws.Config) (*remoteFiles, error) {
+	r := &remoteFiles{
+		s3Config: &aws.Config{Credentials: credentials.AnonymousCredentials},
+		gsConfig: &aws.Config{
+			Endpoint:         aws.String(gcsEndpoint),
+			Region:           aws.String("auto"),
+			S3ForcePathStyle: aws.Bool(true),
+			Credentials:      credentials.AnonymousCredentials,
+		},
+		client:  &http.Client{Timeout: remoteRequestTimeout * time.Second},
+		hosts:   make(map[string]bool),
+		buckets: make(map[string]storage.Storage),
+	}
+	if awsConfig != nil {
+		r.s3Config.Region = awsConfig.Region
+	}
+	if v := os.Getenv(remoteS3CredsEnvVar); v != "" {
+		creds := &awsCredentials{}
+		if err := json.Unmarshal([]byte(v), creds); err != nil {
+			return nil, fmt.Errorf("error unmarshalling remote s3 creds: %v", err)
+		}
+		r.s3Config.Credentials = credentials.NewStaticCredentials(creds.ID, creds.Secret, "")
+	}
+	if v := os.Getenv(remoteGSCredsEnvVar); v != "" {
+		creds := &awsCredentials{}
+		if err := json.Unmarshal([]byte(v), creds); err != nil {
+			return nil, fmt.Errorf("error unmarshalling remote gs creds: %v", err)
+		}
+		r.gsConfig.Credentials = credentials.NewStaticCredentials(creds.ID, creds.Secret, "")
+	}
+	if v := os.Getenv(remoteHTTPSCredsEnvVar); v != "" {
+		creds := &httpsCredentials{}
+		if err := json.Unmarshal([]byte(v), creds); err != nil {
+			return nil, fmt.Errorf("error unmarshalling remote https creds: %v", err)
+		}
+		r.token = creds.Token
+	}
+	for _, host := range strings.Split(os.Getenv(remoteHTTPSHostsEnvVar), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			r.hosts[host] = true
+		}
+	}
+	return r, nil
+}
+
+// bucket returns the storage of the bucket of the given s3:// or gs:// URL
+func (r *remoteFiles) bucket(u *url.URL) (storage.Storage, error) {
+	r.Lock()
+	defer r.Unlock()
+	id := u.Scheme + "://" + u.Host
+	if store, ok := r.buckets[id]; ok {
+		return store, nil
+	}
+	config := r.gsConfig
+	if u.Scheme == s3Scheme {
+		// the bucket may be in another region than the configured one
+		sess, err := session.NewSession(r.s3Config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create aws session: %v", err)
+		}
+		region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, u.Host, aws.StringValue(r.s3Config.Region))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get region of bucket %v: %v", u.Host, err)
+		}
+		config = r.s3Config.Copy(&aws.Config{Region: aws.String(region)})
+	}
+	store, err := storage.NewS3(u.Host, config, "")
+	if err != nil {
+		return nil, err
+	}
+	r.buckets[id] = store
+	return store, nil
+}
+
+// request makes a request for the file at the given https URL - sending the token, if the host is one it may be sent to
+// headers are "<name>: <value>"
+func (r *remoteFiles) request(method string, u *url.URL, headers ...string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range headers {
+		if parts := strings.SplitN(h, ":", 2); len(parts) == 2 {
+			req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	// note: the http client drops the Authorization header on redirects to other hosts
+	if r.token != "" && r.hosts[u.Hostname()] {
+		req.Header.Set(authHeader, "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		// the error includes the URL - whose query string may be a signature, which mustn't end up in the logs
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, storage.ErrNotFound
+		}
+		return nil, fmt.Errorf("%v returned %v", method, resp.Status)
+	}
+	return resp, nil
+}
+
+// try calls f with each source of the remote file staged at the given local path, in order, until one succeeds
+// if every source fails, the error is that of the last - or a not found error, if the file is not found at any
+func (r *remoteFiles) try(path string, f func(u *url.URL, headers []string) error) error {
+	if r == nil {
+		return fmt.Errorf("failed to read remote file %v: no credentials loaded for remote files", remoteURL(path))
+	}
+	sources := remoteSources(path)
+	if len(sources) == 0 {
+		sources = []*AccessURL{{URL: remoteURL(path)}}
+	}
+	var err error
+	notFound := true
+	for _, source := range sources {
+		u, e := url.Parse(source.URL)
+		if e != nil {
+			err, notFound = e, false
+			continue
+		}
+		if e = f(u, source.Headers); e == nil {
+			return nil
+		}
+		// a signed URL's query string is left out, so it doesn't end up in the logs
+		err = fmt.Errorf("%v://%v%v: %w", u.Scheme, u.Host, u.Path, e)
+		notFound = notFound && storage.IsNotFound(e)
+	}
+	if notFound {
+		return fmt.Errorf("%w: %v", storage.ErrNotFound, err)
+	}
+	return err
+}
+
+// stat returns the size of a remote file at one of its sources
+func (r *remoteFiles) stat(u *url.URL, headers []string) (int64, error) {
+	if u.Scheme != httpsScheme {
+		store, err := r.bucket(u)
+		if err != nil {
+			return 0, err
+		}
+		obj, err := store.Stat(u.Path)
+		if err != nil {
+			return 0, err
+		}
+		return obj.Size, nil
+	}
+	resp, err := r.request(http.MethodHead, u, headers...)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("size is unknown")
+	}
+	return resp.ContentLength, nil
+}
+
+// size returns the size of the remote file staged at the given local path
+func (r *remoteFiles) size(path string) (size int64, err error) {
+	err = r.try(path, func(u *url.URL, headers []string) (err error) {
+		size, err = r.stat(u, headers)
+		return err
+	})
+	return size, err
+}
+
+// exists returns true if the remote file staged at the given local path exists
+// a file which can't be checked - e.g., for lack of access - is an error, not a file which doesn't exist
+func (r *remoteFiles) exists(path string) (bool, error) {
+	err := r.try(path, func(u *url.URL, headers []string) error {
+		_, err := r.stat(u, headers)
+		return err
+	})
+	switch {
+	case err == nil:
+		return true, nil
+	case storage.IsNotFound(err):
+		return false, nil
+	}
+	return false, err
+}
+
+// contents returns the contents of the remote file staged at the given local path
+// per the CWL spec, it is an error to load the contents of a file larger than 64 KiB
+func (r *remoteFiles) contents(path string) (string, error) {
+	var b []byte
+	err := r.try(path, func(u *url.URL, headers []string) error {
+		// requesting one byte past the limit to detect files which are too large
+		var body io.ReadCloser
+		if u.Scheme != httpsScheme {
+			store, err := r.bucket(u)
+			if err != nil {
+				return err
+			}
+			if body, err = store.GetRange(u.Path, 0, maxContentsSize+1); err != nil {
+				return err
+			}
+		} else {
+			// range is inclusive
+			resp, err := r.request(http.MethodGet, u, append([]string{fmt.Sprintf("Range: bytes=%v-%v", 0, maxContentsSize)}, headers...)...)
+			if err != nil {
+				return err
+			}
+			body = resp.Body
+		}
+		defer body.Close()
+		var err error
+		b, err = ioutil.ReadAll(io.LimitReader(body, maxContentsSize+1))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxContentsSize {
+		return "", fmt.Errorf("failed to load contents of file %v: file is larger than 64 KiB", remoteURL(path))
+	}
+	return string(b), nil
+}
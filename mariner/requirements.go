@@ -0,0 +1,112 @@
+package mariner
+
+import (
+	cwl "github.com/uc-cdis/cwl.go"
+)
+
+// this file contains code for resolving the requirements and hints which apply to a task
+// per the CWL spec, requirements and hints flow from a workflow, to its steps, to the processes those steps run
+// 1. among requirements, the innermost takes precedence - i.e., tool over step over workflow
+// 2. among hints, likewise
+// 3. a requirement, declared at any level, takes precedence over a hint of the same class
+//
+// see: https://www.commonwl.org/v1.1/Workflow.html#Requirements_and_hints
+//
+// the resolved view gets computed once per task, when the graph is resolved
+// and every consumer (docker image, resources, env vars, initial workdir, ..) reads from it via task.requirement(class)
+
+// Requirement is a resolved requirement (or hint) which applies to a task
+type Requirement struct {
+	cwl.Requirement                        // as parsed by cwl.go - only the class for ResourceRequirement, whose fields are read from Raw
+	Raw             map[string]interface{} // the raw requirement from the packed cwl document
+	Hint            bool                   // true if this came from `hints`, rather than `requirements`
+}
+
+// Requirements is the resolved view of the requirements and hints for a task, keyed by class
+type Requirements map[string]*Requirement
+
+// merge returns the requirements which result from applying the given
+// inner `requirements` and `hints` (raw, in list or map form) on top of these requirements
+func (outer Requirements) merge(requirements interface{}, hints interface{}) Requirements {
+	merged := make(Requirements)
+	for class, requirement := range outer {
+		merged[class] = requirement
+	}
+	for _, raw := range rawRequirements(hints) {
+		class, _ := raw["class"].(string)
+		if cur, ok := merged[class]; ok && !cur.Hint {
+			// hints never override requirements
+			continue
+		}
+		merged[class] = newRequirement(raw, true)
+	}
+	for _, raw := range rawRequirements(requirements) {
+		class, _ := raw["class"].(string)
+		merged[class] = newRequirement(raw, false)
+	}
+	return merged
+}
+
+// newRequirement parses a raw requirement
+// cwl.go would panic on a ResourceRequirement with expressions, so that one is read from the raw requirement only
+func newRequirement(raw map[string]interface{}, hint bool) *Requirement {
+	requirement := &Requirement{
+		Raw:  raw,
+		Hint: hint,
+	}
+	if raw["class"] == CWLResourceRequirement {
+		requirement.Class = CWLResourceRequirement
+	} else {
+		requirement.Requirement = cwl.Requirement{}.New(raw)
+	}
+	return requirement
+}
+
+// resolveRequirements resolves the requirements and hints for this task
+// from those of its parent workflow (nil for the top level workflow), of its step in that workflow, and of its own process
+func (task *Task) resolveRequirements(parent *Task) {
+	var inherited Requirements
+	if parent != nil {
+		step := parent.rawStep(task.OriginalStep.ID)
+		inherited = parent.Requirements.merge(step["requirements"], step["hints"])
+	}
+	process := task.raw()
+	task.Requirements = inherited.merge(process["requirements"], process["hints"])
+	task.infof("resolved requirements and hints: %v", task.Requirements.classes())
+}
+
+// requirement returns the resolved requirement (or hint) of the given class for this task, or nil if none applies
+func (task *Task) requirement(class string) *Requirement {
+	return task.Requirements[class]
+}
+
+// rawStep returns the raw step with the given ID from this task's workflow, or nil if not found
+// steps may be given in the CWL either as a list or as a map keyed by ID
+func (task *Task) rawStep(id string) map[string]interface{} {
+	switch steps := task.raw()["steps"].(type) {
+	case []interface{}:
+		for _, v := range steps {
+			if step, ok := v.(map[string]interface{}); ok && step["id"] == id {
+				return step
+			}
+		}
+	case map[string]interface{}:
+		for key, v := range steps {
+			if step, ok := v.(map[string]interface{}); ok && (key == id || key == lastInPath(id)) {
+				return step
+			}
+		}
+	}
+	return nil
+}
+
+// returns the classes of the resolved requirements, marking those which are hints - for logging
+func (requirements Requirements) classes() (classes []string) {
+	for class, requirement := range requirements {
+		if requirement.Hint {
+			class += " (hint)"
+		}
+		classes = append(classes, class)
+	}
+	return classes
+}
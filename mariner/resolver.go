@@ -0,0 +1,502 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	pathLib "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// this file contains code for resolving commons files to their records - i.e., their filename, size and access URLs
+// 1. "COMMONS/<guid>" - the GUID gets resolved via indexd
+// 2. "drs://<host>/<id>" or "drs://<prefix>:<id>" - the URI gets resolved via the GA4GH DRS API of the host
+// see: https://ga4gh.github.io/data-repository-service-schemas/
+//
+// the access URLs of a record are sorted by the preferred cloud and region - see Config.Resolver
+// a DRS object is only ever staged from its https access URLs - usually signed, via the access endpoint of the object
+// its raw s3:// and gs:// URLs would get fetched with mariner's credentials, rather than with the user's access to the object
+// the user's token, from wts, is sent along with the requests to the DRS API - only of the hosts configured as trusted
+// lookups are cached for the run, and the commons files in the inputs of a run are resolved in batches when the run starts
+//
+// each resolver takes the base URL of its service and an http client, so a local http stand-in can take the place of the service
+
+const (
+	drsPrefix = "drs://"
+
+	// clouds of access URLs
+	awsCloud = "aws"
+	gcpCloud = "gcp"
+
+	// defaults - see Config.Resolver
+	defaultIndexdURL         = "http://indexd-service"
+	defaultResolverBatchSize = 100
+	defaultDRSConcurrency    = 8
+	defaultWTSURL            = "http://workspace-token-service"
+
+	// the user's token from wts gets reused for this long - wts hands out access tokens which are valid for longer
+	tokenCacheTTL = 5 * time.Minute
+)
+
+// FileRecord is the record of a commons file
+type FileRecord struct {
+	ID       string
+	Filename string
+	Size     int64
+	URLs     []*AccessURL // sorted by preference
+}
+
+// AccessURL is a URL at which the file can be accessed
+// it is passed to the s3sidecar of each task which stages the file - see ToolS3Input
+type AccessURL struct {
+	URL     string   `json:"url"`               // may be signed - i.e., have a query string
+	Headers []string `json:"headers,omitempty"` // "<name>: <value>" - headers to send along with requests for the URL
+	Cloud   string   `json:"-"`                 // "aws", "gcp", or "" if not known
+	Region  string   `json:"-"`                 // "" if not known
+}
+
+// url returns the preferred access URL of the file, or "" if it has none
+func (record *FileRecord) url() string {
+	if len(record.URLs) == 0 {
+		return ""
+	}
+	return record.URLs[0].URL
+}
+
+// FileResolver resolves the IDs of commons files to their records
+// it is an error if any of the given IDs can't be resolved
+type FileResolver interface {
+	Resolve(ids ...string) (map[string]*FileRecord, error)
+}
+
+// AccessPreferences .. - the preferred cloud and region of access URLs
+type AccessPreferences struct {
+	Cloud  string
+	Region string
+}
+
+// sort sorts access URLs by preference - matching cloud and region, then matching cloud, then the rest, in their original order
+func (prefs AccessPreferences) sort(urls []*AccessURL) {
+	score := func(u *AccessURL) int {
+		switch {
+		case prefs.Cloud == "" || u.Cloud != prefs.Cloud:
+			return 0
+		case prefs.Region != "" && u.Region == prefs.Region:
+			return 2
+		}
+		return 1
+	}
+	sort.SliceStable(urls, func(i, j int) bool { return score(urls[i]) > score(urls[j]) })
+}
+
+// cloudOf returns the cloud of an access URL, going by its scheme or access method type
+func cloudOf(scheme string) string {
+	switch scheme {
+	case s3Scheme:
+		return awsCloud
+	case gsScheme:
+		return gcpCloud
+	}
+	return ""
+}
+
+// requestJSON makes a request, and unmarshals the json response into v
+// headers are "<name>: <value>"
+func requestJSON(client *http.Client, method, u string, body interface{}, v interface{}, headers ...string) error {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range headers {
+		if parts := strings.SplitN(h, ":", 2); len(parts) == 2 {
+			req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v %v returned %v: %v", method, u, resp.Status, string(b))
+	}
+	return json.Unmarshal(b, v)
+}
+
+//// indexd ////
+
+// IndexdResolver resolves GUIDs via indexd
+// a single GUID is looked up directly, and several are looked up in batches via the bulk endpoint
+type IndexdResolver struct {
+	URL         string // base URL of indexd, e.g., "http://indexd-service"
+	Client      *http.Client
+	Preferences AccessPreferences
+	BatchSize   int
+}
+
+// indexd record
+type indexdRecord struct {
+	DID      string   `json:"did"`
+	Filename string   `json:"file_name"`
+	Size     int64    `json:"size"`
+	URLs     []string `json:"urls"`
+}
+
+// Resolve ..
+func (resolver *IndexdResolver) Resolve(guids ...string) (map[string]*FileRecord, error) {
+	records := make(map[string]*FileRecord)
+	if len(guids) == 1 {
+		raw := &indexdRecord{}
+		if err := requestJSON(resolver.Client, http.MethodGet, resolver.URL+"/index/"+url.PathEscape(guids[0]), nil, raw); err != nil {
+			return nil, fmt.Errorf("failed to look up GUID %v in indexd: %v", guids[0], err)
+		}
+		records[guids[0]] = resolver.record(guids[0], raw)
+		return records, nil
+	}
+	for start := 0; start < len(guids); start += resolver.BatchSize {
+		end := start + resolver.BatchSize
+		if end > len(guids) {
+			end = len(guids)
+		}
+		var raws []*indexdRecord
+		if err := requestJSON(resolver.Client, http.MethodPost, resolver.URL+"/bulk/documents", guids[start:end], &raws); err != nil {
+			return nil, fmt.Errorf("failed to look up GUIDs in indexd: %v", err)
+		}
+		for _, raw := range raws {
+			records[raw.DID] = resolver.record(raw.DID, raw)
+		}
+	}
+	for _, guid := range guids {
+		if records[guid] == nil {
+			return nil, fmt.Errorf("GUID %v not found in indexd", guid)
+		}
+	}
+	return records, nil
+}
+
+func (resolver *IndexdResolver) record(guid string, raw *indexdRecord) *FileRecord {
+	record := &FileRecord{ID: guid, Filename: raw.Filename, Size: raw.Size}
+	for _, u := range raw.URLs {
+		accessURL := &AccessURL{URL: u}
+		if parsed, err := url.Parse(u); err == nil {
+			accessURL.Cloud = cloudOf(parsed.Scheme)
+		}
+		record.URLs = append(record.URLs, accessURL)
+	}
+	resolver.Preferences.sort(record.URLs)
+	return record
+}
+
+//// DRS ////
+
+// DRSResolver resolves DRS URIs via the DRS API of their hosts
+// i.e., "drs://<host>/<id>", or "drs://<prefix>:<id>" where the host of the prefix is configured
+type DRSResolver struct {
+	Hosts         map[string]string // {prefix: host} for compact DRS URIs
+	Scheme        string            // scheme of the DRS API - "https", unless testing against a local stand-in
+	Client        *http.Client
+	Preferences   AccessPreferences
+	MaxConcurrent int // objects looked up at once - the DRS API has no bulk endpoint
+
+	// the user's token, for controlled access objects - sent only to the trusted hosts, since any host may be given in a DRS URI
+	Token        func() (string, error)
+	TrustedHosts map[string]bool
+}
+
+// DRS object
+type drsObject struct {
+	ID            string             `json:"id"`
+	Name          string             `json:"name"`
+	Size          int64              `json:"size"`
+	AccessMethods []*drsAccessMethod `json:"access_methods"`
+}
+
+type drsAccessMethod struct {
+	Type      string        `json:"type"`
+	AccessID  string        `json:"access_id"`
+	Region    string        `json:"region"`
+	AccessURL *drsAccessURL `json:"access_url"`
+}
+
+type drsAccessURL struct {
+	URL     string   `json:"url"`
+	Headers []string `json:"headers"`
+}
+
+// objectURL returns the URL of the DRS API for the object with the given DRS URI, and the host of the API
+func (resolver *DRSResolver) objectURL(uri string) (string, string, error) {
+	trimmed := strings.TrimPrefix(uri, drsPrefix)
+	var host, id string
+	if i := strings.Index(trimmed, ":"); i > 0 && resolver.Hosts[trimmed[:i]] != "" {
+		// compact - "drs://<prefix>:<id>"
+		host, id = resolver.Hosts[trimmed[:i]], trimmed[i+1:]
+	} else if i := strings.Index(trimmed, "/"); i > 0 {
+		// hostname-based - "drs://<host>/<id>"
+		host, id = trimmed[:i], trimmed[i+1:]
+	} else {
+		return "", "", fmt.Errorf("invalid DRS URI %v - must be drs://<host>/<id>, or drs://<prefix>:<id> for a configured prefix", uri)
+	}
+	return fmt.Sprintf("%v://%v/ga4gh/drs/v1/objects/%v", resolver.Scheme, host, url.PathEscape(id)), host, nil
+}
+
+// authHeaders returns the header with the user's token, for requests to the DRS API of the given host - if it's trusted
+func (resolver *DRSResolver) authHeaders(host string) ([]string, error) {
+	if resolver.Token == nil || !resolver.TrustedHosts[host] {
+		return nil, nil
+	}
+	token, err := resolver.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user's token: %v", err)
+	}
+	return []string{fmt.Sprintf("%v: Bearer %v", authHeader, token)}, nil
+}
+
+// Resolve ..
+func (resolver *DRSResolver) Resolve(uris ...string) (map[string]*FileRecord, error) {
+	records := make(map[string]*FileRecord)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]string, 0)
+	guard := make(chan struct{}, resolver.MaxConcurrent)
+	for _, uri := range uris {
+		guard <- struct{}{}
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			defer func() { <-guard }()
+			record, err := resolver.resolve(uri)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, err.Error())
+				return
+			}
+			records[uri] = record
+		}(uri)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to resolve DRS URIs: %v", strings.Join(errs, "; "))
+	}
+	return records, nil
+}
+
+// resolve resolves a single DRS URI
+// only https access URLs are kept - an access method with no https access URL, but an access ID,
+// gets its URL from the access endpoint of the object, which signs it for the user
+func (resolver *DRSResolver) resolve(uri string) (*FileRecord, error) {
+	objectURL, host, err := resolver.objectURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := resolver.authHeaders(host)
+	if err != nil {
+		return nil, err
+	}
+	obj := &drsObject{}
+	if err = requestJSON(resolver.Client, http.MethodGet, objectURL, nil, obj, headers...); err != nil {
+		return nil, fmt.Errorf("failed to get DRS object %v: %v", uri, err)
+	}
+	record := &FileRecord{ID: uri, Filename: obj.Name, Size: obj.Size}
+	for _, method := range obj.AccessMethods {
+		accessURL := method.AccessURL
+		if accessURL == nil || !isHTTPSURL(accessURL.URL) {
+			if method.AccessID == "" {
+				continue
+			}
+			accessURL = &drsAccessURL{}
+			if err = requestJSON(resolver.Client, http.MethodGet, objectURL+"/access/"+url.PathEscape(method.AccessID), nil, accessURL, headers...); err != nil {
+				return nil, fmt.Errorf("failed to get access URL %v of DRS object %v: %v", method.AccessID, uri, err)
+			}
+			if !isHTTPSURL(accessURL.URL) {
+				continue
+			}
+		}
+		record.URLs = append(record.URLs, &AccessURL{URL: accessURL.URL, Headers: accessURL.Headers, Cloud: cloudOf(method.Type), Region: method.Region})
+	}
+	if len(record.URLs) == 0 {
+		return nil, fmt.Errorf("DRS object %v has no https access URLs", uri)
+	}
+	resolver.Preferences.sort(record.URLs)
+	return record, nil
+}
+
+// isHTTPSURL returns true if the given URL is an https URL
+func isHTTPSURL(u string) bool {
+	return strings.HasPrefix(u, httpsScheme+"://")
+}
+
+//// user's token ////
+
+// wtsToken gets the user's access token from wts, which knows the user of the engine's pod by its gen3username annotation
+// the token is cached for a while, since each DRS object is resolved with it
+type wtsToken struct {
+	URL    string // base URL of wts
+	Client *http.Client
+
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Get ..
+func (t *wtsToken) Get() (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+	resp := &struct {
+		Token string `json:"token"`
+	}{}
+	if err := requestJSON(t.Client, http.MethodGet, t.URL+"/token/", nil, resp); err != nil {
+		return "", err
+	}
+	t.token, t.expires = resp.Token, time.Now().Add(tokenCacheTTL)
+	return t.token, nil
+}
+
+//// cache ////
+
+// CachedResolver caches the records resolved by the underlying resolver
+// and sends GUIDs to indexd, and DRS URIs to the DRS resolver
+type CachedResolver struct {
+	Indexd FileResolver
+	DRS    FileResolver
+
+	sync.Mutex
+	records map[string]*FileRecord
+}
+
+// Resolve ..
+func (resolver *CachedResolver) Resolve(ids ...string) (map[string]*FileRecord, error) {
+	resolver.Lock()
+	defer resolver.Unlock()
+	if resolver.records == nil {
+		resolver.records = make(map[string]*FileRecord)
+	}
+	var guids, uris []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if resolver.records[id] != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if strings.HasPrefix(id, drsPrefix) {
+			uris = append(uris, id)
+		} else {
+			guids = append(guids, id)
+		}
+	}
+	for _, batch := range []struct {
+		ids      []string
+		resolver FileResolver
+	}{{guids, resolver.Indexd}, {uris, resolver.DRS}} {
+		if len(batch.ids) == 0 {
+			continue
+		}
+		records, err := batch.resolver.Resolve(batch.ids...)
+		if err != nil {
+			return nil, err
+		}
+		for id, record := range records {
+			resolver.records[id] = record
+		}
+	}
+	records := make(map[string]*FileRecord)
+	for _, id := range ids {
+		records[id] = resolver.records[id]
+	}
+	return records, nil
+}
+
+// the resolver of the engine - see commonsResolver()
+var (
+	fileResolverOnce sync.Once
+	fileResolver     FileResolver
+)
+
+// commonsResolver returns the resolver of commons files, as specified in the mariner config
+func commonsResolver() FileResolver {
+	fileResolverOnce.Do(func() {
+		conf := Config.Resolver
+		prefs := AccessPreferences{Cloud: conf.Cloud, Region: conf.Region}
+		client := &http.Client{Timeout: resolverRequestTimeout * time.Second}
+		fileResolver = &CachedResolver{
+			Indexd: &IndexdResolver{
+				URL:         conf.indexdURL(),
+				Client:      client,
+				Preferences: prefs,
+				BatchSize:   conf.batchSize(),
+			},
+			DRS: &DRSResolver{
+				Hosts:         conf.DRSHosts,
+				Scheme:        httpsScheme,
+				Client:        client,
+				Preferences:   prefs,
+				MaxConcurrent: defaultDRSConcurrency,
+				Token:         (&wtsToken{URL: conf.wtsURL(), Client: client}).Get,
+				TrustedHosts:  conf.trustedHosts(),
+			},
+		}
+	})
+	return fileResolver
+}
+
+// resolveCommonsFile returns the record of a commons file, given its GUID or DRS URI
+func resolveCommonsFile(id string) (*FileRecord, error) {
+	records, err := commonsResolver().Resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	return records[id], nil
+}
+
+// resolveCommonsFiles resolves all the commons files in the inputs of the run in batches, so they're cached for the tasks
+// any failure here is only a warning - each file gets resolved again, with errors reported, by the task which uses it
+func (engine *K8sEngine) resolveCommonsFiles() {
+	var input interface{}
+	if err := json.Unmarshal(engine.Log.Request.Input, &input); err != nil {
+		engine.warnf("failed to unmarshal inputs to resolve commons files: %v", err)
+		return
+	}
+	var ids []string
+	for _, ref := range collectStrings(input, func(s string) bool {
+		return strings.HasPrefix(s, commonsPrefix) || strings.HasPrefix(s, drsPrefix)
+	}) {
+		if strings.HasPrefix(ref, commonsPrefix) {
+			ref = pathLib.Base(ref)
+		}
+		ids = append(ids, ref)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	engine.infof("begin resolve %v commons files", len(ids))
+	if _, err := commonsResolver().Resolve(ids...); err != nil {
+		engine.warnf("failed to resolve commons files: %v", err)
+		return
+	}
+	engine.infof("end resolve %v commons files", len(ids))
+}
@@ -0,0 +1,288 @@
+package mariner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// indexdStandIn serves the given records at the single and bulk endpoints of indexd, and counts the requests to each
+type indexdStandIn struct {
+	records map[string]*indexdRecord
+
+	sync.Mutex
+	single, bulk int
+}
+
+func (s *indexdStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/index/"):
+		s.single++
+		record, ok := s.records[strings.TrimPrefix(r.URL.Path, "/index/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(record)
+	case r.Method == http.MethodPost && r.URL.Path == "/bulk/documents":
+		s.bulk++
+		var guids []string
+		if err := json.NewDecoder(r.Body).Decode(&guids); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		records := []*indexdRecord{}
+		for _, guid := range guids {
+			if record, ok := s.records[guid]; ok {
+				records = append(records, record)
+			}
+		}
+		json.NewEncoder(w).Encode(records)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newIndexdStandIn() *indexdStandIn {
+	return &indexdStandIn{records: map[string]*indexdRecord{
+		"guid-1": {DID: "guid-1", Filename: "a.bam", Size: 1, URLs: []string{"gs://bucket/a.bam", "s3://bucket/a.bam"}},
+		"guid-2": {DID: "guid-2", Filename: "b.bam", Size: 2, URLs: []string{"s3://bucket/b.bam"}},
+		"guid-3": {DID: "guid-3", Filename: "c.bam", Size: 3, URLs: []string{"https://host/c.bam"}},
+	}}
+}
+
+func urlsOf(record *FileRecord) (urls []string) {
+	for _, u := range record.URLs {
+		urls = append(urls, u.URL)
+	}
+	return urls
+}
+
+func TestIndexdResolverSingle(t *testing.T) {
+	standIn := newIndexdStandIn()
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	resolver := &IndexdResolver{URL: server.URL, Client: server.Client(), Preferences: AccessPreferences{Cloud: awsCloud}, BatchSize: 2}
+
+	records, err := resolver.Resolve("guid-1")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	record := records["guid-1"]
+	if record == nil || record.Filename != "a.bam" || record.Size != 1 {
+		t.Fatalf("Resolve() = %+v, want record of a.bam", record)
+	}
+	// the s3 URL is preferred
+	if want := []string{"s3://bucket/a.bam", "gs://bucket/a.bam"}; !reflect.DeepEqual(urlsOf(record), want) {
+		t.Errorf("URLs = %v, want %v", urlsOf(record), want)
+	}
+	if standIn.single != 1 || standIn.bulk != 0 {
+		t.Errorf("requests: single = %v, bulk = %v, want 1 and 0", standIn.single, standIn.bulk)
+	}
+
+	if _, err = resolver.Resolve("guid-404"); err == nil {
+		t.Errorf("Resolve() of unknown GUID: want error")
+	}
+}
+
+func TestIndexdResolverBulk(t *testing.T) {
+	standIn := newIndexdStandIn()
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	resolver := &IndexdResolver{URL: server.URL, Client: server.Client(), BatchSize: 2}
+
+	records, err := resolver.Resolve("guid-1", "guid-2", "guid-3")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	for guid, filename := range map[string]string{"guid-1": "a.bam", "guid-2": "b.bam", "guid-3": "c.bam"} {
+		if records[guid] == nil || records[guid].Filename != filename {
+			t.Errorf("record of %v = %+v, want %v", guid, records[guid], filename)
+		}
+	}
+	// in batches of 2
+	if standIn.single != 0 || standIn.bulk != 2 {
+		t.Errorf("requests: single = %v, bulk = %v, want 0 and 2", standIn.single, standIn.bulk)
+	}
+
+	if _, err = resolver.Resolve("guid-1", "guid-404"); err == nil {
+		t.Errorf("Resolve() of unknown GUID: want error")
+	}
+}
+
+// drsStandIn serves one DRS object, whose signed access URLs are only available via the access endpoint
+// with an access method of a raw s3:// URL, and one whose access endpoint only gives a raw s3:// URL
+// if a token is given, the object is controlled access - requests without the token are refused
+func drsStandIn(t *testing.T, token string) (*httptest.Server, *int) {
+	requests := 0
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		requests++
+		if token != "" && r.Header.Get(authHeader) != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ga4gh/drs/v1/objects/obj-1", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		json.NewEncoder(w).Encode(&drsObject{
+			ID:   "obj-1",
+			Name: "d.bam",
+			Size: 4,
+			AccessMethods: []*drsAccessMethod{
+				{Type: s3Scheme, Region: "us-east-1", AccessURL: &drsAccessURL{URL: "s3://bucket/d.bam"}},
+				{Type: gsScheme, AccessID: "gs-access", Region: "us-east1"},
+				{Type: s3Scheme, AccessID: "s3-west", Region: "us-west-2"},
+				{Type: s3Scheme, AccessID: "s3-east", Region: "us-east-1"},
+				{Type: s3Scheme, AccessID: "s3-raw", Region: "us-east-1"},
+			},
+		})
+	})
+	mux.HandleFunc("/ga4gh/drs/v1/objects/obj-1/access/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		accessID := strings.TrimPrefix(r.URL.Path, "/ga4gh/drs/v1/objects/obj-1/access/")
+		if accessID == "s3-raw" {
+			json.NewEncoder(w).Encode(&drsAccessURL{URL: "s3://bucket/raw/d.bam"})
+			return
+		}
+		json.NewEncoder(w).Encode(&drsAccessURL{
+			URL:     "https://" + accessID + ".example.com/d.bam?X-Amz-Signature=abc",
+			Headers: []string{"X-Access: " + accessID},
+		})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestDRSResolver(t *testing.T) {
+	server, requests := drsStandIn(t, "user-token")
+	host := strings.TrimPrefix(server.URL, "http://")
+	resolver := &DRSResolver{
+		Scheme:        "http",
+		Client:        server.Client(),
+		Preferences:   AccessPreferences{Cloud: awsCloud, Region: "us-east-1"},
+		MaxConcurrent: 2,
+		Token:         func() (string, error) { return "user-token", nil },
+	}
+	uri := drsPrefix + host + "/obj-1"
+
+	// the user's token is only sent to trusted hosts
+	if _, err := resolver.Resolve(uri); err == nil {
+		t.Fatalf("Resolve() of controlled access object from untrusted host: want error")
+	}
+	*requests = 0
+	resolver.TrustedHosts = map[string]bool{host: true}
+
+	records, err := resolver.Resolve(uri)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	record := records[uri]
+	if record == nil || record.Filename != "d.bam" || record.Size != 4 {
+		t.Fatalf("Resolve() = %+v, want record of d.bam", record)
+	}
+	// only the https access URLs - matching cloud and region, then matching cloud, then the rest
+	want := []string{
+		"https://s3-east.example.com/d.bam?X-Amz-Signature=abc",
+		"https://s3-west.example.com/d.bam?X-Amz-Signature=abc",
+		"https://gs-access.example.com/d.bam?X-Amz-Signature=abc",
+	}
+	if !reflect.DeepEqual(urlsOf(record), want) {
+		t.Errorf("URLs = %v, want %v", urlsOf(record), want)
+	}
+	if h := record.URLs[0].Headers; !reflect.DeepEqual(h, []string{"X-Access: s3-east"}) {
+		t.Errorf("headers of preferred URL = %v, want those of its access URL", h)
+	}
+	// the object, and each of its access IDs
+	if *requests != 5 {
+		t.Errorf("requests = %v, want 5", *requests)
+	}
+
+	// the signed URLs get staged at the path of the preferred one, without its query string - and registered as its sources
+	path, err := stageRemoteFile(record.URLs)
+	if err != nil {
+		t.Fatalf("stageRemoteFile() error = %v", err)
+	}
+	if want := pathToRemoteData + "https/s3-east.example.com/d.bam"; path != want {
+		t.Errorf("stageRemoteFile() = %v, want %v", path, want)
+	}
+	if sources := remoteSources(path); !reflect.DeepEqual(sources, record.URLs) {
+		t.Errorf("remoteSources() = %v, want the access URLs of the record", sources)
+	}
+}
+
+func TestCachedResolver(t *testing.T) {
+	standIn := newIndexdStandIn()
+	indexd := httptest.NewServer(standIn)
+	defer indexd.Close()
+	drs, drsRequests := drsStandIn(t, "")
+	resolver := &CachedResolver{
+		Indexd: &IndexdResolver{URL: indexd.URL, Client: indexd.Client(), BatchSize: 100},
+		DRS:    &DRSResolver{Scheme: "http", Client: drs.Client(), MaxConcurrent: 2},
+	}
+	uri := drsPrefix + strings.TrimPrefix(drs.URL, "http://") + "/obj-1"
+
+	// GUIDs go to indexd, in one batch, and DRS URIs to the DRS resolver
+	records, err := resolver.Resolve("guid-1", "guid-2", uri)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if len(records) != 3 || records["guid-2"].Filename != "b.bam" || records[uri].Filename != "d.bam" {
+		t.Fatalf("Resolve() = %v, want records of guid-1, guid-2 and %v", records, uri)
+	}
+	drsRequestsBefore := *drsRequests
+
+	// cached
+	for _, id := range []string{"guid-1", "guid-2", uri} {
+		if _, err = resolver.Resolve(id); err != nil {
+			t.Fatalf("Resolve(%v) error = %v", id, err)
+		}
+	}
+	if standIn.single != 0 || standIn.bulk != 1 || *drsRequests != drsRequestsBefore {
+		t.Errorf("cached records got looked up again: indexd single = %v, bulk = %v; DRS = %v", standIn.single, standIn.bulk, *drsRequests-drsRequestsBefore)
+	}
+
+	// only the GUID which isn't cached gets looked up
+	if _, err = resolver.Resolve("guid-1", "guid-3"); err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if standIn.single != 1 || standIn.bulk != 1 {
+		t.Errorf("requests: single = %v, bulk = %v, want 1 and 1", standIn.single, standIn.bulk)
+	}
+}
+
+func TestWTSToken(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/token/" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "user-token"})
+	}))
+	defer server.Close()
+	token := &wtsToken{URL: server.URL, Client: server.Client()}
+	for i := 0; i < 3; i++ {
+		got, err := token.Get()
+		if err != nil || got != "user-token" {
+			t.Fatalf("Get() = %v, %v, want user-token", got, err)
+		}
+	}
+	// cached
+	if requests != 1 {
+		t.Errorf("requests = %v, want 1", requests)
+	}
+}
@@ -0,0 +1,176 @@
+package mariner
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+)
+
+// this file contains code for resolving the ResourceRequirement of a tool
+// the resolved values populate the `runtime` context in the js vm
+// as well as the resource spec of the task container
+
+// ToolResources holds the resolved ResourceRequirement for a tool
+// values are in CWL units - cores (possibly fractional), and mebibytes for ram, tmpdir and outdir
+// a value of zero means that field was not specified in the CWL
+type ToolResources struct {
+	CoresMin  float64
+	CoresMax  float64
+	RAMMin    int64
+	RAMMax    int64
+	TmpdirMin int64
+	TmpdirMax int64
+	OutdirMin int64
+	OutdirMax int64
+}
+
+// resolveResources reads the ResourceRequirement for the tool
+// and loads the resulting runtime context into the tool's js vms
+// any field may be an expression, evaluated against the inputs context - e.g., to size ram from input file sizes
+func (tool *Tool) resolveResources() (err error) {
+	tool.Task.infof("begin resolve resource requirements")
+	resources := &ToolResources{}
+	if requirement := tool.Task.rawRequirement(CWLResourceRequirement); requirement != nil {
+		for _, field := range []string{"coresMin", "coresMax"} {
+			v, err := tool.resourceValue(requirement[field])
+			if err != nil {
+				return tool.Task.errorf("failed to resolve %v: %v", field, err)
+			}
+			if field == "coresMin" {
+				resources.CoresMin = v
+			} else {
+				resources.CoresMax = v
+			}
+		}
+		fields := map[string]*int64{
+			"ramMin":    &resources.RAMMin,
+			"ramMax":    &resources.RAMMax,
+			"tmpdirMin": &resources.TmpdirMin,
+			"tmpdirMax": &resources.TmpdirMax,
+			"outdirMin": &resources.OutdirMin,
+			"outdirMax": &resources.OutdirMax,
+		}
+		for field, dest := range fields {
+			v, err := tool.resourceValue(requirement[field])
+			if err != nil {
+				return tool.Task.errorf("failed to resolve %v: %v", field, err)
+			}
+			// fractional mebibytes are rounded up
+			*dest = int64(math.Ceil(v))
+		}
+	}
+	tool.Resources = resources
+	for _, vm := range []*otto.Otto{tool.JSVM, tool.InputsVM} {
+		if err = tool.setRuntime(vm); err != nil {
+			return tool.Task.errorf("failed to load runtime context to js vm: %v", err)
+		}
+	}
+	tool.Task.infof("end resolve resource requirements: %+v", *resources)
+	return nil
+}
+
+// resourceValue resolves a ResourceRequirement field to a number
+// the field is either a number or an expression which returns a number
+func (tool *Tool) resourceValue(v interface{}) (float64, error) {
+	if exp, ok := v.(string); ok && strings.HasPrefix(exp, "$") {
+		result, err := tool.evalExpression(exp)
+		if err != nil {
+			return 0, err
+		}
+		v = result
+	}
+	var f float64
+	switch x := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		f = x
+	case int64:
+		f = float64(x)
+	case int:
+		f = float64(x)
+	default:
+		return 0, fmt.Errorf("unsupported value: %v", v)
+	}
+	if f < 0 {
+		return 0, fmt.Errorf("negative value: %v", f)
+	}
+	return f, nil
+}
+
+// reserved returns the amount of a resource reserved for the tool process
+// which is the min if specified, else the max if specified, else the CWL default
+func reserved(min, max, defaultValue int64) int64 {
+	switch {
+	case min > 0:
+		return min
+	case max > 0:
+		return max
+	}
+	return defaultValue
+}
+
+// runtime returns the `runtime` context for the tool
+// see: https://www.commonwl.org/v1.1/CommandLineTool.html#Runtime_environment
+func (tool *Tool) runtime() *TaskRuntimeJSContext {
+	resources := tool.Resources
+	if resources == nil {
+		// resources not yet resolved - use the CWL defaults
+		resources = &ToolResources{}
+	}
+	tmpdirSize := reserved(resources.TmpdirMin, resources.TmpdirMax, defaultTmpdirMin)
+	outdirSize := reserved(resources.OutdirMin, resources.OutdirMax, defaultOutdirMin)
+	// runtime.cores is an integer - fractional cores are rounded up
+	cores := int64(math.Ceil(resources.CoresMin))
+	if cores == 0 {
+		cores = int64(math.Ceil(resources.CoresMax))
+	}
+	return &TaskRuntimeJSContext{
+		Outdir:     tool.outputDirectory(),
+		Tmpdir:     taskTmpdir,
+		Cores:      reserved(cores, 0, defaultCoresMin),
+		RAM:        reserved(resources.RAMMin, resources.RAMMax, defaultRAMMin),
+		OutdirSize: outdirSize,
+		TmpdirSize: tmpdirSize,
+		ExitCode:   tool.ExitCode,
+	}
+}
+
+// setRuntime loads the tool's `runtime` context into the given js vm
+func (tool *Tool) setRuntime(vm *otto.Otto) error {
+	if vm == nil {
+		return nil
+	}
+	runtime, err := preProcessContext(tool.runtime())
+	if err != nil {
+		return fmt.Errorf("failed to preprocess runtime js context: %v", err)
+	}
+	return vm.Set("runtime", runtime)
+}
+
+// loadExitCode reads the exit code of the tool process
+// which the task container writes to a file in the tool's working dir
+// and makes it available as `runtime.exitCode` for output evaluation (CWL v1.1+)
+func (engine *K8sEngine) loadExitCode(tool *Tool) error {
+	if tool.Task.Document == nil || !tool.Task.Document.versionAtLeast("v1.1") {
+		return nil
+	}
+	tool.Task.infof("begin load exit code")
+	f := fileObject(tool.WorkingDir + exitCodeFile)
+	if err := engine.loadContents(f); err != nil {
+		return tool.Task.errorf("failed to load exit code file: %v", err)
+	}
+	exitCode, err := strconv.Atoi(strings.TrimSpace(f.Contents))
+	if err != nil {
+		return tool.Task.errorf("failed to parse exit code: %v", err)
+	}
+	tool.ExitCode = &exitCode
+	if err = tool.setRuntime(tool.InputsVM); err != nil {
+		return tool.Task.errorf("failed to load runtime context to js vm: %v", err)
+	}
+	tool.Task.infof("end load exit code: %v", exitCode)
+	return nil
+}
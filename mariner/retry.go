@@ -0,0 +1,204 @@
+package mariner
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	k8sResource "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// this file contains code for retrying a task whose last attempt failed
+// 1. infrastructure failures - the node was lost, or the pod was evicted or preempted (e.g., a spot node was reclaimed)
+// ---- the task is rescheduled as is, without counting against the tool's retry budget
+// 2. OOMKilled - each retry requests more memory than the last - multiplied by the configured factor, up to the configured ceiling
+// ---- so that a tool whose `ramMin` is an underestimate still gets to run
+//
+// the stats of each failed attempt are kept in the task's stats
+
+// exit code of a process killed by SIGKILL - which, in a container with a memory limit, is the OOM killer
+const sigkillExitCode = 137
+
+// retry dispatches a new task job, if the last attempt failed in a way that a new attempt may fix
+// returns true if the task was retried
+// only a failed job is retried - not one which completed, timed out, or was cancelled
+func (engine *K8sEngine) retry(tool *Tool) (retried bool, err error) {
+	if tool.Task.Log.Status != failed {
+		return false, nil
+	}
+	if tool.Failure != nil && tool.Failure.Infrastructure {
+		return engine.reschedule(tool)
+	}
+	return engine.retryOOM(tool)
+}
+
+// reschedule dispatches a new task job, if the last attempt was lost to an infrastructure failure
+func (engine *K8sEngine) reschedule(tool *Tool) (retried bool, err error) {
+	stats := tool.Task.Log.Stats
+	if stats.NReschedules >= Config.Retries.Infrastructure.maxReschedules() {
+		tool.Task.warnf("task lost to infrastructure failure - no reschedules remain, after %v reschedules", stats.NReschedules)
+		return false, nil
+	}
+	tool.Task.infof("begin reschedule of task lost to infrastructure failure: %v", tool.Failure)
+	engine.newAttempt(tool)
+	engine.Lock()
+	stats.NReschedules++
+	engine.Unlock()
+	if err = engine.runCommandLineTool(tool); err != nil {
+		return false, tool.Task.errorf("failed to reschedule task: %v", err)
+	}
+	tool.Task.infof("end reschedule of task - new job: %v", tool.JobName)
+	return true, nil
+}
+
+// retryOOM dispatches a new task job with escalated memory, if the last attempt was OOMKilled and retries remain
+func (engine *K8sEngine) retryOOM(tool *Tool) (retried bool, err error) {
+	conf := Config.Retries.OOM
+	if conf.MaxRetries <= 0 || !engine.oomKilled(tool) {
+		return false, nil
+	}
+	stats := tool.Task.Log.Stats
+	if stats.NRetries >= conf.MaxRetries {
+		tool.Task.warnf("task was OOMKilled - no retries remain, after %v retries", stats.NRetries)
+		return false, nil
+	}
+	ramMin, ramMax, escalated, err := escalateMemory(tool.Resources, conf, Config.Containers.Task.Resources.Limits.Memory)
+	if err != nil {
+		return false, tool.Task.errorf("failed to escalate memory: %v", err)
+	}
+	if !escalated {
+		tool.Task.warnf("task was OOMKilled - memory is already at the ceiling of %v", conf.Ceiling)
+		return false, nil
+	}
+	tool.Task.infof("begin retry of OOMKilled task with memory (min, max) of (%v, %v) MiB", ramMin, ramMax)
+	if tool.Failure == nil {
+		tool.Failure = &TaskFailure{Reason: oomKilled, Message: "tool process was killed"}
+	}
+	engine.newAttempt(tool)
+	engine.Lock()
+	stats.NRetries++
+	engine.Unlock()
+
+	// runtime.ram changes, so the command is regenerated - it may depend on runtime.ram, e.g., `-Xmx$(runtime.ram)m`
+	tool.Resources.RAMMin, tool.Resources.RAMMax = ramMin, ramMax
+	for _, vm := range []*otto.Otto{tool.JSVM, tool.InputsVM} {
+		if err = tool.setRuntime(vm); err != nil {
+			return false, tool.Task.errorf("failed to load runtime context to js vm: %v", err)
+		}
+	}
+	if err = engine.runCommandLineTool(tool); err != nil {
+		return false, tool.Task.errorf("failed to retry task: %v", err)
+	}
+	tool.Task.infof("end retry of OOMKilled task - new job: %v", tool.JobName)
+	return true, nil
+}
+
+// newAttempt keeps the stats of the failed attempt, and cleans up after it
+// i.e., deletes its PVC, and the exit code and status files it left in the tool's working dir
+func (engine *K8sEngine) newAttempt(tool *Tool) {
+	stats := tool.Task.Log.Stats
+	engine.Lock()
+	stats.Attempts = append(stats.Attempts, AttemptStats{
+		JobName:       tool.JobName,
+		Failure:       tool.Failure.Error(),
+		MemoryReq:     stats.MemoryReq,
+		ResourceUsage: stats.ResourceUsage,
+	})
+	stats.NFailures++
+	stats.MemoryReq = ResourceRequirement{}
+	engine.Unlock()
+
+	if err := engine.deletePVC(tool); err != nil {
+		tool.Task.warnf("failed to delete pvc of failed attempt: %v", err)
+	}
+	// the next attempt may fail before writing its own - so it mustn't be diagnosed from those of this attempt
+	for _, name := range []string{exitCodeFile, taskExitFile, taskStatusFile, sidecarFailureMarker} {
+		if err := engine.S3FileManager.Storage.Delete(engine.localPathToS3Key(tool.WorkingDir + name)); err != nil {
+			tool.Task.warnf("failed to delete %v of failed attempt: %v", name, err)
+		}
+	}
+	tool.Failure = nil
+	tool.ExitCode = nil
+	tool.podSeen = false
+	tool.pullFailingSince = time.Time{}
+	tool.eventsListed = time.Time{}
+	tool.Task.Log.Status = running
+	engine.taskLogTransition(tool.Task)
+}
+
+// oomKilled returns true if the last attempt of the tool was killed for exceeding its memory limit
+// either the task container was OOMKilled, or the tool process was killed within the container
+func (engine *K8sEngine) oomKilled(tool *Tool) bool {
+	if tool.Failure != nil && tool.Failure.Reason == oomKilled {
+		return true
+	}
+	if tool.Task.Log.Stats.MemoryReq.Max == 0 && Config.Containers.Task.Resources.Limits.Memory == "" {
+		// no memory limit, so no OOM kill
+		return false
+	}
+	f := fileObject(tool.WorkingDir + exitCodeFile)
+	if err := engine.loadContents(f); err != nil {
+		return false
+	}
+	return strings.TrimSpace(f.Contents) == strconv.Itoa(sigkillExitCode)
+}
+
+// escalateMemory returns the escalated memory (min, max) in MiB for the next attempt of a task
+// both the request and the limit get set, so that the configured default limit doesn't apply
+// neither ever drops below its current value - escalated is false if the limit isn't strictly larger than the current one,
+// which is the tool's ramMax, or else the configured default limit (e.g., "4Gi"), if any
+func escalateMemory(resources *ToolResources, conf OOMRetries, defaultLimit string) (ramMin int64, ramMax int64, escalated bool, err error) {
+	factor := conf.Factor
+	if factor <= 1 {
+		factor = defaultOOMRetryFactor
+	}
+	ceiling := int64(math.MaxInt64)
+	if conf.Ceiling != "" {
+		if ceiling, err = mebibytes(conf.Ceiling); err != nil {
+			return 0, 0, false, fmt.Errorf("invalid memory ceiling: %v", err)
+		}
+	}
+	limit := resources.RAMMax
+	if limit == 0 && defaultLimit != "" {
+		if limit, err = mebibytes(defaultLimit); err != nil {
+			return 0, 0, false, fmt.Errorf("invalid default memory limit: %v", err)
+		}
+	}
+	base := reserved(resources.RAMMin, resources.RAMMax, defaultRAMMin)
+	ramMin = maxInt64(minInt64(int64(math.Ceil(float64(base)*factor)), ceiling), resources.RAMMin)
+	ramMax = maxInt64(minInt64(int64(math.Ceil(float64(maxInt64(limit, base))*factor)), ceiling), limit)
+	if ramMax < ramMin {
+		ramMax = ramMin
+	}
+	if limit == 0 {
+		// no limit, so the task was killed for memory pressure on its node - only the request makes a difference
+		return ramMin, ramMax, ramMin > resources.RAMMin, nil
+	}
+	return ramMin, ramMax, ramMax > limit, nil
+}
+
+// mebibytes returns the given k8s quantity in MiB - e.g., "4Gi" -> 4096
+func mebibytes(quantity string) (int64, error) {
+	q, err := k8sResource.ParseQuantity(quantity)
+	if err != nil {
+		return 0, err
+	}
+	return q.Value() / int64(math.Pow(2, 20)), nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
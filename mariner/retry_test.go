@@ -0,0 +1,45 @@
+package mariner
+
+import "testing"
+
+func TestEscalateMemory(t *testing.T) {
+	cases := []struct {
+		name           string
+		ramMin, ramMax int64
+		conf           OOMRetries
+		defaultLimit   string
+		wantMin        int64
+		wantMax        int64
+		wantEscalated  bool
+		wantErr        bool
+	}{
+		{name: "unset min and max", wantMin: 2 * defaultRAMMin, wantMax: 2 * defaultRAMMin, wantEscalated: true},
+		{name: "unset min and max, default limit", defaultLimit: "1Gi", wantMin: 2 * defaultRAMMin, wantMax: 2048, wantEscalated: true},
+		{name: "max only", ramMax: 1000, wantMin: 2000, wantMax: 2000, wantEscalated: true},
+		{name: "min only, default limit", ramMin: 1000, defaultLimit: "4Gi", wantMin: 2000, wantMax: 8192, wantEscalated: true},
+		{name: "min and max", ramMin: 1000, ramMax: 2000, wantMin: 2000, wantMax: 4000, wantEscalated: true},
+		{name: "factor", ramMin: 1000, ramMax: 2000, conf: OOMRetries{Factor: 1.5}, wantMin: 1500, wantMax: 3000, wantEscalated: true},
+		{name: "capped at ceiling", ramMin: 1024, ramMax: 2048, conf: OOMRetries{Ceiling: "3Gi"}, wantMin: 2048, wantMax: 3072, wantEscalated: true},
+		// never less than the current request and limit
+		{name: "ceiling below current", ramMin: 4096, ramMax: 8192, conf: OOMRetries{Ceiling: "2Gi"}, wantMin: 4096, wantMax: 8192},
+		{name: "ceiling below default limit", defaultLimit: "4Gi", conf: OOMRetries{Ceiling: "2Gi"}, wantMin: 2 * defaultRAMMin, wantMax: 4096},
+		{name: "ceiling reached", ramMin: 2048, ramMax: 3072, conf: OOMRetries{Ceiling: "3Gi"}, wantMin: 3072, wantMax: 3072},
+		{name: "invalid ceiling", conf: OOMRetries{Ceiling: "lots"}, wantErr: true},
+	}
+	for _, c := range cases {
+		ramMin, ramMax, escalated, err := escalateMemory(&ToolResources{RAMMin: c.ramMin, RAMMax: c.ramMax}, c.conf, c.defaultLimit)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%v: want error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: error = %v", c.name, err)
+			continue
+		}
+		if ramMin != c.wantMin || ramMax != c.wantMax || escalated != c.wantEscalated {
+			t.Errorf("%v: escalateMemory() = (%v, %v, %v), want (%v, %v, %v)", c.name, ramMin, ramMax, escalated, c.wantMin, c.wantMax, c.wantEscalated)
+		}
+	}
+}
@@ -8,7 +8,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/uc-cdis/mariner/storage"
 )
 
 const (
@@ -16,6 +16,10 @@ const (
 	awsCredsEnvVar         = "AWSCREDS"
 	userIDEnvVar           = "USER_ID"
 	sharedVolumeNameEnvVar = "ENGINE_WORKSPACE"
+	remoteS3CredsEnvVar    = "REMOTE_S3_CREDS"
+	remoteGSCredsEnvVar    = "REMOTE_GS_CREDS"
+	remoteHTTPSCredsEnvVar = "REMOTE_HTTPS_CREDS"
+	remoteHTTPSHostsEnvVar = "REMOTE_HTTPS_HOSTS"
 
 	// setting a max so as to prevent the error of having too many files being open at once
 	// need to investigate how high we can set this bound without running into problems
@@ -25,6 +29,10 @@ const (
 	// resides in the task's working dir in s3
 	// contains list of files that need to be downloaded from s3 in order for this task to run
 	inputFileListName = "_mariner_s3_input.json"
+
+	// resides in the task's working dir in s3
+	// contains the command for the task container, from which the s3sidecar writes run.sh - see TaskCommand
+	commandFileName = "_mariner_command.json"
 )
 
 // S3FileManager ..
@@ -32,6 +40,7 @@ type S3FileManager struct {
 	AWSConfig     *aws.Config
 	S3BucketName  string
 	MaxConcurrent int
+	Storage       storage.Storage // where run logs, requests and task working dirs are read and written - see Config.Storage.Backend
 }
 
 func loadAWSConfig() (*aws.Config, error) {
@@ -55,17 +64,25 @@ type awsCredentials struct {
 }
 
 func (fm *S3FileManager) setup() (err error) {
-	fm.AWSConfig, err = loadAWSConfig()
-	if err != nil {
-		return err
-	}
 	fm.S3BucketName = Config.Storage.S3.Name
 	fm.MaxConcurrent = maxConcurrent
-	return nil
-}
-
-func (fm *S3FileManager) newS3Session() *session.Session {
-	return session.Must(session.NewSession(fm.AWSConfig))
+	switch backend := Config.Storage.backend(); backend {
+	case localBackend:
+		if Config.Storage.Local.Root == "" {
+			return fmt.Errorf("no root dir configured for the local storage backend")
+		}
+		fm.Storage, err = storage.NewLocal(Config.Storage.Local.Root)
+		return err
+	case s3Backend:
+		fm.AWSConfig, err = loadAWSConfig()
+		if err != nil {
+			return err
+		}
+		fm.Storage, err = storage.NewS3(fm.S3BucketName, fm.AWSConfig, Config.Storage.S3.Endpoint)
+		return err
+	default:
+		return fmt.Errorf("unknown storage backend: %v", backend)
+	}
 }
 
 /*
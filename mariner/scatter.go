@@ -86,6 +86,7 @@ func (engine *K8sEngine) gatherScatterOutputs(task *Task) (err error) {
 		mtx := &sync.Mutex{}
 		go func(scatterTask *Task, totalOutput map[string][]interface{}) {
 			defer wg.Done()
+			defer engine.recoverTask(task)
 			for !*scatterTask.Done {
 				// wait for scattered task to finish
 			}
@@ -143,6 +144,7 @@ func (engine *K8sEngine) runScatterTasks(task *Task) (err error) {
 		wg.Add(1)
 		go func(scattertask *Task) {
 			defer wg.Done()
+			defer engine.recoverTask(scattertask)
 			engine.run(scattertask)
 		}(scattertask)
 	}
@@ -201,6 +203,8 @@ func (task *Task) dotproduct(scatterParams map[string][]interface{}) (err error)
 		task.infof("begin build subtask %v", i)
 		subtask := &Task{
 			Root:         task.Root,
+			Document:     task.Document,
+			Requirements: task.Requirements,
 			Parameters:   make(cwl.Parameters),
 			OriginalStep: task.OriginalStep,
 			Done:         &falseVal,
@@ -243,6 +247,8 @@ func (task *Task) flatCrossproduct(scatterParams map[string][]interface{}) (err
 		task.infof("begin build subtask %v", scatterIndex)
 		subtask := &Task{
 			Root:         task.Root,
+			Document:     task.Document,
+			Requirements: task.Requirements,
 			Parameters:   make(cwl.Parameters),
 			OriginalStep: task.OriginalStep,
 			Done:         &falseVal,
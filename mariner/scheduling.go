@@ -0,0 +1,114 @@
+package mariner
+
+import (
+	"encoding/json"
+
+	k8sv1 "k8s.io/api/core/v1"
+)
+
+// this file contains code for handling the scheduling constraints of mariner jobs
+// 1. per component - `scheduling` of the engine and task job configs in the mariner config
+// 2. per tool - the `mariner:Scheduling` hint, which overrides the task job config
+//
+// e.g., to pin a memory-heavy tool to a high-memory node group:
+//
+// hints:
+//   mariner:Scheduling:
+//     spot: true                        # prefer spot capacity, per `jobs.task.spot` in the mariner config
+//     profile: highmem                  # a named profile from `jobs.task.profiles` in the mariner config
+//     nodeSelector:                     # and/or any of the Scheduling fields directly
+//       role: highmem
+//
+// $namespaces:
+//   mariner: https://github.com/uc-cdis/mariner#
+
+// apply sets those scheduling constraints which are specified onto the given pod spec
+func (s *Scheduling) apply(spec *k8sv1.PodSpec) {
+	if s == nil {
+		return
+	}
+	if s.Tolerations != nil {
+		spec.Tolerations = s.Tolerations
+	}
+	if s.NodeSelector != nil {
+		spec.NodeSelector = s.NodeSelector
+	}
+	if s.Affinity != nil {
+		spec.Affinity = s.Affinity
+	}
+	if s.PriorityClassName != "" {
+		spec.PriorityClassName = s.PriorityClassName
+	}
+	if s.RuntimeClassName != "" {
+		runtimeClassName := s.RuntimeClassName
+		spec.RuntimeClassName = &runtimeClassName
+	}
+}
+
+// override sets those scheduling constraints which are specified in the given scheduling
+func (s *Scheduling) override(o *Scheduling) {
+	if o.Tolerations != nil {
+		s.Tolerations = o.Tolerations
+	}
+	if o.NodeSelector != nil {
+		s.NodeSelector = o.NodeSelector
+	}
+	if o.Affinity != nil {
+		s.Affinity = o.Affinity
+	}
+	if o.PriorityClassName != "" {
+		s.PriorityClassName = o.PriorityClassName
+	}
+	if o.RuntimeClassName != "" {
+		s.RuntimeClassName = o.RuntimeClassName
+	}
+}
+
+// scheduling returns the scheduling constraints given by the tool's mariner:Scheduling hint, if any
+// spot scheduling is applied first, then a named profile, then any constraints given directly in the hint
+func (tool *Tool) scheduling() (*Scheduling, error) {
+	scheduling := &Scheduling{}
+	hint := tool.Task.marinerHint(marinerSchedulingHint)
+	if hint == nil {
+		return scheduling, nil
+	}
+	tool.Task.infof("begin load scheduling hint")
+	if spot, _ := hint["spot"].(bool); spot {
+		// spot nodes may be reclaimed at any time - such tasks get rescheduled, see retry.go
+		if Config.Jobs.Task.Spot == nil {
+			tool.Task.warnf("tool prefers spot capacity, but no spot scheduling is configured")
+		} else {
+			scheduling.override(Config.Jobs.Task.Spot)
+		}
+	}
+	if v, ok := hint["profile"]; ok {
+		name, _ := v.(string)
+		profile, ok := Config.Jobs.Task.Profiles[name]
+		if !ok {
+			return nil, tool.Task.errorf("no scheduling profile named: %v", v)
+		}
+		scheduling.override(&profile)
+	}
+	b, err := json.Marshal(hint)
+	if err != nil {
+		return nil, tool.Task.errorf("failed to marshal scheduling hint: %v", err)
+	}
+	explicit := &Scheduling{}
+	if err = json.Unmarshal(b, explicit); err != nil {
+		return nil, tool.Task.errorf("failed to unmarshal scheduling hint: %v", err)
+	}
+	scheduling.override(explicit)
+	tool.Task.infof("end load scheduling hint: %+v", *scheduling)
+	return scheduling, nil
+}
+
+// marinerHint returns the raw mariner-specific hint (or requirement) of the given class for this task, or nil if none applies
+// the class may be given with the `mariner:` prefix, or as the full IRI in the mariner namespace
+func (task *Task) marinerHint(class string) map[string]interface{} {
+	for c, requirement := range task.Requirements {
+		if c == marinerNamespacePrefix+class || task.Document.expandIRI(c) == marinerNamespace+class {
+			return requirement.Raw
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package mariner
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -13,11 +14,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	batchv1 "k8s.io/api/batch/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	batchtypev1 "k8s.io/client-go/kubernetes/typed/batch/v1"
 
 	logrus "github.com/sirupsen/logrus"
@@ -40,6 +40,10 @@ type WorkflowRequest struct {
 
 	// new: specify a service account for the workflow job
 	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// optional wall-clock budget for the whole run, as a go duration string - e.g., "36h"
+	// if exceeded, the engine cancels all outstanding task jobs and fails the run
+	MaxRunDuration string `json:"maxRunDuration,omitempty"`
 }
 
 type Manifest []ManifestEntry
@@ -135,6 +139,7 @@ func runServer() {
 	fm := &S3FileManager{}
 	fm.setup()
 	server := server().withLogger(logger).withJWTApp(jwtApp).withS3FileManager(fm)
+	go server.deleteOrphanedPVCs()
 	router := server.makeRouter(os.Stdout)
 	addr := fmt.Sprintf(":%d", *port)
 	httpLogger := log.New(os.Stdout, "", log.LstdFlags)
@@ -169,17 +174,24 @@ func server() (server *Server) {
 	return &Server{}
 }
 
-// first just getting the endpoints to work, then will make nice and WES-ish
-func (server *Server) makeRouter(out io.Writer) http.Handler {
+// routes returns the router of the API endpoints, without the auth and response header middleware
+func (server *Server) routes() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/runs", server.handleRunsPOST).Methods("POST")
 	router.HandleFunc("/runs", server.handleRunsGET).Methods("GET")
 	router.HandleFunc("/runs/{runID}", server.handleRunLogGET).Methods("GET")
 	router.HandleFunc("/runs/{runID}/status", server.handleRunStatusGET).Methods("GET")
 	router.HandleFunc("/runs/{runID}/cancel", server.handleCancelRunPOST).Methods("POST")
+	router.HandleFunc("/runs/{runID}/tasks/{taskID}/logs", server.handleTaskLogsGET).Methods("GET")
 	router.HandleFunc("/_status", server.handleHealthCheck).Methods("GET") // TO CHECK
 
 	// router.NotFoundHandler = http.HandlerFunc(handleNotFound) // TODO
+	return router
+}
+
+// first just getting the endpoints to work, then will make nice and WES-ish
+func (server *Server) makeRouter(out io.Writer) http.Handler {
+	router := server.routes()
 
 	router.Use(server.handleAuth)        // use auth middleware function - right now access to mariner API is all-or-nothing
 	router.Use(server.setResponseHeader) // set "Content-Type: application/json" header - every endpoint returns JSON
@@ -233,7 +245,7 @@ func (server *Server) handleRunStatusGET(w http.ResponseWriter, r *http.Request)
 
 func (server *Server) fetchStatus(userID, runID string) (*StatusJSON, error) {
 	j := &StatusJSON{}
-	runLog, err := server.fetchMainLog(userID, runID)
+	runLog, err := server.fetchRunLogIndex(userID, runID)
 	if err != nil {
 		return nil, err
 	}
@@ -271,15 +283,15 @@ func (server *Server) cancelRun(userID, runID string) (*CancelRunJSON, error) {
 	if err != nil {
 		return nil, err
 	}
-	engineJob, err := jobByID(jobsClient, runLog.Main.JobID)
-	if err != nil {
-		return j, err
-	}
+	deleteOption := metav1.NewDeleteOptions(120) // how long (seconds) should the grace period be?
+	var deletionPropagation metav1.DeletionPropagation = "Background"
+	deleteOption.PropagationPolicy = &deletionPropagation
 
-	// first kill engine job
+	// first kill engine job - the engine job name is the run ID
+	// the task jobs and PVCs of the run are owned by the engine job, so k8s garbage collects them too
 	fmt.Println("deleting engine job..")
-	err = deleteJobs([]batchv1.Job{*engineJob}, running, jobsClient)
-	if err != nil {
+	err = jobsClient.Delete(context.TODO(), runID, *deleteOption)
+	if err != nil && !k8sErrors.IsNotFound(err) {
 		// log
 		runLog.Main.Event.errorf("error killing engine job: %v", err)
 		return j, err
@@ -295,47 +307,31 @@ func (server *Server) cancelRun(userID, runID string) (*CancelRunJSON, error) {
 	server.writeLog(runLog, userID, runID)
 
 	// then wait til engine job is killed, and kill all associated task jobs
+	// in case any task job didn't get garbage collected - e.g., if created without an owner reference
 	go func(runLog *MainLog, jobsClient batchtypev1.JobInterface) {
 		fmt.Println("sleeping out grace period..")
 		time.Sleep(150 * time.Second)
 
-		fmt.Println("collecting running tasks..")
-		taskJobs := []batchv1.Job{}
-		for taskID, task := range runLog.ByProcess {
-			fmt.Println("handling task ", taskID)
-			if task.JobID != "" {
-				fmt.Println("nonempty jobID: ", task.JobName)
-				job, err := jobByID(jobsClient, task.JobID)
-				if err != nil {
-					fmt.Println("failed to fetch job with ID ", task.JobID)
+		fmt.Println("deleting task jobs..")
+		selector := metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%v=%v,%v=%v", componentLabel, marinerTask, runIDLabel, labelValue(runID)),
+		}
+		if err := jobsClient.DeleteCollection(context.TODO(), *deleteOption, selector); err != nil {
+			fmt.Println("error deleting task jobs: ", err)
+		}
+		for _, task := range runLog.ByProcess {
+			// some running tasks may finish in this grace period
+			// although those task processes finish, output is not collected from them
+			// because the engine process has already been killed
+			// so the most appropriate status for these tasks is 'cancelled'
+			if task.Status == running || task.Status == notStarted {
+				if task.JobID != "" {
+					// log
+					task.Event.info("task process killed")
 				}
-				fmt.Println("collected this running job: ", task.JobName)
-				taskJobs = append(taskJobs, *job)
-
-				// log
-				task.Event.info("task process killed")
-
-				// update status of each task process to be killed
-				task.Status = cancelled
-			} else if task.Status == running {
-				// some running tasks may finish in this grace period
-				// although those task processes finish, output is not collected from them
-				// because the engine process has already been killed
-				// so the most appropriate status for these tasks is 'cancelled'
 				task.Status = cancelled
 			}
 		}
-		switch l := len(taskJobs); l {
-		case 0:
-			fmt.Print("no running task jobs to kill")
-		default:
-			fmt.Println("deleting task jobs..")
-			err = deleteJobs(taskJobs, running, jobsClient)
-			if err != nil {
-				fmt.Println("error deleting task jobs: ", err)
-			}
-			fmt.Println("successfully deleted task jobs")
-		}
 		// update logdb with cancelled tasks
 		server.writeLog(runLog, userID, runID)
 	}(runLog, jobsClient)
@@ -381,6 +377,29 @@ func (server *Server) handleRunsPOST(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if workflowRequest.MaxRunDuration != "" {
+		if d, err := time.ParseDuration(workflowRequest.MaxRunDuration); err != nil || d <= 0 {
+			http.Error(w, "invalid maxRunDuration - must be a positive duration, e.g., \"36h\"", 400)
+			return
+		}
+	}
+
+	if err := checkWorkflowImages([]byte(workflowRequest.Workflow)); err != nil {
+		http.Error(w, fmt.Sprintf("image not permitted: %v", err), 400)
+		return
+	}
+
+	// the user needn't list the commons files of the run in the manifest - see manifest.go
+	if err := workflowRequest.deriveManifest(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if err := Config.Storage.checkTaskBackend(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	workflowRequest.UserID = server.userID(r)
 	workflowRequest.JobName = createJobName()
 
@@ -400,8 +419,6 @@ func (server *Server) handleRunsPOST(w http.ResponseWriter, r *http.Request) {
 }
 
 func (server *Server) writeWorkflowRequestToS3(r *WorkflowRequest) error {
-	sess := server.S3FileManager.newS3Session()
-	uploader := s3manager.NewUploader(sess)
 	b, err := json.Marshal(r)
 	if err != nil {
 		return fmt.Errorf("failed to marshal workflow request to json: %v", err)
@@ -414,21 +431,17 @@ func (server *Server) writeWorkflowRequestToS3(r *WorkflowRequest) error {
 
 	key := fmt.Sprintf("/%s/workflowRuns/%s/%s", r.UserID, r.JobName, requestFile)
 
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(server.S3FileManager.S3BucketName),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(b),
-	})
-	if err != nil {
+	if err = server.S3FileManager.Storage.Put(key, bytes.NewReader(b)); err != nil {
 		return fmt.Errorf("upload workflow request to s3 failed: %v", err)
 	}
-	fmt.Println("wrote workflow request to s3 location:", result.Location)
+	fmt.Println("wrote workflow request to storage key:", key)
 	return nil
 }
 
 //// middleware ////
 
 // all endpoints return JSON, so just set that response header here
+// the task logs endpoint returns plain text, and overrides this header
 func (server *Server) setResponseHeader(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
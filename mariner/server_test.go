@@ -0,0 +1,123 @@
+package mariner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// userJWTApp decodes every token to the claims of the given user
+type userJWTApp string
+
+func (app userJWTApp) Decode(string) (*map[string]interface{}, error) {
+	claims := map[string]interface{}{
+		"context": map[string]interface{}{
+			"user": map[string]interface{}{"name": string(app)},
+		},
+	}
+	return &claims, nil
+}
+
+// newTestServer serves the API endpoints offline, on the local storage backend, with the run log of testRunLog()
+// and the stdout of each of its tasks
+func newTestServer(t *testing.T) *httptest.Server {
+	store := newCountingStore(t)
+	if err := writeRunLog(store, testRunLog(), "user", "run", nil); err != nil {
+		t.Fatalf("writeRunLog() error = %v", err)
+	}
+	fm := &S3FileManager{Storage: store}
+	for _, path := range []string{"/engine-workspace/align/stdout", "/engine-workspace/call/0/stdout", "/engine-workspace/call/1/stdout"} {
+		if err := store.Put(fm.s3Key(path, "user"), strings.NewReader("one\ntwo\nthree\n"+path+"\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := server().withS3FileManager(fm).withJWTApp(userJWTApp("user"))
+	ts := httptest.NewServer(server.routes())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func get(t *testing.T, url string) (status int, body string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(authHeader, "Bearer token")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %v error = %v", url, err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(b)
+}
+
+func TestServerRunLog(t *testing.T) {
+	ts := newTestServer(t)
+	status, body := get(t, ts.URL+"/runs/run")
+	if status != 200 {
+		t.Fatalf("status = %v, body = %v", status, body)
+	}
+	j := &RunLogJSON{}
+	if err := json.Unmarshal([]byte(body), j); err != nil {
+		t.Fatalf("failed to unmarshal run log: %v", err)
+	}
+	// the task logs are read back from their own objects
+	call := j.Log.ByProcess["#main/call"]
+	if j.Log.Main.Status != running || j.Log.ByProcess["#main/align"] == nil || call == nil || len(call.Scatter) != 2 {
+		t.Errorf("run log = %+v, want the log of the run with its task logs", j.Log)
+	}
+}
+
+func TestServerRunStatus(t *testing.T) {
+	ts := newTestServer(t)
+	status, body := get(t, ts.URL+"/runs/run/status")
+	j := &StatusJSON{}
+	if err := json.Unmarshal([]byte(body), j); err != nil || status != 200 || j.Status != running {
+		t.Errorf("status = %v, body = %v, want status %v", status, body, running)
+	}
+}
+
+func TestServerTaskLogs(t *testing.T) {
+	ts := newTestServer(t)
+	for _, c := range []struct {
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"align/logs", 200, "one\ntwo\nthree\n/engine-workspace/align/stdout\n"},
+		{"align/logs?tail=2", 200, "three\n/engine-workspace/align/stdout\n"},
+		{"call/logs?scatterIndex=1&tail=1", 200, "/engine-workspace/call/1/stdout\n"},
+		// a scattered task has no log of its own
+		{"call/logs", 400, "specify the scatterIndex"},
+		{"call/logs?scatterIndex=2", 404, "no scattered subtask 2"},
+		{"missing/logs", 404, "no task missing"},
+		{"align/logs?stream=stderr", 404, "no log recorded"},
+		{"align/logs?stream=other", 400, "invalid stream"},
+	} {
+		status, body := get(t, ts.URL+"/runs/run/tasks/"+c.query)
+		if status != c.wantStatus || !strings.Contains(body, c.wantBody) {
+			t.Errorf("%v: got (%v, %q), want (%v, %q)", c.query, status, body, c.wantStatus, c.wantBody)
+		}
+	}
+
+	// a byte range of the log
+	req, _ := http.NewRequest("GET", ts.URL+"/runs/run/tasks/align/logs", nil)
+	req.Header.Set(authHeader, "Bearer token")
+	req.Header.Set("Range", "bytes=0-2")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusPartialContent || string(b) != "one" || !strings.HasPrefix(res.Header.Get("Content-Range"), "bytes 0-2/") {
+		t.Errorf("range: got (%v, %q, %v), want (206, \"one\", bytes 0-2/...)", res.StatusCode, b, res.Header.Get("Content-Range"))
+	}
+}
@@ -0,0 +1,187 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// this file contains code for resolving a tool's SoftwareRequirement to a container image
+// many community tools declare the packages they need (e.g., samtools 1.9) instead of a DockerRequirement
+// so when a tool has no DockerRequirement, its packages get looked up in a configured mapping - e.g., derived from BioContainers
+// see: https://www.commonwl.org/v1.1/CommandLineTool.html#SoftwareRequirement
+//
+// cwl.go doesn't parse SoftwareRequirement, so the packages are read from the raw requirement
+
+// SoftwarePackage is a package listed in a SoftwareRequirement
+type SoftwarePackage struct {
+	Package string
+	Version []string // any of these versions is acceptable - if empty, any version is acceptable
+}
+
+// SoftwareResolver maps packages to container images
+type SoftwareResolver struct {
+	Images map[string]map[string]string // {package: {version: image}}
+}
+
+// resolve returns the image for the given package, or "" if no image is mapped for any acceptable version of it
+// if the package lists no versions, any version is acceptable - the "*" image if mapped, else the image of the latest mapped version
+func (resolver *SoftwareResolver) resolve(pkg SoftwarePackage) string {
+	versions := resolver.Images[pkg.Package]
+	for _, version := range pkg.Version {
+		if image := versions[version]; image != "" {
+			return image
+		}
+	}
+	if image := versions[anyVersion]; image != "" || len(pkg.Version) > 0 {
+		return image
+	}
+	latest := ""
+	for version, image := range versions {
+		if image != "" && (latest == "" || compareVersions(version, latest) > 0) {
+			latest = version
+		}
+	}
+	return versions[latest]
+}
+
+// compareVersions compares two versions, e.g., "1.10" > "1.9" - returns a positive number if a > b, negative if a < b, else 0
+// the parts of a version are separated by "." or "-", and numeric parts are compared as numbers, the others as strings
+// versions which only differ in how their parts are written (e.g., "1.09" and "1.9") get ordered as strings, so the order is total
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' })
+	}
+	pa, pb := split(a), split(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				return na - nb
+			}
+		case errA == nil:
+			// numeric parts are later than the others - e.g., "1.0" > "1.beta"
+			return 1
+		case errB == nil:
+			return -1
+		default:
+			if c := strings.Compare(pa[i], pb[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	// e.g., "1.9.1" > "1.9", but "1.9-beta" < "1.9"
+	switch {
+	case len(pa) > len(pb):
+		if _, err := strconv.Atoi(pa[len(pb)]); err != nil {
+			return -1
+		}
+		return 1
+	case len(pa) < len(pb):
+		if _, err := strconv.Atoi(pb[len(pa)]); err != nil {
+			return 1
+		}
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// the resolver of the engine, loaded once - see softwareResolver()
+var (
+	softwareResolverOnce sync.Once
+	softwareResolverVal  *SoftwareResolver
+	softwareResolverErr  error
+)
+
+// softwareResolver returns the resolver specified in the mariner config, or nil if none is configured
+// the mapping gets loaded the first time it's needed - not once per tool
+func softwareResolver() (*SoftwareResolver, error) {
+	softwareResolverOnce.Do(func() {
+		softwareResolverVal, softwareResolverErr = loadSoftwareResolver(Config.Software.Mapping)
+	})
+	return softwareResolverVal, softwareResolverErr
+}
+
+// loadSoftwareResolver loads the mapping of packages to images from the given json file, or returns nil if no file is given
+func loadSoftwareResolver(mapping string) (*SoftwareResolver, error) {
+	if mapping == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(mapping)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read software mapping: %v", err)
+	}
+	resolver := &SoftwareResolver{}
+	if err = json.Unmarshal(b, &resolver.Images); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal software mapping: %v", err)
+	}
+	return resolver, nil
+}
+
+// softwareImage returns the image resolved from the tool's SoftwareRequirement (or hint), or "" if none
+// the packages are tried in order, and the first one which resolves to an image determines the image
+func (tool *Tool) softwareImage() (string, error) {
+	requirement := tool.Task.requirement(CWLSoftwareRequirement)
+	if requirement == nil {
+		return "", nil
+	}
+	resolver, err := softwareResolver()
+	if err != nil || resolver == nil {
+		return "", err
+	}
+	packages := softwarePackages(requirement.Raw["packages"])
+	for _, pkg := range packages {
+		if image := resolver.resolve(pkg); image != "" {
+			tool.Task.infof("resolved SoftwareRequirement package %v (versions %v) to image %v", pkg.Package, pkg.Version, image)
+			return image, nil
+		}
+		tool.Task.infof("no image found for SoftwareRequirement package %v (versions %v)", pkg.Package, pkg.Version)
+	}
+	return "", nil
+}
+
+// softwarePackages parses the `packages` of a raw SoftwareRequirement
+// which may be given in the CWL either as a list, or as a map keyed by package name
+// the packages of a map are sorted by name, so the same requirement always resolves to the same image
+func softwarePackages(v interface{}) (packages []SoftwarePackage) {
+	switch x := v.(type) {
+	case []interface{}:
+		for _, p := range x {
+			if raw, ok := p.(map[string]interface{}); ok {
+				name, _ := raw["package"].(string)
+				packages = append(packages, SoftwarePackage{Package: name, Version: stringList(raw["version"])})
+			}
+		}
+	case map[string]interface{}:
+		for name, p := range x {
+			pkg := SoftwarePackage{Package: name}
+			if raw, ok := p.(map[string]interface{}); ok {
+				pkg.Version = stringList(raw["version"])
+			}
+			packages = append(packages, pkg)
+		}
+		sort.Slice(packages, func(i, j int) bool { return packages[i].Package < packages[j].Package })
+	}
+	return packages
+}
+
+// returns the strings in a raw value which may be a single string or a list of strings
+func stringList(v interface{}) (list []string) {
+	switch x := v.(type) {
+	case string:
+		list = []string{x}
+	case []interface{}:
+		for _, s := range x {
+			if str, ok := s.(string); ok {
+				list = append(list, str)
+			}
+		}
+	}
+	return list
+}
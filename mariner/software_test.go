@@ -0,0 +1,103 @@
+package mariner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSoftwarePackages(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  interface{}
+		want []SoftwarePackage
+	}{
+		{
+			name: "list",
+			raw: []interface{}{
+				map[string]interface{}{"package": "samtools", "version": []interface{}{"1.9", "1.10"}},
+				map[string]interface{}{"package": "bwa", "version": "0.7.17"},
+				map[string]interface{}{"package": "python"},
+			},
+			want: []SoftwarePackage{
+				{Package: "samtools", Version: []string{"1.9", "1.10"}},
+				{Package: "bwa", Version: []string{"0.7.17"}},
+				{Package: "python"},
+			},
+		},
+		{
+			name: "map, sorted by name",
+			raw: map[string]interface{}{
+				"samtools": map[string]interface{}{"version": []interface{}{"1.9"}},
+				"bwa":      map[string]interface{}{},
+				"picard":   map[string]interface{}{"version": "2.18"},
+				"bcftools": nil,
+			},
+			want: []SoftwarePackage{
+				{Package: "bcftools"},
+				{Package: "bwa"},
+				{Package: "picard", Version: []string{"2.18"}},
+				{Package: "samtools", Version: []string{"1.9"}},
+			},
+		},
+		{name: "neither", raw: "samtools", want: nil},
+	}
+	for _, c := range cases {
+		// the order of a map must not depend on its iteration order
+		for i := 0; i < 10; i++ {
+			if got := softwarePackages(c.raw); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("%v: softwarePackages() = %v, want %v", c.name, got, c.want)
+			}
+		}
+	}
+}
+
+func TestSoftwareResolve(t *testing.T) {
+	resolver := &SoftwareResolver{Images: map[string]map[string]string{
+		"samtools": {"1.9": "samtools:1.9", "1.10": "samtools:1.10", "1.2": "samtools:1.2"},
+		"bwa":      {"0.7.17": "bwa:0.7.17", anyVersion: "bwa:latest"},
+		"picard":   {"2.18.0": "picard:2.18.0", "2.18.0-beta": "picard:2.18.0-beta", "2.9.1": "picard:2.9.1"},
+	}}
+	cases := []struct {
+		pkg  SoftwarePackage
+		want string
+	}{
+		{SoftwarePackage{Package: "samtools", Version: []string{"1.8", "1.9"}}, "samtools:1.9"},
+		{SoftwarePackage{Package: "samtools", Version: []string{"1.8"}}, ""},
+		{SoftwarePackage{Package: "bwa", Version: []string{"0.7.15"}}, "bwa:latest"},
+		{SoftwarePackage{Package: "bwa"}, "bwa:latest"},
+		// no versions listed, and no "*" image - the latest mapped version
+		{SoftwarePackage{Package: "samtools"}, "samtools:1.10"},
+		{SoftwarePackage{Package: "picard"}, "picard:2.18.0"},
+		{SoftwarePackage{Package: "gatk"}, ""},
+	}
+	for _, c := range cases {
+		for i := 0; i < 10; i++ {
+			if got := resolver.resolve(c.pkg); got != c.want {
+				t.Fatalf("resolve(%+v) = %q, want %q", c.pkg, got, c.want)
+			}
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int // sign
+	}{
+		{"1.10", "1.9", 1},
+		{"1.9", "1.10", -1},
+		{"1.9", "1.9", 0},
+		{"2.0", "1.99.1", 1},
+		{"1.9.1", "1.9", 1},
+		{"1.0", "1.beta", 1},
+		{"1.0-rc1", "1.0-rc2", -1},
+		{"1.0-rc1", "1.0", -1},
+		{"1.09", "1.9", -1},
+	}
+	for _, c := range cases {
+		got := compareVersions(c.a, c.b)
+		if (got > 0) != (c.want > 0) || (got < 0) != (c.want < 0) {
+			t.Errorf("compareVersions(%q, %q) = %v, want sign of %v", c.a, c.b, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package mariner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// this file contains code for the status of a task, as reported from within the task pod
+// the handshake in the task pod goes like so:
+// 1. the s3sidecar stages the inputs, then writes run.sh - the task container waits for run.sh (or the sidecar's failure marker)
+// 2. the task container runs run.sh, then writes the exit code and timestamps of the tool to `_mariner_task_exit.json`
+// 3. the s3sidecar waits for that file, uploads the working dir, and writes the task's final status to `_mariner_task_status.json`
+//
+// the engine reads the final status once the task job completes
+// and fails the task if the tool exited with a code other than one of the tool's `successCodes`
+// or if there is no final status with an exit code - e.g., the task container was killed before reporting the tool's exit
+
+// TaskStatus is the status of a task, as written by the s3sidecar
+type TaskStatus struct {
+	Phase            string     `json:"phase"` // "staging", "running", "uploading", "completed" or "failed"
+	ExitCode         *int       `json:"exitCode,omitempty"`
+	TimedOut         bool       `json:"timedOut,omitempty"` // the tool was killed for exceeding its ToolTimeLimit
+	StagingStartedAt *time.Time `json:"stagingStartedAt,omitempty"`
+	StartedAt        *time.Time `json:"startedAt,omitempty"`  // when the tool started
+	FinishedAt       *time.Time `json:"finishedAt,omitempty"` // when the tool finished
+	UploadedAt       *time.Time `json:"uploadedAt,omitempty"` // when the outputs finished uploading
+	Error            string     `json:"error,omitempty"`
+}
+
+// checkTaskStatus loads the final status of the task, once its job has completed
+// and returns an error if the tool exited with a code which is not one of its success codes
+// a missing or invalid status, or one without an exit code, means the handshake in the task pod broke - so the task fails
+func (engine *K8sEngine) checkTaskStatus(tool *Tool) error {
+	f := fileObject(tool.WorkingDir + taskStatusFile)
+	if err := engine.loadContents(f); err != nil {
+		return tool.statusFailure("failed to load task status: %v", err)
+	}
+	status := &TaskStatus{}
+	if err := json.Unmarshal([]byte(f.Contents), status); err != nil {
+		return tool.statusFailure("failed to unmarshal task status: %v", err)
+	}
+	tool.Task.Log.TaskStatus = status
+	tool.Task.infof("task status: phase %v, exit code %v, started %v, finished %v", status.Phase, intValue(status.ExitCode), status.StartedAt, status.FinishedAt)
+	if status.ExitCode == nil {
+		return tool.statusFailure("task status in phase %v has no exit code", status.Phase)
+	}
+	if status.TimedOut {
+		tool.Failure = &TaskFailure{
+			Reason:  toolTimedOut,
+			Message: fmt.Sprintf("tool exceeded its time limit of %vs - exit code %v", tool.TimeLimit, *status.ExitCode),
+		}
+		return tool.Failure
+	}
+	for _, code := range tool.successCodes() {
+		if *status.ExitCode == code {
+			return nil
+		}
+	}
+	tool.Failure = &TaskFailure{
+		Reason:  toolFailed,
+		Message: fmt.Sprintf("tool exited with code %v, which is not a success code %v", *status.ExitCode, tool.successCodes()),
+	}
+	return tool.Failure
+}
+
+// statusFailure fails the task due to a task status which is missing or invalid
+func (tool *Tool) statusFailure(format string, a ...interface{}) error {
+	tool.Failure = &TaskFailure{Reason: invalidTaskStatus, Message: fmt.Sprintf(format, a...)}
+	tool.Task.warnf("%v", tool.Failure)
+	return tool.Failure
+}
+
+// successCodes returns the exit codes of the tool which indicate success - per the CWL spec, zero if not specified
+func (tool *Tool) successCodes() (codes []int) {
+	raw, _ := tool.Task.raw()["successCodes"].([]interface{})
+	for _, v := range raw {
+		if code, ok := v.(float64); ok {
+			codes = append(codes, int(code))
+		}
+	}
+	if len(codes) == 0 {
+		codes = []int{0}
+	}
+	return codes
+}
+
+// for logging
+func intValue(i *int) string {
+	if i == nil {
+		return "unknown"
+	}
+	return strconv.Itoa(*i)
+}
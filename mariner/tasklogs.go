@@ -0,0 +1,283 @@
+package mariner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains code for serving the stdout and stderr of a task
+// the task container tees the tool's stdout and stderr to files in the task working dir - see taskLogs()
+// those files get uploaded with the working dir, and the task log records where they are
+//
+// '/runs/{runID}/tasks/{taskID}/logs' - GET
+// the taskID is the step name - i.e., the last element of the task's ID in the run log - e.g., "step" for "#main/step"
+// query params:
+// - stream: "stdout" (default) or "stderr"
+// - scatterIndex: for a scattered task, the index of the scattered subtask
+// - tail: return only the last N lines
+// a single-range `Range` header (e.g., "bytes=0-1023" or "bytes=-1024") returns that range of the log, as a 206 with the `Content-Range` header set
+
+const (
+	stdoutStream = "stdout"
+	stderrStream = "stderr"
+
+	// size of the chunks read from the end of a log file, to find its last N lines
+	tailChunkSize = 64 * 1024
+)
+
+// '/runs/{runID}/tasks/{taskID}/logs' - GET
+func (server *Server) handleTaskLogsGET(w http.ResponseWriter, r *http.Request) {
+	userID, runID := server.uniqueKey(r)
+	// only the index - the log of the one task gets read from it
+	runLog, err := server.fetchRunLogIndex(userID, runID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch log of run %v: %v", runID, err), 404)
+		return
+	}
+	taskLog, status, err := taskLog(server.S3FileManager.Storage, runLog, mux.Vars(r)["taskID"], r.URL.Query().Get("scatterIndex"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	stream := r.URL.Query().Get("stream")
+	var path string
+	switch stream {
+	case "", stdoutStream:
+		path = taskLog.Logs.Stdout
+	case stderrStream:
+		path = taskLog.Logs.Stderr
+	default:
+		http.Error(w, fmt.Sprintf("invalid stream %v - must be %v or %v", stream, stdoutStream, stderrStream), 400)
+		return
+	}
+	if path == "" {
+		http.Error(w, "no log recorded for this task", 404)
+		return
+	}
+	key := server.S3FileManager.s3Key(path, userID)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if tail := r.URL.Query().Get("tail"); tail != "" {
+		n, err := strconv.Atoi(tail)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid tail %v - must be a non-negative number of lines", tail), 400)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			http.Error(w, "tail and Range can't both be specified", 400)
+			return
+		}
+		b, err := server.tailObject(key, n)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read log: %v", err), storageErrorStatus(err))
+			return
+		}
+		w.Write(b)
+		return
+	}
+	server.writeObject(w, key, r.Header.Get("Range"))
+}
+
+// taskLog returns the log of the given task (or scattered subtask) of the run
+// along with the http status to respond with, if there's an error
+// the run log is its index - see fetchRunLogIndex() - so only the log object of that one task (or subtask) gets read
+// a log written before task logs were stored as their own objects has no index, and holds all the task logs
+func taskLog(store storage.Storage, runLog *MainLog, taskID, scatterIndex string) (*Log, int, error) {
+	indexed := len(runLog.Tasks) > 0
+	var matches []string
+	match := func(id string) {
+		if id == taskID || lastInPath(id) == taskID {
+			matches = append(matches, id)
+		}
+	}
+	if indexed {
+		for id := range runLog.Tasks {
+			match(id)
+		}
+	} else {
+		for id := range runLog.ByProcess {
+			match(id)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, 404, fmt.Errorf("no task %v in this run", taskID)
+	case len(matches) > 1:
+		sort.Strings(matches)
+		return nil, 400, fmt.Errorf("task %v is ambiguous - could be any of %v", taskID, matches)
+	}
+
+	var i int
+	if scatterIndex != "" {
+		var err error
+		if i, err = strconv.Atoi(scatterIndex); err != nil {
+			return nil, 400, fmt.Errorf("invalid scatterIndex %v", scatterIndex)
+		}
+	}
+	var log *Log
+	if indexed {
+		ref := runLog.Tasks[matches[0]]
+		if scatterIndex != "" {
+			if ref = ref.Scatter[i]; ref == nil {
+				return nil, 404, fmt.Errorf("no scattered subtask %v of task %v", i, taskID)
+			}
+		} else if len(ref.Scatter) > 0 {
+			return nil, 400, fmt.Errorf("task %v is scattered - specify the scatterIndex of a subtask", taskID)
+		}
+		b, err := storage.ReadAll(store, ref.Key)
+		if err != nil {
+			return nil, storageErrorStatus(err), fmt.Errorf("failed to fetch log of task %v: %v", taskID, err)
+		}
+		log = &Log{}
+		if err = json.Unmarshal(b, log); err != nil {
+			return nil, 500, fmt.Errorf("failed to unmarshal log of task %v: %v", taskID, err)
+		}
+	} else {
+		log = runLog.ByProcess[matches[0]]
+		if scatterIndex != "" {
+			if log = log.Scatter[i]; log == nil {
+				return nil, 404, fmt.Errorf("no scattered subtask %v of task %v", i, taskID)
+			}
+		} else if len(log.Scatter) > 0 {
+			return nil, 400, fmt.Errorf("task %v is scattered - specify the scatterIndex of a subtask", taskID)
+		}
+	}
+
+	if log.Logs == nil {
+		return nil, 404, fmt.Errorf("no logs recorded for task %v", taskID)
+	}
+	return log, 0, nil
+}
+
+// writeObject writes the given object (or the given byte range of it) to the response
+func (server *Server) writeObject(w http.ResponseWriter, key, byteRange string) {
+	obj, err := server.S3FileManager.Storage.Stat(key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read log: %v", err), storageErrorStatus(err))
+		return
+	}
+	offset, length, ok := parseRange(byteRange, obj.Size)
+	switch {
+	case byteRange == "":
+	case !ok:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%v", obj.Size))
+		http.Error(w, fmt.Sprintf("invalid or unsatisfiable range %v", byteRange), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	body, err := server.S3FileManager.Storage.GetRange(key, offset, length)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read log: %v", err), storageErrorStatus(err))
+		return
+	}
+	defer body.Close()
+	if byteRange != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", offset, offset+length-1, obj.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if _, err = io.Copy(w, body); err != nil {
+		fmt.Println("error writing log: ", err)
+	}
+}
+
+// parseRange returns the offset and length of the given single byte range of an object of the given size
+// i.e., "bytes=a-b", "bytes=a-" or the suffix range "bytes=-n" - with ok false if the range is invalid or unsatisfiable
+// an empty range is the whole object
+func parseRange(byteRange string, size int64) (offset int64, length int64, ok bool) {
+	if byteRange == "" {
+		return 0, -1, true
+	}
+	spec := strings.TrimPrefix(byteRange, "bytes=")
+	dash := strings.Index(spec, "-")
+	if spec == byteRange || dash < 0 || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// tailObject returns the last n lines of the given object
+// the object is read backwards in chunks, until the chunks read contain n lines
+func (server *Server) tailObject(key string, n int) ([]byte, error) {
+	obj, err := server.S3FileManager.Storage.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	for end := obj.Size; end > 0; {
+		start := end - tailChunkSize
+		if start < 0 {
+			start = 0
+		}
+		body, err := server.S3FileManager.Storage.GetRange(key, start, end-start)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		b = append(chunk, b...)
+		end = start
+		// the trailing newline of the last line doesn't count
+		if bytes.Count(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")) >= n {
+			break
+		}
+	}
+	return lastLines(b, n), nil
+}
+
+// lastLines returns the last n lines of b
+func lastLines(b []byte, n int) []byte {
+	if n == 0 {
+		return nil
+	}
+	i := len(bytes.TrimSuffix(b, []byte("\n")))
+	for ; n > 0 && i >= 0; n-- {
+		i = bytes.LastIndexByte(b[:i], '\n')
+	}
+	return b[i+1:]
+}
+
+// storageErrorStatus returns the http status to respond with for the given error from storage
+func storageErrorStatus(err error) int {
+	if storage.IsNotFound(err) {
+		return 404
+	}
+	return 500
+}
@@ -0,0 +1,113 @@
+package mariner
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLastLines(t *testing.T) {
+	cases := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"a\nb\nc\n", 0, ""},
+		{"a\nb\nc\n", 1, "c\n"},
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc\n", 3, "a\nb\nc\n"},
+		// no trailing newline
+		{"a\nb\nc", 1, "c"},
+		{"a\nb\nc", 2, "b\nc"},
+		// fewer lines than n
+		{"a\nb\n", 5, "a\nb\n"},
+		{"a", 5, "a"},
+		{"", 1, ""},
+		// empty lines count
+		{"a\n\n\n", 2, "\n\n"},
+	}
+	for _, c := range cases {
+		if got := string(lastLines([]byte(c.in), c.n)); got != c.want {
+			t.Errorf("lastLines(%q, %v) = %q, want %q", c.in, c.n, got, c.want)
+		}
+	}
+}
+
+func TestTailObject(t *testing.T) {
+	store := newCountingStore(t)
+	server := server().withS3FileManager(&S3FileManager{Storage: store})
+
+	// lines of 1000 bytes - so the chunk boundaries fall mid-line
+	var lines []string
+	for i := 0; i < 3*tailChunkSize/1000; i++ {
+		lines = append(lines, fmt.Sprintf("%04d", i)+strings.Repeat("x", 995))
+	}
+	log := strings.Join(lines, "\n")
+	for _, trailing := range []string{"\n", ""} {
+		if err := store.Put("log", strings.NewReader(log+trailing)); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{0, 1, tailChunkSize / 1000, tailChunkSize/1000 + 1, 2 * tailChunkSize / 1000, len(lines), len(lines) + 10} {
+			b, err := server.tailObject("log", n)
+			if err != nil {
+				t.Fatalf("tailObject(%v) error = %v", n, err)
+			}
+			want := ""
+			if n > 0 {
+				from := len(lines) - n
+				if from < 0 {
+					from = 0
+				}
+				want = strings.Join(lines[from:], "\n") + trailing
+			}
+			if string(b) != want {
+				t.Errorf("tailObject(%v), trailing newline %q: got %v lines, want %v", n, trailing, strings.Count(string(b), "\n"), strings.Count(want, "\n"))
+			}
+		}
+	}
+}
+
+func TestTaskLog(t *testing.T) {
+	// the same step name in the main workflow and in a subworkflow
+	ambiguous := testRunLog()
+	ambiguous.ByProcess["#sub/align"] = &Log{Status: completed, Logs: &TaskLogs{Stdout: "/engine-workspace/sub/align/stdout"}}
+
+	store := newCountingStore(t)
+	if err := writeRunLog(store, ambiguous, "user", "run", nil); err != nil {
+		t.Fatalf("writeRunLog() error = %v", err)
+	}
+	index := fetchIndex(t, store, "user", "run")
+	// a log written before task logs were stored as their own objects - the task logs are in the run log itself
+	old := testRunLog()
+	old.ByProcess["#sub/align"] = ambiguous.ByProcess["#sub/align"]
+
+	cases := []struct {
+		taskID, scatterIndex string
+		wantStatus           int
+		wantStdout           string
+	}{
+		{"align", "", 400, ""},
+		{"#main/align", "", 0, "/engine-workspace/align/stdout"},
+		{"#sub/align", "", 0, "/engine-workspace/sub/align/stdout"},
+		{"call", "", 400, ""},
+		{"call", "0", 0, "/engine-workspace/call/0/stdout"},
+		{"call", "1", 0, "/engine-workspace/call/1/stdout"},
+		{"call", "2", 404, ""},
+		{"call", "one", 400, ""},
+		{"missing", "", 404, ""},
+	}
+	for name, runLog := range map[string]*MainLog{"index": index, "old": old} {
+		for _, c := range cases {
+			log, status, err := taskLog(store, runLog, c.taskID, c.scatterIndex)
+			if c.wantStatus != 0 {
+				if err == nil || status != c.wantStatus {
+					t.Errorf("%v: taskLog(%v, %q) = %v, %v, want status %v", name, c.taskID, c.scatterIndex, status, err, c.wantStatus)
+				}
+				continue
+			}
+			if err != nil || log.Logs.Stdout != c.wantStdout {
+				t.Errorf("%v: taskLog(%v, %q) = %+v, %v, want stdout %v", name, c.taskID, c.scatterIndex, log, err, c.wantStdout)
+			}
+		}
+	}
+}
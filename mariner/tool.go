@@ -8,8 +8,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,7 +18,7 @@ func isValidPath(path string) bool {
 			return true
 		}
 	}
-	return false
+	return isRemoteURL(path)
 }
 
 // this file contains some methods/functions for setting up and working with Tools (i.e., commandlinetools and expressiontools)
@@ -36,17 +34,25 @@ func pathHelper(path string, tool *Tool) (err error) {
 		path = strings.Join([]string{"/", engineWorkspaceVolumeName, "/", trimmedPath}, "")
 	} else if strings.HasPrefix(path, commonsPrefix) {
 		guid := pathLib.Base(path)
-		indexFile, err := getIndexedFileInfo(guid)
+		record, err := resolveCommonsFile(guid)
 		if err != nil {
 			return tool.Task.errorf("Unable to get indexed record: %v; error: %v", guid, err)
 		}
-		path = pathLib.Join(pathToCommonsData, indexFile.Filename)
-		url = indexFile.URLs[0]
+		path = pathLib.Join(pathToCommonsData, record.Filename)
+		url = record.url()
+	} else if isRemoteURL(path) {
+		if path, err = stageRemoteFile([]*AccessURL{{URL: path}}); err != nil {
+			return tool.Task.errorf("%v", err)
+		}
+		url = remoteURL(path)
+	} else {
+		url = remoteURL(path)
 	}
 
 	tool.Task.infof("adding initwkdir path: %v", path)
 	tool.S3Input = append(tool.S3Input, &ToolS3Input{
 		URL:         url,
+		Sources:     remoteSources(path),
 		Path:        path,
 		InitWorkDir: true,
 	})
@@ -61,171 +67,161 @@ func pathHelper(path string, tool *Tool) (err error) {
 func (engine *K8sEngine) initWorkDirReq(tool *Tool) (err error) {
 	tool.Task.infof("begin handle InitialWorkDirRequirement")
 	var resFile interface{}
-	for _, requirement := range tool.Task.Root.Requirements {
-		if requirement.Class == CWLInitialWorkDirRequirement {
-			for _, listing := range requirement.Listing {
-				// handling the case where `entry` is content (expression or string) to be written to a file
-				// and `entryname` is the name of the file to be created
-				var contents interface{}
-				// `entry` is an expression which may return a string, File or `dirent`
-				// NOTE: presently NOT supporting the File or dirent case
-				// what's a dirent? good question: https://www.commonwl.org/v1.0/CommandLineTool.html#Dirent
-				tool.Task.infof("listing: %+v", listing)
-
-				// logic: exactly one of resultString or resultFile should be returned
-				if len(listing.Entry) == 0 {
-					// Here we have the case for an expression/string and not a dirent
-					tool.Task.infof("listing entry len 0: %v", listing.Entry)
-					tool.Task.infof("listing Location: %v", listing.Location)
-					tool.Task.infof("listing Location type: %T", listing.Location)
-					tool.Task.infof("s3input paths: %v", tool.S3Input)
-					if strings.HasPrefix(listing.Location, "$(") {
-						tool.Task.infof("listing Location has JS expression: %v", listing.Location)
-						output, err := tool.evalExpression(listing.Location)
-						if err != nil {
-							log.Errorf("failed to evaluate expression: %v; error: %v", listing.Location, err)
-							return tool.Task.errorf("failed to evaluate expression: %v; error: %v", listing.Location, err)
+	if requirement := tool.Task.requirement(CWLInitialWorkDirRequirement); requirement != nil {
+		for _, listing := range requirement.Listing {
+			// handling the case where `entry` is content (expression or string) to be written to a file
+			// and `entryname` is the name of the file to be created
+			var contents interface{}
+			// `entry` is an expression which may return a string, File or `dirent`
+			// NOTE: presently NOT supporting the File or dirent case
+			// what's a dirent? good question: https://www.commonwl.org/v1.0/CommandLineTool.html#Dirent
+			tool.Task.infof("listing: %+v", listing)
+
+			// logic: exactly one of resultString or resultFile should be returned
+			if len(listing.Entry) == 0 {
+				// Here we have the case for an expression/string and not a dirent
+				tool.Task.infof("listing entry len 0: %v", listing.Entry)
+				tool.Task.infof("listing Location: %v", listing.Location)
+				tool.Task.infof("listing Location type: %T", listing.Location)
+				tool.Task.infof("s3input paths: %v", tool.S3Input)
+				if strings.HasPrefix(listing.Location, "$(") {
+					tool.Task.infof("listing Location has JS expression: %v", listing.Location)
+					output, err := tool.evalExpression(listing.Location)
+					if err != nil {
+						log.Errorf("failed to evaluate expression: %v; error: %v", listing.Location, err)
+						return tool.Task.errorf("failed to evaluate expression: %v; error: %v", listing.Location, err)
+					}
+					switch x := output.(type) {
+					case []map[string]interface{}:
+						files := output.([]map[string]interface{})
+						for _, f := range files {
+							path, err := filePath(f)
+							if err != nil {
+								return tool.Task.errorf("failed to extract path from file: %v", f)
+							}
+
+							err = pathHelper(path, tool)
+							if err != nil {
+								return err
+							}
+							tool.Task.infof("[]map[string]interface{} - Path: %v", path)
 						}
-						switch x := output.(type) {
-						case []map[string]interface{}:
-							files := output.([]map[string]interface{})
-							for _, f := range files {
-								path, err := filePath(f)
+					case []interface{}:
+						// TODO: this probably needs to be a more recursive type processing for all the different possible types
+						tool.Task.infof("[]interface{} - HERE: %v", output)
+						for _, v := range x {
+							tool.Task.infof("item: %v; type: %T", v, v)
+							switch v.(type) {
+							case map[string]interface{}:
+								path, err := filePath(v)
 								if err != nil {
-									return tool.Task.errorf("failed to extract path from file: %v", f)
+									return tool.Task.errorf("failed to extract path from file: %v", v)
 								}
-
+								tool.Task.infof("map[string]interface{} - Path: %v", path)
 								err = pathHelper(path, tool)
 								if err != nil {
 									return err
 								}
-								tool.Task.infof("[]map[string]interface{} - Path: %v", path)
-							}
-						case []interface{}:
-							// TODO: this probably needs to be a more recursive type processing for all the different possible types
-							tool.Task.infof("[]interface{} - HERE: %v", output)
-							for _, v := range x {
-								tool.Task.infof("item: %v; type: %T", v, v)
-								switch v.(type) {
-								case map[string]interface{}:
-									path, err := filePath(v)
-									if err != nil {
-										return tool.Task.errorf("failed to extract path from file: %v", v)
-									}
-									tool.Task.infof("map[string]interface{} - Path: %v", path)
+							case *File:
+								if p, ok := v.(*File); ok {
+									path := p.Path
 									err = pathHelper(path, tool)
 									if err != nil {
-										return err
-									}
-								case *File:
-									if p, ok := v.(*File); ok {
-										path := p.Path
-										err = pathHelper(path, tool)
-										if err != nil {
-											return nil
-										}
-									} else {
-										tool.Task.infof("failed to extract path from file: %v", v)
-										return tool.Task.errorf("failed to extract path from file: %v", v)
+										return nil
 									}
-								default:
-									log.Errorf("unsupported initwkdir type: %T; value: %v", v, v)
-									return tool.Task.errorf("unsupported initwkdir type: %T; value: %v", v, v)
+								} else {
+									tool.Task.infof("failed to extract path from file: %v", v)
+									return tool.Task.errorf("failed to extract path from file: %v", v)
 								}
+							default:
+								log.Errorf("unsupported initwkdir type: %T; value: %v", v, v)
+								return tool.Task.errorf("unsupported initwkdir type: %T; value: %v", v, v)
 							}
-						default:
-							log.Errorf("unsupported initwkdir type: %T; value: %v", output, output)
-							return tool.Task.errorf("unsupported initwkdir type: %T; value: %v", output, output)
 						}
+					default:
+						log.Errorf("unsupported initwkdir type: %T; value: %v", output, output)
+						return tool.Task.errorf("unsupported initwkdir type: %T; value: %v", output, output)
 					}
-					tool.Task.infof("s3input paths: %v", tool.S3Input)
-					continue
 				}
+				tool.Task.infof("s3input paths: %v", tool.S3Input)
+				continue
+			}
 
-				resultText, resultFile, err := tool.resolveExpressions(listing.Entry)
-				switch {
-				case err != nil:
-					log.Errorf("failed to resolve expressions in entry: %v; error: %v", listing.Entry, err)
-					return tool.Task.errorf("failed to resolve expressions in entry: %v; error: %v", listing.Entry, err)
-				case resultFile != nil:
-					contents = resultFile
-				case resultText != "":
-					contents = resultText
-				default:
-					log.Errorf("entry returned empty value: %v", listing.Entry)
-					return tool.Task.errorf("entry returned empty value: %v", listing.Entry)
-				}
+			resultText, resultFile, err := tool.resolveExpressions(listing.Entry)
+			switch {
+			case err != nil:
+				log.Errorf("failed to resolve expressions in entry: %v; error: %v", listing.Entry, err)
+				return tool.Task.errorf("failed to resolve expressions in entry: %v; error: %v", listing.Entry, err)
+			case resultFile != nil:
+				contents = resultFile
+			case resultText != "":
+				contents = resultText
+			default:
+				log.Errorf("entry returned empty value: %v", listing.Entry)
+				return tool.Task.errorf("entry returned empty value: %v", listing.Entry)
+			}
 
-				// `entryName` for sure is a string literal or an expression which evaluates to a string
-				// `entryName` is the name of the file to be created
-				entryName, _, err := tool.resolveExpressions(listing.EntryName)
-				if err != nil {
-					log.Errorf("failed to resolve expressions in entry name: %v; error: %v", listing.EntryName, err)
-					return tool.Task.errorf("failed to resolve expressions in entry name: %v; error: %v", listing.EntryName, err)
-				}
+			// `entryName` for sure is a string literal or an expression which evaluates to a string
+			// `entryName` is the name of the file to be created
+			entryName, _, err := tool.resolveExpressions(listing.EntryName)
+			if err != nil {
+				log.Errorf("failed to resolve expressions in entry name: %v; error: %v", listing.EntryName, err)
+				return tool.Task.errorf("failed to resolve expressions in entry name: %v; error: %v", listing.EntryName, err)
+			}
 
-				/*
-					NOTE: I think we DO support the file case - though maybe not the dirent case
-						Cases:
-						1. `entry` returned a file object - file object stored as an interface{} in `resFile` (NOT SUPPORTED)
-						2. `entry` did not return a file object - then returned value is in `contents` and must be written to a new file with filename stored in `entryName` (supported)
-				*/
-
-				// pretty sure this conditional is dated/unnecessary
-				tool.Task.infof("resFile: %v", resFile)
-				if resFile != nil {
-					// "If the value is an expression that evaluates to a File object,
-					// this indicates the referenced file should be added to the designated output directory prior to executing the tool."
-					// NOTE: the "designated output directory" is just the directory corresponding to the Tool
-					// not sure what the purpose/meaning/use of this feature is - pretty sure all i/o for Tools gets handled already
-					// presently not supporting this case - will implement this feature once I find an example to work with
-					log.Errorf("feature not supported: entry expression returned a file object")
-					tool.Task.errorf("feature not supported: entry expression returned a file object")
-				} else {
-
-					// #no-fuse
-
-					sess := engine.S3FileManager.newS3Session()
-					uploader := s3manager.NewUploader(sess)
-
-					// Q: what about the case of creating directories?
-					// guess: this is probably not currently supported
-					key := strings.TrimPrefix(engine.localPathToS3Key(entryName), "/")
-					tool.Task.infof("raw key: %v", key)
-					tool.Task.infof("tool workdir: %v", tool.WorkingDir)
-
-					var b []byte
-					switch contents.(type) {
-					case string:
-						b = []byte(contents.(string))
-					case *File:
-						b, err = json.Marshal(contents)
-						if err != nil {
-							log.Errorf("error marshalling contents to file: %v", err)
-							return tool.Task.errorf("error marshalling contents to file: %v", err)
-						}
+			/*
+				NOTE: I think we DO support the file case - though maybe not the dirent case
+					Cases:
+					1. `entry` returned a file object - file object stored as an interface{} in `resFile` (NOT SUPPORTED)
+					2. `entry` did not return a file object - then returned value is in `contents` and must be written to a new file with filename stored in `entryName` (supported)
+			*/
+
+			// pretty sure this conditional is dated/unnecessary
+			tool.Task.infof("resFile: %v", resFile)
+			if resFile != nil {
+				// "If the value is an expression that evaluates to a File object,
+				// this indicates the referenced file should be added to the designated output directory prior to executing the tool."
+				// NOTE: the "designated output directory" is just the directory corresponding to the Tool
+				// not sure what the purpose/meaning/use of this feature is - pretty sure all i/o for Tools gets handled already
+				// presently not supporting this case - will implement this feature once I find an example to work with
+				log.Errorf("feature not supported: entry expression returned a file object")
+				tool.Task.errorf("feature not supported: entry expression returned a file object")
+			} else {
+
+				// #no-fuse
+
+				// Q: what about the case of creating directories?
+				// guess: this is probably not currently supported
+				key := strings.TrimPrefix(engine.localPathToS3Key(entryName), "/")
+				tool.Task.infof("raw key: %v", key)
+				tool.Task.infof("tool workdir: %v", tool.WorkingDir)
+
+				var b []byte
+				switch contents.(type) {
+				case string:
+					b = []byte(contents.(string))
+				case *File:
+					b, err = json.Marshal(contents)
+					if err != nil {
+						log.Errorf("error marshalling contents to file: %v", err)
+						return tool.Task.errorf("error marshalling contents to file: %v", err)
 					}
+				}
 
-					workDirPath := engine.S3FileManager.s3Key(tool.WorkingDir, engine.UserID)
-					key = filepath.Join(workDirPath, key)
-
-					_, err := uploader.Upload(&s3manager.UploadInput{
-						Bucket: aws.String(engine.S3FileManager.S3BucketName),
-						Key:    aws.String(key),
-						Body:   bytes.NewReader(b),
-					})
+				workDirPath := engine.S3FileManager.s3Key(tool.WorkingDir, engine.UserID)
+				key = filepath.Join(workDirPath, key)
 
-					if err != nil {
-						log.Errorf("upload to s3 failed: %v", err)
-						return fmt.Errorf("upload to s3 failed: %v", err)
-					}
-					log.Infof("init working directory request recieved")
-					tool.S3Input = append(tool.S3Input, &ToolS3Input{
-						URL:         "s3://" + filepath.Join(engine.S3FileManager.S3BucketName, key),
-						Path:        filepath.Join(tool.WorkingDir, entryName),
-						InitWorkDir: true,
-					})
+				err := engine.S3FileManager.Storage.Put(key, bytes.NewReader(b))
+				if err != nil {
+					log.Errorf("upload to s3 failed: %v", err)
+					return fmt.Errorf("upload to s3 failed: %v", err)
 				}
+				log.Infof("init working directory request recieved")
+				tool.S3Input = append(tool.S3Input, &ToolS3Input{
+					URL:         "s3://" + filepath.Join(engine.S3FileManager.S3BucketName, key),
+					Path:        filepath.Join(tool.WorkingDir, entryName),
+					InitWorkDir: true,
+				})
 			}
 		}
 	}
@@ -42,6 +42,8 @@ type Task struct {
 	sync.RWMutex  `json:"-"`
 	Parameters    cwl.Parameters         // input parameters of this task
 	Root          *cwl.Root              // "root" of the "namespace" of the cwl file for this task
+	Document      *Document              // raw packed cwl document which this task belongs to - for fields not parsed by cwl.go
+	Requirements  Requirements           // resolved requirements and hints which apply to this task - see requirements.go
 	Outputs       map[string]interface{} // output parameters of this task
 	Scatter       []string               // if task is a step in a workflow and requires scatter; input parameters to scatter are stored here
 	ScatterMethod string                 // if task is step in a workflow and requires scatter; scatter method specified - "dotproduct" or "flatcrossproduct" or ""
@@ -57,6 +59,15 @@ type Task struct {
 	CleanupByStep *CleanupByStep // if task is a workflow; info for deleting intermediate files after they are no longer needed
 }
 
+// stepID returns the ID of this task's step in its parent workflow
+// or the ID of its process if it is the top level process
+func (task *Task) stepID() string {
+	if task.OriginalStep != nil {
+		return task.OriginalStep.ID
+	}
+	return task.Root.ID
+}
+
 // fileParam returns a bool indicating whether the given step-level input param corresponds to a set of files
 // 'task' here is a workflow
 func (task *Task) stepParamIsFile(step *cwl.Step, stepParam string) bool {
@@ -106,6 +117,16 @@ func outputParamFile(output cwl.Output) bool {
 	return false
 }
 
+// outputItemType returns the type of the output param - or for an array, the type of its items
+// e.g., "Directory" for both Directory and Directory[]
+func outputItemType(output *cwl.Output) string {
+	t := output.Types[0]
+	if t.Type == "array" && len(t.Items) > 0 {
+		return t.Items[0].Type
+	}
+	return t.Type
+}
+
 // recursively populates `mainTask` (the task object for the top level workflow with all downstream task objects)
 // see note describing the Task type for explanation of nested structure of Task
 // basically, if task is a workflow, the task objects for the workflow steps get stored in the Task.Children field
@@ -132,12 +153,14 @@ func (engine *K8sEngine) resolveGraph(rootMap map[string]*cwl.Root, curTask *Tas
 
 			newTask := &Task{
 				Root:         stepRoot,
+				Document:     curTask.Document,
 				Parameters:   make(cwl.Parameters),
 				OriginalStep: &curTask.Root.Steps[i],
 				Log:          logger(),
 				Done:         &falseVal,
 			}
 			engine.Log.ByProcess[step.ID] = newTask.Log
+			newTask.resolveRequirements(curTask)
 
 			engine.resolveGraph(rootMap, newTask)
 
@@ -162,8 +185,18 @@ func (engine *K8sEngine) runWorkflow() error {
 	// with task objects for all the other nodes in the workflow graph
 	var mainTask *Task
 
+	// keep the raw packed workflow for fields which cwl.go doesn't parse
+	doc, err := document(engine.Log.Request.Workflow)
+	if err != nil {
+		return engine.errorf("%v", err)
+	}
+
 	// unmarshal the packed workflow JSON from the request body
-	if err = json.Unmarshal(engine.Log.Request.Workflow, &root); err != nil {
+	workflow, err := sanitize(engine.Log.Request.Workflow)
+	if err != nil {
+		return engine.errorf("%v", err)
+	}
+	if err = json.Unmarshal(workflow, &root); err != nil {
 		return engine.errorf("failed to unmarshal workflow JSON: %v", err)
 	}
 
@@ -193,6 +226,7 @@ func (engine *K8sEngine) runWorkflow() error {
 			// construct `mainTask` - the task object for the top level workflow
 			mainTask = &Task{
 				Root:       process,
+				Document:   doc,
 				Parameters: params,
 				Log:        logger(), // initialize empty Log object with status NOT_STARTED
 				Done:       &falseVal,
@@ -204,7 +238,10 @@ func (engine *K8sEngine) runWorkflow() error {
 	}
 
 	// fixme: refactor
+	engine.Log.Lock()
 	engine.Log.Main = mainTask.Log
+	engine.Log.Unlock()
+	mainTask.resolveRequirements(nil)
 
 	mainTask.Log.JobName = engine.Log.Request.JobName
 	_, jobsClient, _, _, err := k8sClient(k8sJobAPI)
@@ -224,7 +261,7 @@ func (engine *K8sEngine) runWorkflow() error {
 	}
 
 	engine.infof("end run workflow")
-	engine.writeLogToS3()
+	engine.flushLog()
 	return nil
 }
 
@@ -253,7 +290,19 @@ func (engine *K8sEngine) run(task *Task) (err error) {
 		}
 	default:
 		// this is a leaf in the graph
-		engine.dispatchTask(task)
+		if err = engine.dispatchTask(task); err != nil {
+			// a failed task fails the whole run
+			switch {
+			case engine.stopping():
+				// the run already stopped - so the task got cancelled, or never dispatched
+				task.Log.Status = cancelled
+			case task.Log.Status != timedOut:
+				task.Log.Status = failed
+			}
+			engine.finishTask(task)
+			engine.fail(fmt.Errorf("task %v failed: %v", task.Root.ID, err))
+			return engine.errorf("failed to run task: %v; error: %v", task.Root.ID, err)
+		}
 	}
 	engine.finishTask(task)
 	engine.infof("end run task: %v", task.Root.ID)
@@ -405,8 +454,9 @@ func (engine *K8sEngine) runSteps(task *Task) {
 	for curStepID, subtask := range task.Children {
 		wg.Add(1)
 		go func(curStepID string, task *Task, subtask *Task, wg *sync.WaitGroup) {
+			defer wg.Done()
+			defer engine.recoverTask(subtask)
 			engine.runStep(curStepID, task, subtask)
-			wg.Done()
 		}(curStepID, task, subtask, &wg)
 	}
 	wg.Wait()
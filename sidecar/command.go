@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TaskCommand is the command for the task container, as given by the engine
+type TaskCommand struct {
+	Args   []string          `json:"args"`
+	Env    map[string]string `json:"env,omitempty"`
+	Stdin  string            `json:"stdin,omitempty"`
+	Stdout string            `json:"stdout,omitempty"`
+	Stderr string            `json:"stderr,omitempty"`
+
+	// files to which the tool's stdout and stderr get tee'd, unless redirected by the CWL
+	StdoutLog string `json:"stdoutLog,omitempty"`
+	StderrLog string `json:"stderrLog,omitempty"`
+
+	// Unquoted[i] is true if Args[i] goes to the shell as is - e.g., a pipe or a redirection, under ShellCommandRequirement
+	Unquoted []bool `json:"unquoted,omitempty"`
+
+	// the files to upload from the working dir - nil means upload the whole working dir
+	Outputs []*OutputPattern `json:"outputs"`
+}
+
+// OutputPattern matches output files to upload
+type OutputPattern struct {
+	Glob           string   `json:"glob"`
+	SecondaryFiles []string `json:"secondaryFiles,omitempty"`
+}
+
+// script returns the run.sh script for the command
+// every argument, env var value and path gets quoted, so the tool gets them exactly as given
+// except for the arguments marked unquoted, which the shell interprets - e.g., `|`, `&&` or `> out.txt`
+// the script runs with either bash or sh, depending on the image - pipefail is set where the shell supports it
+//
+// stdout and stderr are tee'd to the log files given by the engine, unless the CWL redirects them to files of its own
+// the tool's exit code is kept in a file, since without pipefail a pipeline exits with the code of its last command
+func (cmd *TaskCommand) script(workingDir string) string {
+	var b strings.Builder
+	b.WriteString("set -eu\n")
+	b.WriteString("(set -o pipefail) 2> /dev/null && set -o pipefail\n")
+
+	// sorted, so the script is the same for the same command
+	names := make([]string, 0, len(cmd.Env))
+	for name := range cmd.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "export %v=%v\n", name, shellQuote(cmd.Env[name]))
+	}
+
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		if i < len(cmd.Unquoted) && cmd.Unquoted[i] {
+			args[i] = arg
+			continue
+		}
+		args[i] = shellQuote(arg)
+	}
+	command := strings.Join(args, " ")
+	if cmd.Stdin != "" {
+		command += fmt.Sprintf(" < %v", shellQuote(cmd.Stdin))
+	}
+	if cmd.Stdout != "" {
+		command += fmt.Sprintf(" 1>> %v", shellQuote(cmd.Stdout))
+	}
+	if cmd.Stderr != "" {
+		command += fmt.Sprintf(" 2>> %v", shellQuote(cmd.Stderr))
+	}
+
+	teeStdout := cmd.Stdout == "" && cmd.StdoutLog != ""
+	teeStderr := cmd.Stderr == "" && cmd.StderrLog != ""
+	if !teeStdout && !teeStderr {
+		b.WriteString(command + "\n")
+		return b.String()
+	}
+
+	rc := shellQuote(filepath.Join(workingDir, returnCodeFile))
+	// in a subshell of its own, so that the exit code gets kept even if the command exits the shell - e.g., an unquoted `exit 3`
+	command = fmt.Sprintf("if ( %v ); then echo 0 > %v; else echo $? > %v; fi", command, rc, rc)
+	if teeStderr {
+		// swap stdout and stderr, so that stderr goes through the pipe to tee - then swap back
+		command = fmt.Sprintf("{ { %v; } 2>&1 1>&3 3>&- | tee -a %v 1>&2 3>&-; } 3>&1", command, shellQuote(cmd.StderrLog))
+	}
+	if teeStdout {
+		command = fmt.Sprintf("{ %v; } | tee -a %v", command, shellQuote(cmd.StdoutLog))
+	}
+	b.WriteString(command + "\n")
+	fmt.Fprintf(&b, "exit $(cat %v)\n", rc)
+	return b.String()
+}
+
+// shellQuote single-quotes a string for POSIX sh
+// any single quote within the string gets closed, escaped and reopened
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"", `''`},
+		{"plain", `'plain'`},
+		{"with space", `'with space'`},
+		{"it's", `'it'\''s'`},
+		{"$HOME", `'$HOME'`},
+		{"$(rm -rf /)", `'$(rm -rf /)'`},
+		{"a | b && c > d", `'a | b && c > d'`},
+		{`"double"`, `'"double"'`},
+	}
+	for _, c := range cases {
+		got := shellQuote(c.in)
+		if got != c.want {
+			t.Errorf("shellQuote(%q) = %v, want %v", c.in, got, c.want)
+		}
+		// the shell gets back exactly the given string
+		out, err := exec.Command("sh", "-c", "printf %s "+got).Output()
+		if err != nil {
+			t.Fatalf("sh failed for %q: %v", c.in, err)
+		}
+		if string(out) != c.in {
+			t.Errorf("sh got %q from shellQuote(%q), want the same", out, c.in)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	const header = "set -eu\n(set -o pipefail) 2> /dev/null && set -o pipefail\n"
+	cases := []struct {
+		name string
+		cmd  *TaskCommand
+		want string
+	}{
+		{
+			name: "quoted args",
+			cmd:  &TaskCommand{Args: []string{"echo", "with space", "it's", "$HOME"}},
+			want: header + `'echo' 'with space' 'it'\''s' '$HOME'` + "\n",
+		},
+		{
+			name: "unquoted shell fragments",
+			cmd: &TaskCommand{
+				Args:     []string{"cat", "in file.txt", "|", "wc", "-l", "&&", "echo", "done", "> out.txt"},
+				Unquoted: []bool{false, false, true, false, false, true, false, false, true},
+			},
+			want: header + `'cat' 'in file.txt' | 'wc' '-l' && 'echo' 'done' > out.txt` + "\n",
+		},
+		{
+			name: "env and redirects",
+			cmd: &TaskCommand{
+				Args:   []string{"tool"},
+				Env:    map[string]string{"B": "b's", "A": "$a"},
+				Stdin:  "/in dir/in.txt",
+				Stdout: "/out dir/out.txt",
+			},
+			want: header + "export A='$a'\nexport B='b'\\''s'\n" + `'tool' < '/in dir/in.txt' 1>> '/out dir/out.txt'` + "\n",
+		},
+	}
+	for _, c := range cases {
+		if got := c.cmd.script("/wd/"); got != c.want {
+			t.Errorf("%v: script() =\n%v\nwant\n%v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestScriptRuns(t *testing.T) {
+	dir := t.TempDir()
+	stdoutLog := filepath.Join(dir, "stdout.log")
+	cmd := &TaskCommand{
+		Args:      []string{"printf", `%s\n`, "a b", "it's", "$HOME", "|", "tr", "a-z", "A-Z"},
+		Unquoted:  []bool{false, false, false, false, false, true, false, false, false},
+		StdoutLog: stdoutLog,
+	}
+	out, err := exec.Command("sh", "-c", cmd.script(dir)).Output()
+	if err != nil {
+		t.Fatalf("script failed: %v", err)
+	}
+	want := "A B\nIT'S\n$HOME\n"
+	if string(out) != want {
+		t.Errorf("script output = %q, want %q", out, want)
+	}
+	log, err := ioutil.ReadFile(stdoutLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(log) != want {
+		t.Errorf("stdout log = %q, want %q", log, want)
+	}
+}
+
+func TestScriptExitCode(t *testing.T) {
+	tools := map[string]*TaskCommand{
+		"tool":          {Args: []string{"sh", "-c", "echo out; echo err 1>&2; exit 3"}},
+		"unquoted exit": {Args: []string{"echo out; echo err 1>&2; exit 3"}, Unquoted: []bool{true}},
+	}
+	for _, shell := range []string{"sh", "bash"} {
+		if _, err := exec.LookPath(shell); err != nil {
+			continue
+		}
+		for name, cmd := range tools {
+			testScriptExitCode(t, shell+", "+name, shell, cmd)
+		}
+	}
+}
+
+// testScriptExitCode runs the script of the given command, which exits 3, with its stdout and stderr tee'd to logs
+func testScriptExitCode(t *testing.T, name, shell string, cmd *TaskCommand) {
+	dir := t.TempDir()
+	stdoutLog, stderrLog := filepath.Join(dir, "stdout.log"), filepath.Join(dir, "stderr.log")
+	cmd.StdoutLog, cmd.StderrLog = stdoutLog, stderrLog
+	c := exec.Command(shell, "-c", cmd.script(dir))
+	var stdout, stderr strings.Builder
+	c.Stdout, c.Stderr = &stdout, &stderr
+	// the tool's exit code - not tee's
+	err := c.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("%v: script error = %v, want exit code 3", name, err)
+	}
+	if rc, _ := ioutil.ReadFile(filepath.Join(dir, returnCodeFile)); strings.TrimSpace(string(rc)) != "3" {
+		t.Errorf("%v: return code file = %q, want 3", name, rc)
+	}
+	// each stream still goes to its own fd, as well as to its log
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("%v: stdout, stderr = %q, %q, want %q, %q", name, stdout.String(), stderr.String(), "out\n", "err\n")
+	}
+	for log, want := range map[string]string{stdoutLog: "out\n", stderrLog: "err\n"} {
+		if b, _ := ioutil.ReadFile(log); string(b) != want {
+			t.Errorf("%v: %v = %q, want %q", name, filepath.Base(log), b, want)
+		}
+	}
+}
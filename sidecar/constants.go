@@ -1,6 +1,59 @@
 package main
 
+import "time"
+
 const (
 	commonsDataPath = "/commons-data"
 	localDataPath   = "/engine-workspace"
+
+	// remote inputs get staged under this dir - see fetch.go
+	remoteDataPath = localDataPath + "/_mariner_remote/"
+
+	// endpoint of the s3-compatible API of gcs
+	gcsEndpoint = "https://storage.googleapis.com"
+
+	// timeouts of the fetches of https inputs - see httpsFetcher
+	// a fetch which stalls for longer than the idle read timeout fails, and gets retried - see withRetries()
+	httpsConnectTimeout  = 30 * time.Second
+	httpsHeaderTimeout   = time.Minute
+	httpsIdleReadTimeout = 2 * time.Minute
+
+	// written to the task working dir if the sidecar fails - see fail()
+	// the task container doesn't run the tool if this file exists, and the engine reads the failure from it
+	failureMarkerFile = "_mariner_sidecar_failed"
+
+	// k8s surfaces the contents of this file as the container's termination message
+	terminationMessagePath = "/dev/termination-log"
+
+	// retries of s3 transfers - see withRetries()
+	maxTransferAttempts = 5
+	initialBackoff      = 2 * time.Second
+	maxBackoff          = 30 * time.Second
+
+	// handshake with the task container - see status.go
+	taskExitFile   = "_mariner_task_exit.json"   // written by the task container once the tool exits
+	taskStatusFile = "_mariner_task_status.json" // the status of the task, for the engine
+	exitCodeFile   = "_mariner_exit_code"        // written by the task container once the tool exits
+	cwlOutputFile  = "cwl.output.json"           // per the CWL spec, the tool may write its outputs here
+	returnCodeFile = "_mariner_rc"               // the tool's exit code, within run.sh
+	pollingPeriod  = time.Second
+
+	// the task container touches its heartbeat file every TASK_HEARTBEAT_PERIOD seconds while it runs, as set by the engine
+	// if the heartbeat is older than heartbeatTimeoutPeriods periods, the task container is gone - see waitForTaskExit()
+	taskHeartbeatFile       = "_mariner_task_heartbeat"
+	defaultHeartbeatPeriod  = 10
+	heartbeatTimeoutPeriods = 6
+
+	// max time to wait on the task container, if the task has no time limit
+	defaultMaxTaskDuration = 7 * 24 * time.Hour
+
+	// how long to wait for a commons file to appear, while gen3fuse sets up
+	gen3fuseTimeout = 2 * time.Minute
+
+	// phases of the task
+	phaseStaging   = "staging"
+	phaseRunning   = "running"
+	phaseUploading = "uploading"
+	phaseCompleted = "completed"
+	phaseFailed    = "failed"
 )
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// this file contains the fetchers of remote inputs - File inputs given as s3://, gs:// or https:// URLs
+// the engine maps each remote URL to a local path under /engine-workspace/_mariner_remote/
+// and the sidecar fetches the file to that path, with the fetcher for the URL's scheme
+//
+// the credentials for each scheme come from the mariner config, via env vars:
+// - s3: REMOTE_S3_CREDS {"id": .., "secret": ..} - if not set, objects are fetched anonymously
+// - gs: REMOTE_GS_CREDS, an HMAC key {"id": .., "secret": ..} - if not set, objects are fetched anonymously
+// - https: REMOTE_HTTPS_CREDS {"token": ..} - sent as a bearer token, only to the hosts listed in REMOTE_HTTPS_HOSTS
+//
+// remote inputs are never fetched with the sidecar's own aws creds, which give access to the working dirs of every user's runs
+// for the same reason, the workspace bucket is never fetched from as a remote source
+//
+// an input may come with several sources - e.g., the access URLs of a DRS object, which may be signed and need headers
+// each source gets tried in turn, until the input is fetched
+
+// Fetcher downloads the file at a remote URL to a local path
+// headers are "<name>: <value>" - only https URLs take headers
+type Fetcher interface {
+	Fetch(u *url.URL, headers []string, localPath string) error
+}
+
+// RemoteSource is an access URL of a remote input
+type RemoteSource struct {
+	URL     string   `json:"url"`
+	Headers []string `json:"headers,omitempty"`
+}
+
+// isRemotePath returns true if the given local path is where a remote input gets staged
+func isRemotePath(path string) bool {
+	return strings.HasPrefix(path, remoteDataPath)
+}
+
+type httpsCredentials struct {
+	Token string `json:"token"`
+}
+
+// setupFetchers sets up the fetcher for each supported scheme of remote URLs
+func (fm *S3FileManager) setupFetchers() error {
+	// remote s3:// URLs are in aws s3, even if the working dirs are in an s3-compatible store at S3_ENDPOINT
+	s3Config := &aws.Config{Region: fm.AWSConfig.Region, Credentials: credentials.AnonymousCredentials}
+	if v := os.Getenv(remoteS3CredsEnvVar); v != "" {
+		creds := &awsCredentials{}
+		if err := json.Unmarshal([]byte(v), creds); err != nil {
+			return fmt.Errorf("error unmarshalling remote s3 creds: %v", err)
+		}
+		s3Config.Credentials = credentials.NewStaticCredentials(creds.ID, creds.Secret, "")
+	}
+
+	// gcs has an s3-compatible API, which accepts HMAC keys
+	// see: https://cloud.google.com/storage/docs/interoperability
+	gsConfig := &aws.Config{
+		Endpoint:         aws.String(gcsEndpoint),
+		Region:           aws.String("auto"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.AnonymousCredentials,
+	}
+	if v := os.Getenv(remoteGSCredsEnvVar); v != "" {
+		creds := &awsCredentials{}
+		if err := json.Unmarshal([]byte(v), creds); err != nil {
+			return fmt.Errorf("error unmarshalling remote gs creds: %v", err)
+		}
+		gsConfig.Credentials = credentials.NewStaticCredentials(creds.ID, creds.Secret, "")
+	}
+
+	https := &httpsFetcher{client: newHTTPSClient(), idleTimeout: httpsIdleReadTimeout, hosts: make(map[string]bool)}
+	if v := os.Getenv(remoteHTTPSCredsEnvVar); v != "" {
+		creds := &httpsCredentials{}
+		if err := json.Unmarshal([]byte(v), creds); err != nil {
+			return fmt.Errorf("error unmarshalling remote https creds: %v", err)
+		}
+		https.token = creds.Token
+	}
+	for _, host := range strings.Split(os.Getenv(remoteHTTPSHostsEnvVar), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			https.hosts[host] = true
+		}
+	}
+
+	fm.Fetchers = map[string]Fetcher{
+		"s3":    &s3Fetcher{fm: fm, config: s3Config, findRegion: true, checksum: true},
+		"gs":    &s3Fetcher{fm: fm, config: gsConfig},
+		"https": https,
+	}
+	return nil
+}
+
+// fetchRemoteInput fetches a remote input to its local path, from each of its sources in turn, with retries
+func (fm *S3FileManager) fetchRemoteInput(taskInput *TaskS3Input) error {
+	if err := os.MkdirAll(filepath.Dir(taskInput.Path), os.ModeDir); err != nil {
+		return fmt.Errorf("failed to make dirs: %v", err)
+	}
+	sources := taskInput.Sources
+	if len(sources) == 0 {
+		sources = []*RemoteSource{{URL: taskInput.URL}}
+	}
+	var errs []string
+	for _, source := range sources {
+		err := fm.fetchRemoteSource(source, taskInput.Path)
+		if err == nil {
+			return nil
+		}
+		log.Warnf("failed to fetch %v: %v", taskInput.Path, err)
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("failed to fetch from any of %v sources: %v", len(sources), strings.Join(errs, "; "))
+}
+
+// fetchRemoteSource fetches a remote input from one of its sources, with retries
+func (fm *S3FileManager) fetchRemoteSource(source *RemoteSource, localPath string) error {
+	u, err := url.Parse(source.URL)
+	if err != nil {
+		return fmt.Errorf("failed to parse URL: %v", err)
+	}
+	// a signed URL's query string is left out, so it doesn't end up in the logs
+	name := fmt.Sprintf("%v://%v%v", u.Scheme, u.Host, u.Path)
+	fetcher, ok := fm.Fetchers[u.Scheme]
+	if !ok {
+		return fmt.Errorf("unsupported scheme of URL %v", name)
+	}
+	if u.Scheme == "s3" && u.Host == fm.S3BucketName {
+		return fmt.Errorf("invalid URL %v - the workspace bucket is not a remote source", name)
+	}
+	log.Infof("fetching %v to %v", name, localPath)
+	return withRetries(fmt.Sprintf("fetch of %v", name), func() error {
+		return fetcher.Fetch(u, source.Headers, localPath)
+	})
+}
+
+// s3Fetcher fetches objects from s3, or from an s3-compatible API
+type s3Fetcher struct {
+	fm         *S3FileManager
+	config     *aws.Config
+	findRegion bool // look up the region of each bucket, which may differ from the configured one
+	checksum   bool // the ETags of single part uploads are MD5 checksums - see verify()
+
+	sync.Mutex
+	sessions map[string]*session.Session // by bucket
+}
+
+func (f *s3Fetcher) session(bucket string) (*session.Session, error) {
+	f.Lock()
+	defer f.Unlock()
+	if sess, ok := f.sessions[bucket]; ok {
+		return sess, nil
+	}
+	sess, err := session.NewSession(f.config)
+	if err != nil {
+		return nil, err
+	}
+	if f.findRegion {
+		region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, aws.StringValue(f.config.Region))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get region of bucket %v: %v", bucket, err)
+		}
+		if sess, err = session.NewSession(f.config.Copy(&aws.Config{Region: aws.String(region)})); err != nil {
+			return nil, err
+		}
+	}
+	if f.sessions == nil {
+		f.sessions = make(map[string]*session.Session)
+	}
+	f.sessions[bucket] = sess
+	return sess, nil
+}
+
+// Fetch downloads the object at "<scheme>://bucket/key"
+func (f *s3Fetcher) Fetch(u *url.URL, headers []string, localPath string) error {
+	sess, err := f.session(u.Host)
+	if err != nil {
+		return err
+	}
+	downloader := s3manager.NewDownloader(sess, func(d *s3manager.Downloader) {
+		d.PartSize = f.fm.PartSize
+		d.Concurrency = f.fm.PartConcurrency
+	})
+	return download(downloader, s3.New(sess), u.Host, strings.TrimPrefix(u.Path, "/"), localPath, f.checksum)
+}
+
+// httpsFetcher fetches files over https
+type httpsFetcher struct {
+	client      *http.Client
+	idleTimeout time.Duration // a download which reads nothing for this long gets cancelled - see idleTimeoutReader
+	token       string
+	hosts       map[string]bool // the hosts to which the token may be sent
+}
+
+// newHTTPSClient returns the client for https fetches, with timeouts for connecting and for the response headers
+// there's no overall timeout, since a large file may take hours to download - the body is bounded by the idle read timeout instead
+func newHTTPSClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: httpsConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = httpsConnectTimeout
+	transport.ResponseHeaderTimeout = httpsHeaderTimeout
+	return &http.Client{Transport: transport}
+}
+
+// idleTimeoutReader cancels a request once its body has read nothing for the timeout
+type idleTimeoutReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+// Fetch downloads the file at the given https URL
+func (f *httpsFetcher) Fetch(u *url.URL, headers []string, localPath string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timer := time.AfterFunc(f.idleTimeout, cancel)
+	defer timer.Stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	for _, h := range headers {
+		if parts := strings.SplitN(h, ":", 2); len(parts) == 2 {
+			req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	// note: the http client drops the Authorization header on redirects to other hosts
+	if f.token != "" && f.hosts[u.Hostname()] {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// the error includes the URL - whose query string may be a signature, which mustn't end up in the logs
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return fmt.Errorf("failed to get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get: %v", resp.Status)
+	}
+
+	// create/open file for writing - truncates the partial file of any previous attempt
+	out, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer out.Close()
+	n, err := io.Copy(out, &idleTimeoutReader{r: resp.Body, timer: timer, timeout: f.idleTimeout})
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("no data received for %v", f.idleTimeout)
+		}
+		return fmt.Errorf("failed to download: %v", err)
+	}
+	if resp.ContentLength < 0 {
+		return nil
+	}
+	return verify(localPath, n, resp.ContentLength, "")
+}
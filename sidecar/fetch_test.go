@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSFetcher(t *testing.T) {
+	stall := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			if r.Header.Get("X-Access") != "granted" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("contents"))
+		case "/stalled":
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("part"))
+			w.(http.Flusher).Flush()
+			<-stall
+		}
+	}))
+	defer server.Close()
+	defer close(stall) // before the server closes, which waits on the stalled handler
+	f := &httpsFetcher{client: server.Client(), idleTimeout: 100 * time.Millisecond}
+	dir := t.TempDir()
+
+	u, _ := url.Parse(server.URL + "/ok")
+	localPath := filepath.Join(dir, "ok")
+	if err := f.Fetch(u, []string{"X-Access: granted"}, localPath); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if b, _ := ioutil.ReadFile(localPath); string(b) != "contents" {
+		t.Errorf("fetched %q, want %q", b, "contents")
+	}
+
+	// a download which stalls fails once it has read nothing for the idle timeout
+	u, _ = url.Parse(server.URL + "/stalled")
+	done := make(chan error, 1)
+	go func() { done <- f.Fetch(u, nil, filepath.Join(dir, "stalled")) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "no data received") {
+			t.Errorf("Fetch() of stalled download error = %v, want idle timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Fetch() of stalled download didn't time out")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/uc-cdis/mariner/storage"
+)
+
+// this file contains code for selecting the files to upload from the task working dir
+// the engine sends the resolved glob patterns of the tool's outputs, along with their secondaryFiles patterns
+// so staged inputs, InitialWorkDir files and scratch data don't get uploaded - unless an output matches them
+//
+// a tool which writes cwl.output.json sets its outputs itself, ignoring the output globs
+// so the files and dirs referenced in cwl.output.json get uploaded too - see cwlOutputPaths()
+
+// files in the task working dir which are always uploaded, if present
+var alwaysUploaded = []string{
+	cwlOutputFile,
+	exitCodeFile,
+	taskExitFile,
+}
+
+// outputPaths returns the paths of the files to upload from the task working dir
+func (fm *S3FileManager) outputPaths() ([]string, error) {
+	if fm.Command == nil || fm.Command.Outputs == nil {
+		return walkFiles(fm.TaskWorkingDir)
+	}
+	paths := make(map[string]bool)
+	add := func(path string) error {
+		files, err := walkFiles(path)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			paths[f] = true
+		}
+		return nil
+	}
+
+	candidates := []string{fm.Command.Stdout, fm.Command.Stderr, fm.Command.StdoutLog, fm.Command.StderrLog}
+	for _, name := range alwaysUploaded {
+		candidates = append(candidates, filepath.Join(fm.TaskWorkingDir, name))
+	}
+	referenced, ok := fm.cwlOutputPaths()
+	if !ok {
+		// can't tell which files the outputs are, so upload them all
+		return walkFiles(fm.TaskWorkingDir)
+	}
+	candidates = append(candidates, referenced...)
+	for _, pattern := range fm.Command.Outputs {
+		matches, err := glob(pattern.Glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			candidates = append(candidates, match)
+			for _, secondaryFile := range pattern.SecondaryFiles {
+				candidates = append(candidates, secondaryFilePath(match, secondaryFile))
+			}
+		}
+	}
+	for _, path := range candidates {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			// e.g., an optional secondary file which the tool didn't write
+			continue
+		}
+		if err := add(path); err != nil {
+			return nil, err
+		}
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// cwlOutputPaths returns the paths of the files and dirs referenced in the cwl.output.json written by the tool, if any
+// i.e., the location and path of each File and Directory in it - along with those of their secondaryFiles and listings
+// returns false if cwl.output.json exists but can't be parsed
+func (fm *S3FileManager) cwlOutputPaths() (paths []string, ok bool) {
+	b, err := ioutil.ReadFile(filepath.Join(fm.TaskWorkingDir, cwlOutputFile))
+	if os.IsNotExist(err) {
+		return nil, true
+	}
+	var outputs interface{}
+	if err == nil {
+		err = json.Unmarshal(b, &outputs)
+	}
+	if err != nil {
+		log.Warnf("failed to parse %v, uploading the whole working dir: %v", cwlOutputFile, err)
+		return nil, false
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case []interface{}:
+			for _, e := range x {
+				walk(e)
+			}
+		case map[string]interface{}:
+			if class, _ := x["class"].(string); class == "File" || class == "Directory" {
+				for _, key := range []string{"location", "path"} {
+					if path := fm.cwlOutputPath(x[key]); path != "" {
+						paths = append(paths, path)
+					}
+				}
+			}
+			// secondaryFiles, listings, and the fields of records
+			for _, e := range x {
+				walk(e)
+			}
+		}
+	}
+	walk(outputs)
+	return paths, true
+}
+
+// cwlOutputPath returns the local path of a location or path in cwl.output.json, or "" if it's not a local path
+// relative paths are relative to the task working dir
+func (fm *S3FileManager) cwlOutputPath(v interface{}) string {
+	s, _ := v.(string)
+	s = strings.TrimPrefix(s, "file://")
+	if s == "" || strings.Contains(s, "://") {
+		return ""
+	}
+	if !filepath.IsAbs(s) {
+		s = filepath.Join(fm.TaskWorkingDir, s)
+	}
+	return filepath.Clean(s)
+}
+
+// glob returns the paths of the files and dirs which match the pattern, with the same semantics as the engine's glob
+// i.e., character classes, and "**" matching any number of dirs - see storage.Match
+func glob(pattern string) (matches []string, err error) {
+	if _, err = storage.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	root := storage.GlobRoot(pattern)
+	if _, err = os.Lstat(root); err != nil {
+		// nothing matches under a dir which doesn't exist
+		return nil, nil
+	}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if match, _ := storage.Match(pattern, path); match {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// walkFiles returns the paths of the regular files at or under the given path
+// symlinks to regular files are included - e.g., an output which is an InitialWorkDir file
+func walkFiles(root string) (paths []string, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil {
+				// broken symlink
+				return nil
+			}
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// secondaryFilePath returns the path of the secondary file of the given file, per a secondaryFiles pattern
+// each leading "^" strips an extension from the file's path before the rest of the pattern is appended
+// see: https://www.commonwl.org/v1.0/CommandLineTool.html#CommandOutputParameter
+func secondaryFilePath(path string, pattern string) string {
+	for strings.HasPrefix(pattern, "^") {
+		pattern = strings.TrimPrefix(pattern, "^")
+		path = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	return path + pattern
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutputPathsCWLOutputJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"out.bam":        "",
+		"out.bam.bai":    "",
+		"report/a.html":  "",
+		"report/b.png":   "",
+		"listed/c.txt":   "",
+		"scratch.tmp":    "",
+		"globbed.txt":    "",
+		cwlOutputFile:    "",
+		"unused/big.dat": "",
+	})
+	fm := &S3FileManager{
+		TaskWorkingDir: dir,
+		Command:        &TaskCommand{Outputs: []*OutputPattern{{Glob: filepath.Join(dir, "*.txt")}}},
+	}
+	cases := []struct {
+		name       string
+		outputJSON string
+		want       []string
+	}{
+		{
+			name: "files, secondaryFiles and listings",
+			outputJSON: `{
+				"bam": {"class": "File", "location": "out.bam", "secondaryFiles": [{"class": "File", "path": "` + filepath.Join(dir, "out.bam.bai") + `"}]},
+				"report": {"class": "Directory", "location": "file://` + filepath.Join(dir, "report") + `"},
+				"record": {"listed": {"class": "Directory", "listing": [{"class": "File", "location": "listed/c.txt"}]}},
+				"remote": {"class": "File", "location": "s3://bucket/key"},
+				"n": 3
+			}`,
+			want: []string{cwlOutputFile, "globbed.txt", "listed/c.txt", "out.bam", "out.bam.bai", "report/a.html", "report/b.png"},
+		},
+		{
+			name:       "unparseable",
+			outputJSON: `{"bam": `,
+			want:       []string{cwlOutputFile, "globbed.txt", "listed/c.txt", "out.bam", "out.bam.bai", "report/a.html", "report/b.png", "scratch.tmp", "unused/big.dat"},
+		},
+	}
+	for _, c := range cases {
+		writeFiles(t, dir, map[string]string{cwlOutputFile: c.outputJSON})
+		paths, err := fm.outputPaths()
+		if err != nil {
+			t.Fatalf("%v: outputPaths() error = %v", c.name, err)
+		}
+		var got []string
+		for _, path := range paths {
+			rel, _ := filepath.Rel(dir, path)
+			got = append(got, rel)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: outputPaths() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
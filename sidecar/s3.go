@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -17,18 +19,37 @@ const (
 	awsCredsEnvVar         = "AWSCREDS"
 	s3RegionEnvVar         = "S3_REGION"
 	s3BucketNameEnvVar     = "S3_BUCKET_NAME"
+	s3EndpointEnvVar       = "S3_ENDPOINT"
 	userIDEnvVar           = "USER_ID"
+	maxConcurrentEnvVar    = "MAX_CONCURRENT_TRANSFERS"
+	partSizeEnvVar         = "TRANSFER_PART_SIZE_MB"
+	partConcurrencyEnvVar  = "TRANSFER_PART_CONCURRENCY"
 	sharedVolumeNameEnvVar = "ENGINE_WORKSPACE"
 	taskWorkingDirEnvVar   = "TOOL_WORKING_DIR"
+	remoteS3CredsEnvVar    = "REMOTE_S3_CREDS"
+	remoteGSCredsEnvVar    = "REMOTE_GS_CREDS"
+	remoteHTTPSCredsEnvVar = "REMOTE_HTTPS_CREDS"
+	remoteHTTPSHostsEnvVar = "REMOTE_HTTPS_HOSTS"
+	taskTimeLimitEnvVar    = "TASK_TIME_LIMIT"
+	taskHeartbeatEnvVar    = "TASK_HEARTBEAT_PERIOD"
 
 	// setting a max so as to prevent the error of having too many files being open at once
 	// need to investigate how high we can set this bound without running into problems
-	// for now, conservatively setting the bound to 32
+	// for now, conservatively setting the default bound to 32 - configurable via MAX_CONCURRENT_TRANSFERS
 	maxConcurrent = 32
 
+	// multipart transfers - configurable via TRANSFER_PART_SIZE_MB and TRANSFER_PART_CONCURRENCY
+	// at most 10000 parts per object, so 64MB parts allow objects up to ~640GB
+	defaultPartSizeMB      = 64
+	defaultPartConcurrency = 5
+
 	// resides in the task's working dir in s3
 	// contains list of files that need to be downloaded from s3 in order for this task to run
 	inputFileListName = "_mariner_s3_input.json"
+
+	// resides in the task's working dir in s3
+	// contains the command for the task container, from which run.sh gets written
+	commandFileName = "_mariner_command.json"
 )
 
 // S3FileManager manages interactions with S3
@@ -36,10 +57,18 @@ type S3FileManager struct {
 	AWSConfig             *aws.Config
 	S3BucketName          string
 	InputFileListS3Key    string
+	CommandS3Key          string
 	UserID                string
 	SharedVolumeMountPath string
 	TaskWorkingDir        string
 	MaxConcurrent         int
+	PartSize              int64 // bytes
+	PartConcurrency       int
+	Command               *TaskCommand
+	Status                *TaskStatus
+	MaxTaskDuration       time.Duration      // bound on the wait for the task container - the task's time limit, if it has one
+	HeartbeatTimeout      time.Duration      // age at which the task container's heartbeat is stale
+	Fetchers              map[string]Fetcher // fetchers of remote inputs, by URL scheme - see fetch.go
 }
 
 type awsCredentials struct {
@@ -60,26 +89,37 @@ func (fm *S3FileManager) setup() (err error) {
 
 	fm.TaskWorkingDir = os.Getenv(taskWorkingDirEnvVar)
 
-	fm.MaxConcurrent = maxConcurrent
+	fm.MaxConcurrent = envInt(maxConcurrentEnvVar, maxConcurrent)
+	fm.PartSize = int64(envInt(partSizeEnvVar, defaultPartSizeMB)) * 1024 * 1024
+	fm.PartConcurrency = envInt(partConcurrencyEnvVar, defaultPartConcurrency)
+
+	fm.MaxTaskDuration = defaultMaxTaskDuration
+	if limit := envInt(taskTimeLimitEnvVar, 0); limit > 0 {
+		fm.MaxTaskDuration = time.Duration(limit) * time.Second
+	}
+	fm.HeartbeatTimeout = time.Duration(heartbeatTimeoutPeriods*envInt(taskHeartbeatEnvVar, defaultHeartbeatPeriod)) * time.Second
 
 	// "/userID/workflowRuns/runID/taskID/_mariner_s3_input.json"
 	fm.InputFileListS3Key = filepath.Join(fm.s3Key(fm.TaskWorkingDir), inputFileListName)
 
-	return nil
+	// "/userID/workflowRuns/runID/taskID/_mariner_command.json"
+	fm.CommandS3Key = filepath.Join(fm.s3Key(fm.TaskWorkingDir), commandFileName)
+
+	return fm.setupFetchers()
 }
 
 /*
-	converts filepath to the corresponding s3 location
-	-> maps the local "task working directory"
-	-- to the S3 "task working directory"
+converts filepath to the corresponding s3 location
+-> maps the local "task working directory"
+-- to the S3 "task working directory"
 
-	filepaths look like:
-	"/engine-workspace/path/to/file"
+filepaths look like:
+"/engine-workspace/path/to/file"
 
-	s3 keys look like:
-	"/userID/path/to/file"
+s3 keys look like:
+"/userID/path/to/file"
 
-	so, replace "/engine-workspace" with "/userID"
+so, replace "/engine-workspace" with "/userID"
 */
 func (fm *S3FileManager) s3Key(path string) string {
 	userIDPrefix := fmt.Sprintf("/%v", fm.UserID)
@@ -87,6 +127,14 @@ func (fm *S3FileManager) s3Key(path string) string {
 	return key
 }
 
+// envInt returns the positive integer value of an env var, or the default if not set
+func envInt(name string, defaultValue int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return defaultValue
+}
+
 func (fm *S3FileManager) newS3Session() *session.Session {
 	return session.Must(session.NewSession(fm.AWSConfig))
 }
@@ -103,5 +151,10 @@ func loadAWSConfig() (*aws.Config, error) {
 		Region:      aws.String(os.Getenv(s3RegionEnvVar)),
 		Credentials: credsConfig,
 	}
+	// an s3-compatible store, e.g., MinIO - which is addressed by path rather than by virtual host
+	if endpoint := os.Getenv(s3EndpointEnvVar); endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
 	return awsConfig, nil
 }
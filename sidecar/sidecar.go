@@ -3,13 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
 	pathLib "path"
 	"path/filepath"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -22,47 +22,109 @@ type TaskS3Input struct {
 	URL         string `json:"url"`           // S3 URL
 	Path        string `json:"path"`          // Local path for dl
 	InitWorkDir bool   `json:"init_work_dir"` // is this an initwkdir requirement?
+
+	// the access URLs of a remote input, if they can't be recovered from its path - tried in order - see fetch.go
+	Sources []*RemoteSource `json:"sources,omitempty"`
 }
 
 func main() {
 
-	fm := &S3FileManager{}
-	fm.setup()
+	fm := &S3FileManager{Status: &TaskStatus{StagingStartedAt: now()}}
+	if err := fm.setup(); err != nil {
+		fm.fail(fmt.Errorf("setup failed: %v", err))
+	}
+	fm.setPhase(phaseStaging)
 
 	// 1. read in the target s3 paths
 	taskS3Input, err := fm.fetchTaskS3InputList()
 	if err != nil {
-		log.Errorf("readMarinerS3Paths failed: %s", err)
+		fm.fail(fmt.Errorf("readMarinerS3Paths failed: %v", err))
 	}
 
 	// 2. download those files to the shared volume
 	err = fm.downloadInputFiles(taskS3Input)
 	if err != nil {
-		log.Errorf("downloadFiles failed: %s", err)
+		fm.fail(fmt.Errorf("downloadFiles failed: %v", err))
 	}
 
 	// 3. signal main container to run
 	err = fm.signalTaskToRun()
 	if err != nil {
-		log.Errorf("signalTaskToRun failed: %s", err)
+		fm.fail(fmt.Errorf("signalTaskToRun failed: %v", err))
 	}
+	fm.setPhase(phaseRunning)
 
 	// 4. wait for main container to finish
 	err = fm.waitForTaskToFinish()
 	if err != nil {
-		log.Errorf("waitForTaskToFinish failed: %s", err)
+		fm.fail(fmt.Errorf("waitForTaskToFinish failed: %v", err))
 	}
+	fm.setPhase(phaseUploading)
 
 	// 5. upload output files to s3
 	err = fm.uploadOutputFiles()
 	if err != nil {
-		log.Errorf("uploadOutputFiles failed: %s", err)
+		fm.fail(fmt.Errorf("uploadOutputFiles failed: %v", err))
+	}
+
+	// 6. report the final status of the task to the engine
+	fm.Status.UploadedAt = now()
+	fm.Status.Phase = phaseCompleted
+	if err = fm.uploadStatus(); err != nil {
+		fm.fail(fmt.Errorf("uploadStatus failed: %v", err))
 	}
+}
 
+// fail marks the task as failed, and exits non-zero - so the pod, and so the task job, fails
+// the failure marker in the task working dir tells the task container not to run the tool (if it hasn't yet)
+// and tells the engine why the task failed - the same message goes to the sidecar's termination message
+func (fm *S3FileManager) fail(err error) {
+	log.Errorf("%v", err)
+	message := []byte(err.Error())
+	if fm.TaskWorkingDir != "" {
+		marker := filepath.Join(fm.TaskWorkingDir, failureMarkerFile)
+		if e := os.MkdirAll(fm.TaskWorkingDir, os.ModeDir); e != nil {
+			log.Errorf("failed to make dirs: %v", e)
+		}
+		if e := ioutil.WriteFile(marker, message, 0644); e != nil {
+			log.Errorf("failed to write failure marker: %v", e)
+		}
+		if fm.AWSConfig != nil {
+			if e := fm.upload(marker); e != nil {
+				log.Errorf("failed to upload failure marker: %v", e)
+			}
+			fm.Status.Phase = phaseFailed
+			fm.Status.Error = err.Error()
+			if e := fm.uploadStatus(); e != nil {
+				log.Errorf("failed to upload task status: %v", e)
+			}
+		}
+	}
+	if e := ioutil.WriteFile(terminationMessagePath, message, 0644); e != nil {
+		log.Errorf("failed to write termination message: %v", e)
+	}
+	os.Exit(1)
 }
 
 // 1. read this task's input file list from s3
 func (fm *S3FileManager) fetchTaskS3InputList() ([]*TaskS3Input, error) {
+	log.Debugf("here are the input key we are trying to download from s3 %s", fm.InputFileListS3Key)
+	b, err := fm.fetch(fm.InputFileListS3Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var taskS3Input []*TaskS3Input
+	err = json.Unmarshal(b, &taskS3Input)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarhsalling TaskS3Input: %v", err)
+	}
+
+	return taskS3Input, nil
+}
+
+// fetch returns the contents of the object with the given key in the s3 bucket
+func (fm *S3FileManager) fetch(key string) ([]byte, error) {
 	sess := fm.newS3Session()
 
 	// Create a downloader with the session and default options
@@ -75,23 +137,14 @@ func (fm *S3FileManager) fetchTaskS3InputList() ([]*TaskS3Input, error) {
 	// Write the contents of S3 Object to the buffer
 	s3Obj := &s3.GetObjectInput{
 		Bucket: aws.String(fm.S3BucketName),
-		Key:    aws.String(fm.InputFileListS3Key),
+		Key:    aws.String(key),
 	}
 
-	log.Debugf("here are the input key we are trying to download from s3 %s", fm.InputFileListS3Key)
 	_, err := downloader.Download(buf, s3Obj)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file, %v", err)
 	}
-
-	b := buf.Bytes()
-	var taskS3Input []*TaskS3Input
-	err = json.Unmarshal(b, &taskS3Input)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarhsalling TaskS3Input: %v", err)
-	}
-
-	return taskS3Input, nil
+	return buf.Bytes(), nil
 }
 
 func isLocalPath(path string, url string) bool {
@@ -119,13 +172,20 @@ func getS3KeyAndBucket(fileUrl string, path string, fm *S3FileManager) (key stri
 }
 
 // 2. download this task's input files from s3
+// each download is retried with backoff, and verified against the size and checksum of the s3 object
+// returns an error if any input file could not be staged, so the tool never runs on a missing or partial file
 func (fm *S3FileManager) downloadInputFiles(taskS3Input []*TaskS3Input) (err error) {
 
 	// note: downloader is safe for concurrent use
 	sess := fm.newS3Session()
-	downloader := s3manager.NewDownloader(sess)
+	downloader := s3manager.NewDownloader(sess, func(d *s3manager.Downloader) {
+		d.PartSize = fm.PartSize
+		d.Concurrency = fm.PartConcurrency
+	})
+	svc := s3.New(sess)
 
 	var wg sync.WaitGroup
+	errs := &transferErrors{}
 	guard := make(chan struct{}, fm.MaxConcurrent)
 
 	for _, p := range taskS3Input {
@@ -136,89 +196,125 @@ func (fm *S3FileManager) downloadInputFiles(taskS3Input []*TaskS3Input) (err err
 		wg.Add(1)
 		go func(taskInput *TaskS3Input) {
 			defer wg.Done()
-			log.Infof("here is the file we are downloading %+v", taskInput)
-
-			var skipFile = false
-
-			if strings.Contains(filepath.Dir(taskInput.Path), commonsDataPath) {
-				// test if it exists
-				log.Infof("commons file: %v", taskInput.Path)
-				_, err = os.Stat(taskInput.Path)
-				if os.IsNotExist(err) {
-					log.Errorf("Commons file %v does not exist; error - %v", taskInput.Path, err)
-				}
-				// create necessary dirs
-				if err = os.MkdirAll(fm.TaskWorkingDir, os.ModeDir); err != nil {
-					log.Errorf("failed to make dirs: %v\n", err)
-				}
-			} else {
-				localPath := taskInput.Path
-				if isLocalPath(taskInput.Path, taskInput.URL) {
-					skipFile = true
-					localPath = filepath.Join(fm.TaskWorkingDir, pathLib.Base(taskInput.Path))
-				}
-
-				// create necessary dirs
-				if err = os.MkdirAll(filepath.Dir(localPath), os.ModeDir); err != nil {
-					log.Errorf("failed to make dirs: %v\n", err)
-				}
-
-				// create/open file for writing
-				log.Infof("local path: %v", localPath)
-				f, err := os.Create(localPath)
-				if err != nil {
-					log.Errorf("failed to open file: %s", err)
-				}
-				defer f.Close()
-
-				s3Key, s3Bucket, err := getS3KeyAndBucket(taskInput.URL, taskInput.Path, fm)
-
-				if err != nil {
-					log.Errorf("failed to get s3 key and bucket from %v; error - %v", taskInput.URL, err)
-				}
-
-				log.Infof("downloading; bucket - %v; key - %v", s3Bucket, s3Key)
-				_, err = downloader.Download(f, &s3.GetObjectInput{
-					Bucket: aws.String(s3Bucket),
-					Key:    aws.String(s3Key),
-				})
-				if err != nil {
-					log.Errorf("failed to download file with url %s and path %s with error %s: ", taskInput.URL, taskInput.Path, err)
-				}
-			}
-
-			// If initworkdir, we will symlink
-			if taskInput.InitWorkDir && !skipFile {
-				log.Infof("InitWorkDir file: %v\n", taskInput.Path)
-				newPath := filepath.Join(fm.TaskWorkingDir, pathLib.Base(taskInput.Path))
-				err = os.Symlink(taskInput.Path, newPath)
-				if err != nil {
-					log.Infof("skipping symlink: %v - %v; error: %v\n", taskInput.Path, newPath, err)
-				} else {
-					log.Infof("created symlink: %v - %v\n", taskInput.Path, newPath)
-				}
-			}
 
 			// release this spot in the guard channel
 			// so the next goroutine can run
-			<-guard
+			defer func() { <-guard }()
+
+			log.Infof("here is the file we are downloading %+v", taskInput)
+			if err := fm.stageInputFile(downloader, svc, taskInput); err != nil {
+				errs.add(fmt.Errorf("failed to stage input file with url %v and path %v: %v", taskInput.URL, taskInput.Path, err))
+			}
 		}(p)
 	}
 	wg.Wait()
+	return errs.err()
+}
+
+// stageInputFile stages a single input file to the shared volume
+func (fm *S3FileManager) stageInputFile(downloader *s3manager.Downloader, svc *s3.S3, taskInput *TaskS3Input) error {
+	var skipFile = false
+
+	if strings.Contains(filepath.Dir(taskInput.Path), commonsDataPath) {
+		// test if it exists
+		// gen3fuse may still be setting up, so wait a bit for it to appear
+		log.Infof("commons file: %v", taskInput.Path)
+		if err := waitForFile(taskInput.Path, gen3fuseTimeout); err != nil {
+			return fmt.Errorf("commons file %v is not available: %v", taskInput.Path, err)
+		}
+		// create necessary dirs
+		if err := os.MkdirAll(fm.TaskWorkingDir, os.ModeDir); err != nil {
+			return fmt.Errorf("failed to make dirs: %v", err)
+		}
+	} else if isRemotePath(taskInput.Path) {
+		// an input given as a remote URL - e.g., s3://, gs:// or https://
+		if err := fm.fetchRemoteInput(taskInput); err != nil {
+			return err
+		}
+	} else {
+		localPath := taskInput.Path
+		if isLocalPath(taskInput.Path, taskInput.URL) {
+			skipFile = true
+			localPath = filepath.Join(fm.TaskWorkingDir, pathLib.Base(taskInput.Path))
+		}
+
+		// create necessary dirs
+		if err := os.MkdirAll(filepath.Dir(localPath), os.ModeDir); err != nil {
+			return fmt.Errorf("failed to make dirs: %v", err)
+		}
+
+		s3Key, s3Bucket, err := getS3KeyAndBucket(taskInput.URL, taskInput.Path, fm)
+		if err != nil {
+			return fmt.Errorf("failed to get s3 key and bucket: %v", err)
+		}
+
+		log.Infof("downloading; bucket - %v; key - %v; local path - %v", s3Bucket, s3Key, localPath)
+		err = withRetries(fmt.Sprintf("download of %v", s3Key), func() error {
+			return download(downloader, svc, s3Bucket, s3Key, localPath, true)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// If initworkdir, we will symlink
+	if taskInput.InitWorkDir && !skipFile {
+		log.Infof("InitWorkDir file: %v\n", taskInput.Path)
+		newPath := filepath.Join(fm.TaskWorkingDir, pathLib.Base(taskInput.Path))
+		if err := os.Symlink(taskInput.Path, newPath); err != nil {
+			log.Infof("skipping symlink: %v - %v; error: %v\n", taskInput.Path, newPath, err)
+		} else {
+			log.Infof("created symlink: %v - %v\n", taskInput.Path, newPath)
+		}
+	}
 	return nil
 }
 
-// 3. signal to main container to run
-// fixme - WHY is it that the sidecar passes the task command to the main container?
-// ------> WHY doesn't the engine simply give the task container its command directly?
-// ------> early design decision, probably doesn't make sense any more, should fix it
-func (fm *S3FileManager) signalTaskToRun() error {
+// download downloads an s3 object to the given local path, and verifies the size - and if checksum is true, the checksum - of the local file
+func download(downloader *s3manager.Downloader, svc *s3.S3, bucket string, key string, localPath string, checksum bool) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to head object: %v", err)
+	}
 
-	// cushion to ensure gen3fuse finishes setting up..
-	time.Sleep(7 * time.Second)
+	// create/open file for writing - truncates the partial file of any previous attempt
+	f, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	n, err := downloader.Download(f, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		// guards against the object changing between the head and the download
+		IfMatch: head.ETag,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download: %v", err)
+	}
+	etag := md5ETag(head)
+	if !checksum {
+		etag = ""
+	}
+	return verify(localPath, n, aws.Int64Value(head.ContentLength), etag)
+}
 
-	// fixme - make these strings constants
-	cmd := os.Getenv("TOOL_COMMAND")
+// 3. signal to main container to run
+// by writing the task's command, as given by the engine, to run.sh
+func (fm *S3FileManager) signalTaskToRun() error {
+	b, err := fm.fetch(fm.CommandS3Key)
+	if err != nil {
+		return fmt.Errorf("failed to fetch task command: %v", err)
+	}
+	cmd := &TaskCommand{}
+	if err = json.Unmarshal(b, cmd); err != nil {
+		return fmt.Errorf("error unmarshalling TaskCommand: %v", err)
+	}
+	fm.Command = cmd
 
 	pathToTaskCommand := filepath.Join(fm.TaskWorkingDir, "run.sh")
 
@@ -227,92 +323,111 @@ func (fm *S3FileManager) signalTaskToRun() error {
 		fmt.Printf("failed to make dirs: %v\n", err)
 	}
 
-	f, err := os.Create(pathToTaskCommand)
-	defer f.Close()
-	if err != nil {
+	// the task container polls for run.sh, so write it elsewhere and move it into place once complete
+	tmp := pathToTaskCommand + ".tmp"
+	if err = ioutil.WriteFile(tmp, []byte(cmd.script(fm.TaskWorkingDir)), 0755); err != nil {
 		return err
 	}
-	f.WriteString(cmd)
-
-	return nil
+	return os.Rename(tmp, pathToTaskCommand)
 }
 
 // 4. wait for main container to finish
-// not sure if this fn should actually return an error or not
+// once the tool exits, the task container writes the tool's exit code and timestamps to a file in the task working dir
+// the exit code goes in the task's status - the engine decides whether it means success
+// the wait is bounded by the task's time limit, and ends early if the task container stops its heartbeat - see waitForTaskExit()
 func (fm *S3FileManager) waitForTaskToFinish() error {
-	time.Sleep(10 * time.Second)
-
-	var err error
-
-	/*
-		context:
-		when the task process finishes
-		it writes a file called "done" to the task working directory
-		as soon as that file exists, we can proceed and upload the task output to s3
-	*/
-
-	doneFlag := filepath.Join(fm.TaskWorkingDir, "done")
-	taskDone := false
-	for !taskDone {
-		_, err = os.Stat(doneFlag)
-		switch {
-		case err == nil:
-			// 'done' file exists
-			taskDone = true
-		case os.IsNotExist(err):
-			// 'done' file doesn't exist
-		default:
-			// unexpected error
-			log.Errorf("unexpected error checking for doneFlag: %s", err)
-		}
-		time.Sleep(5 * time.Second)
+	path := filepath.Join(fm.TaskWorkingDir, taskExitFile)
+	if err := waitForTaskExit(path, filepath.Join(fm.TaskWorkingDir, taskHeartbeatFile), fm.HeartbeatTimeout, fm.MaxTaskDuration); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read task exit file: %v", err)
 	}
+	exit := &taskExit{}
+	if err = json.Unmarshal(b, exit); err != nil {
+		return fmt.Errorf("failed to unmarshal task exit file: %v", err)
+	}
+	log.Infof("task exited with code %v", exit.ExitCode)
+	if exit.TimedOut {
+		log.Infof("task exceeded its time limit")
+	}
+	fm.Status.ExitCode = &exit.ExitCode
+	fm.Status.TimedOut = exit.TimedOut
+	fm.Status.StartedAt = &exit.StartedAt
+	fm.Status.FinishedAt = &exit.FinishedAt
 	return nil
 }
 
 // uploadOutputFiles utilizes a file manager to upload output files for a task.
+// only the files which the engine may collect as outputs get uploaded - see outputPaths()
+// each upload is retried with backoff, and verified against the size and checksum of the local file
+// returns an error if any output file could not be uploaded, so the task doesn't succeed with missing outputs
 func (fm *S3FileManager) uploadOutputFiles() (err error) {
-	paths := []string{}
-	_ = filepath.Walk(fm.TaskWorkingDir, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			if info.Mode().IsRegular() {
-				paths = append(paths, path)
-			}
-		}
-		return nil
-	})
-	sess := fm.newS3Session()
-	uploader := s3manager.NewUploader(sess)
-	var result *s3manager.UploadOutput
+	paths, err := fm.outputPaths()
+	if err != nil {
+		return fmt.Errorf("failed to list output files in task working dir: %v", err)
+	}
+	log.Infof("uploading %v output files", len(paths))
 	var wg sync.WaitGroup
+	errs := &transferErrors{}
 	guard := make(chan struct{}, fm.MaxConcurrent)
 	for _, p := range paths {
 		guard <- struct{}{}
 		wg.Add(1)
 		go func(path string) {
 			defer wg.Done()
-			f, err := os.Open(path)
-			if err != nil {
-				log.Errorf("failed to open file %s with error %s:", path, err)
-				return
-			}
-
-			result, err = uploader.Upload(&s3manager.UploadInput{
-				Bucket: aws.String(fm.S3BucketName),
-				Key:    aws.String(strings.TrimPrefix(fm.s3Key(path), "/")),
-				Body:   f,
-			})
-			if err != nil {
-				log.Errorf("failed to upload file %s with error %s:", path, err)
-				return
-			}
-			fmt.Println("file uploaded to location:", result.Location)
-			if err = f.Close(); err != nil {
-				log.Errorf("failed to close file: %s", err)
+			defer func() { <-guard }()
+			if err := fm.upload(path); err != nil {
+				errs.add(err)
 			}
-			<-guard
 		}(p)
 	}
 	wg.Wait()
-	return nil
+	return errs.err()
+}
+
+// upload uploads a local file to its location in s3, with retries
+func (fm *S3FileManager) upload(path string) error {
+	sess := fm.newS3Session()
+	// streams the file in parts, so large files are never read into memory as a whole
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = fm.PartSize
+		u.Concurrency = fm.PartConcurrency
+	})
+	svc := s3.New(sess)
+	key := strings.TrimPrefix(fm.s3Key(path), "/")
+	return withRetries(fmt.Sprintf("upload of %v", path), func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open file %v: %v", path, err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat file %v: %v", path, err)
+		}
+
+		result, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(fm.S3BucketName),
+			Key:    aws.String(key),
+			Body:   f,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload file %v: %v", path, err)
+		}
+
+		head, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(fm.S3BucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to head uploaded object %v: %v", key, err)
+		}
+		if err = verify(path, aws.Int64Value(head.ContentLength), info.Size(), md5ETag(head)); err != nil {
+			return fmt.Errorf("uploaded object %v doesn't match file %v: %v", key, path, err)
+		}
+		log.Infof("file uploaded to location: %v", result.Location)
+		return nil
+	})
 }
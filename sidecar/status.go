@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// this file contains code for the status of the task, as reported to the engine
+// the sidecar writes the status to the task working dir at each phase, and uploads the final status to s3
+// the task container reports the exit code and timestamps of the tool in a file of its own, which the sidecar waits for
+
+// TaskStatus is the status of a task, as read by the engine
+type TaskStatus struct {
+	Phase            string     `json:"phase"` // "staging", "running", "uploading", "completed" or "failed"
+	ExitCode         *int       `json:"exitCode,omitempty"`
+	TimedOut         bool       `json:"timedOut,omitempty"` // the tool was killed for exceeding its time limit
+	StagingStartedAt *time.Time `json:"stagingStartedAt,omitempty"`
+	StartedAt        *time.Time `json:"startedAt,omitempty"`  // when the tool started
+	FinishedAt       *time.Time `json:"finishedAt,omitempty"` // when the tool finished
+	UploadedAt       *time.Time `json:"uploadedAt,omitempty"` // when the outputs finished uploading
+	Error            string     `json:"error,omitempty"`
+}
+
+// taskExit is written by the task container once the tool exits
+type taskExit struct {
+	ExitCode   int       `json:"exitCode"`
+	TimedOut   bool      `json:"timedOut"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// setPhase records the given phase of the task in the status file in the task working dir
+func (fm *S3FileManager) setPhase(phase string) {
+	fm.Status.Phase = phase
+	if err := fm.writeStatus(); err != nil {
+		log.Errorf("failed to write task status: %v", err)
+	}
+}
+
+// writeStatus writes the status file to the task working dir
+// written elsewhere and moved into place, so a reader never sees a partial file
+func (fm *S3FileManager) writeStatus() error {
+	b, err := json.Marshal(fm.Status)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task status: %v", err)
+	}
+	if err = os.MkdirAll(fm.TaskWorkingDir, os.ModeDir); err != nil {
+		return fmt.Errorf("failed to make dirs: %v", err)
+	}
+	path := filepath.Join(fm.TaskWorkingDir, taskStatusFile)
+	if err = ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// uploadStatus writes the status file, and uploads it to s3
+func (fm *S3FileManager) uploadStatus() error {
+	if err := fm.writeStatus(); err != nil {
+		return err
+	}
+	return fm.upload(filepath.Join(fm.TaskWorkingDir, taskStatusFile))
+}
+
+// waitForFile waits for a file to exist, checking every pollingPeriod - and returns an error if it doesn't within the timeout
+// a zero timeout means wait indefinitely
+func waitForFile(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := os.Stat(path)
+		switch {
+		case err == nil:
+			return nil
+		case !os.IsNotExist(err):
+			return fmt.Errorf("unexpected error checking for file %v: %v", path, err)
+		case timeout > 0 && time.Now().After(deadline):
+			return fmt.Errorf("file %v doesn't exist after %v", path, timeout)
+		}
+		time.Sleep(pollingPeriod)
+	}
+}
+
+// waitForTaskExit waits for the task container to write its exit file, checking every pollingPeriod
+// returns an error if the task container's heartbeat is older than heartbeatTimeout - i.e., the container was killed (e.g., by an OOM kill of the launcher, or an eviction)
+// without reporting the tool's exit - or if the exit file doesn't appear within the timeout
+// the heartbeat may not exist yet, since the task container may still be pulling its image
+func waitForTaskExit(path string, heartbeat string, heartbeatTimeout, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := os.Stat(path)
+		switch {
+		case err == nil:
+			return nil
+		case !os.IsNotExist(err):
+			return fmt.Errorf("unexpected error checking for file %v: %v", path, err)
+		case time.Now().After(deadline):
+			return fmt.Errorf("task container didn't exit within %v", timeout)
+		}
+		info, err := os.Stat(heartbeat)
+		switch {
+		case err == nil:
+			if since := time.Since(info.ModTime()); since > heartbeatTimeout {
+				return fmt.Errorf("task container terminated without reporting the exit of the tool - last heartbeat %v ago", since.Round(time.Second))
+			}
+		case !os.IsNotExist(err):
+			return fmt.Errorf("unexpected error checking for file %v: %v", heartbeat, err)
+		}
+		time.Sleep(pollingPeriod)
+	}
+}
+
+func now() *time.Time {
+	t := time.Now().UTC()
+	return &t
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForTaskExit(t *testing.T) {
+	dir := t.TempDir()
+	exit, heartbeat := filepath.Join(dir, taskExitFile), filepath.Join(dir, taskHeartbeatFile)
+
+	// no heartbeat yet - e.g., the image is still being pulled - so only the timeout applies
+	if err := waitForTaskExit(exit, heartbeat, time.Minute, 10*time.Millisecond); err == nil || !strings.Contains(err.Error(), "didn't exit") {
+		t.Errorf("waitForTaskExit() without heartbeat error = %v, want timeout", err)
+	}
+
+	// a heartbeat older than the heartbeat timeout
+	if err := ioutil.WriteFile(heartbeat, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(heartbeat, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForTaskExit(exit, heartbeat, 30*time.Second, time.Hour); err == nil || !strings.Contains(err.Error(), "last heartbeat") {
+		t.Errorf("waitForTaskExit() with stale heartbeat error = %v, want stale heartbeat", err)
+	}
+
+	if err := ioutil.WriteFile(exit, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForTaskExit(exit, heartbeat, 30*time.Second, time.Hour); err != nil {
+		t.Errorf("waitForTaskExit() after exit error = %v", err)
+	}
+}
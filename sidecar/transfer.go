@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// this file contains code for making s3 transfers reliable
+// 1. each transfer is retried with exponential backoff
+// 2. each transfer is verified - the sizes must match, and so must the MD5 checksum where the ETag is one
+// 3. errors from concurrent transfers are collected, so a single failed transfer fails the task
+
+// withRetries calls fn until it succeeds, or until maxTransferAttempts attempts have failed
+func withRetries(description string, fn func() error) (err error) {
+	backoff := initialBackoff
+	for attempt := 1; attempt <= maxTransferAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt < maxTransferAttempts {
+			log.Warnf("%v failed (attempt %v of %v), retrying in %v: %v", description, attempt, maxTransferAttempts, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+	return fmt.Errorf("%v failed after %v attempts: %v", description, maxTransferAttempts, err)
+}
+
+// verify checks a transferred local file against its s3 object
+// the ETag of an object uploaded in a single part is the MD5 of its contents, so then the checksums get compared too
+// the ETag of a multipart upload ("<md5>-<nParts>") is not an MD5 of the contents, so then only the sizes get compared
+// and neither is the ETag of an object encrypted with SSE-KMS or SSE-C - see md5ETag()
+func verify(path string, transferred int64, expected int64, etag string) error {
+	if transferred != expected {
+		return fmt.Errorf("size mismatch: transferred %v bytes, expected %v bytes", transferred, expected)
+	}
+	etag = strings.Trim(etag, `"`)
+	if etag == "" || strings.Contains(etag, "-") {
+		return nil
+	}
+	checksum, err := md5sum(path)
+	if err != nil {
+		return err
+	}
+	if checksum != etag {
+		return fmt.Errorf("checksum mismatch: local md5 %v, s3 etag %v", checksum, etag)
+	}
+	return nil
+}
+
+// md5ETag returns the ETag of an object, for verify() to compare - or "" if it's not an MD5 of the object's contents
+// i.e., only the ETag of an unencrypted object, or one encrypted with SSE-S3, may be an MD5
+// see: https://docs.aws.amazon.com/AmazonS3/latest/API/API_Object.html
+func md5ETag(head *s3.HeadObjectOutput) string {
+	if aws.StringValue(head.SSECustomerAlgorithm) != "" {
+		return ""
+	}
+	switch aws.StringValue(head.ServerSideEncryption) {
+	case "", s3.ServerSideEncryptionAes256:
+		return aws.StringValue(head.ETag)
+	}
+	return ""
+}
+
+// md5sum returns the hex MD5 checksum of a local file
+func md5sum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file for checksum: %v", err)
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to compute checksum: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// transferErrors collects the errors of concurrent transfers
+type transferErrors struct {
+	sync.Mutex
+	errs []string
+}
+
+func (e *transferErrors) add(err error) {
+	log.Errorf("%v", err)
+	e.Lock()
+	defer e.Unlock()
+	e.errs = append(e.errs, err.Error())
+}
+
+// err returns an error summarizing the collected errors, or nil if there were none
+func (e *transferErrors) err() error {
+	e.Lock()
+	defer e.Unlock()
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v transfer(s) failed: %v", len(e.errs), strings.Join(e.errs, "; "))
+}
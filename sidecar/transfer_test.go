@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const md5 = `"5d41402abc4b2a76b9719d911017c592"` // of "hello"
+	const other = `"0123456789abcdef0123456789abcdef"`
+	cases := []struct {
+		name    string
+		head    *s3.HeadObjectOutput
+		wantErr bool
+	}{
+		{"plain, matching", &s3.HeadObjectOutput{ETag: aws.String(md5)}, false},
+		{"plain, mismatched", &s3.HeadObjectOutput{ETag: aws.String(other)}, true},
+		{"sse-s3, mismatched", &s3.HeadObjectOutput{ETag: aws.String(other), ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256)}, true},
+		{"sse-kms", &s3.HeadObjectOutput{ETag: aws.String(other), ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms)}, false},
+		{"sse-c", &s3.HeadObjectOutput{ETag: aws.String(other), SSECustomerAlgorithm: aws.String("AES256")}, false},
+		{"multipart", &s3.HeadObjectOutput{ETag: aws.String(`"0123456789abcdef0123456789abcdef-2"`)}, false},
+	}
+	for _, c := range cases {
+		if err := verify(path, 5, 5, md5ETag(c.head)); (err != nil) != c.wantErr {
+			t.Errorf("%v: verify() error = %v, want error %v", c.name, err, c.wantErr)
+		}
+	}
+	if err := verify(path, 4, 5, ""); err == nil {
+		t.Errorf("size mismatch: want error")
+	}
+}
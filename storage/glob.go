@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"path"
+	"strings"
+)
+
+// glob patterns over slash-separated keys (or paths), shared by the engine's glob of a task's outputs and by the s3sidecar
+// a pattern element is matched as by path.Match - i.e., "*", "?", character classes "[a-z]", "[^0-9]", and "\" escapes -
+// plus the element "**", which matches zero or more whole elements, e.g., "out/**/*.bam" matches "out/a.bam" and "out/x/y/a.bam"
+
+// Match returns true if the key (or path) matches the pattern
+// the only error returned is path.ErrBadPattern
+func Match(pattern, key string) (bool, error) {
+	patternElems := strings.Split(pattern, "/")
+	for _, elem := range patternElems {
+		if elem == "**" {
+			continue
+		}
+		// path.Match only reports a malformed pattern as far as it gets to matching it
+		if _, err := path.Match(elem, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchElems(patternElems, strings.Split(key, "/")), nil
+}
+
+func matchElems(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// collapse consecutive "**", then try every number of elements for it to match
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range key {
+				if matchElems(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(key) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], key[0]); !ok {
+			return false
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// GlobRoot returns the leading elements of the pattern which contain no metacharacters
+// i.e., the dir under which all the matches of the pattern are - e.g., "a/b/" for "a/b/*/c.txt"
+func GlobRoot(pattern string) string {
+	i := strings.IndexAny(pattern, `*?[\`)
+	if i < 0 {
+		return pattern
+	}
+	return pattern[:strings.LastIndex(pattern[:i], "/")+1]
+}
+
+// Dirs returns the dirs which contain the given key, below the given prefix
+// e.g., ["a/b/c", "a/b/c/d"] for the key "a/b/c/d/e.txt" under the prefix "a/b/"
+func Dirs(prefix, key string) []string {
+	var dirs []string
+	rel := strings.TrimPrefix(key, prefix)
+	for i := strings.Index(rel, "/"); i >= 0; {
+		dirs = append(dirs, prefix+rel[:i])
+		next := strings.Index(rel[i+1:], "/")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return dirs
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prefix of the temp files written by Put - these are never listed
+const tempPrefix = ".mariner-put-"
+
+// Local stores objects as files under a root dir of the local filesystem
+// the key "a/b/c.txt" is the file "<root>/a/b/c.txt"
+type Local struct {
+	Root string
+}
+
+// NewLocal returns the storage for the given root dir, creating the dir if it does not exist
+func NewLocal(root string) (*Local, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve storage root %v: %v", root, err)
+	}
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage root %v: %v", root, err)
+	}
+	return &Local{Root: root}, nil
+}
+
+// path returns the path of the file for the given key
+// keys which would escape the root dir, e.g., "../x", are rejected
+func (storage *Local) path(key string) (string, error) {
+	key = normalize(key)
+	path := filepath.Join(storage.Root, filepath.FromSlash(key))
+	if path != storage.Root && !strings.HasPrefix(path, storage.Root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key %v: outside of storage root", key)
+	}
+	return path, nil
+}
+
+// Get ..
+func (storage *Local) Get(key string) (io.ReadCloser, error) {
+	return storage.GetRange(key, 0, -1)
+}
+
+// GetRange ..
+func (storage *Local) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	path, err := storage.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, storage.err("get", key, err)
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, notFound(key)
+	}
+	if offset > 0 {
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, storage.err("get", key, err)
+		}
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedFile{Reader: io.LimitReader(f, length), file: f}, nil
+}
+
+// limitedFile reads a section of a file and closes the file
+type limitedFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (f *limitedFile) Close() error { return f.file.Close() }
+
+// Put writes to a temp file which is then renamed, so a reader never sees a partially written object
+func (storage *Local) Put(key string, body io.Reader) error {
+	path, err := storage.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return storage.err("put", key, err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return storage.err("put", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return storage.err("put", key, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return storage.err("put", key, err)
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return storage.err("put", key, err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return storage.err("put", key, err)
+	}
+	return nil
+}
+
+// Stat ..
+func (storage *Local) Stat(key string) (*Object, error) {
+	path, err := storage.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, storage.err("stat", key, err)
+	}
+	if info.IsDir() {
+		return nil, notFound(key)
+	}
+	return &Object{
+		Key:          normalize(key),
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// Delete ..
+func (storage *Local) Delete(key string) error {
+	path, err := storage.path(key)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return storage.err("delete", key, err)
+	}
+	return nil
+}
+
+// Exists ..
+func (storage *Local) Exists(key string) (bool, error) {
+	_, err := storage.Stat(key)
+	switch {
+	case err == nil:
+		return true, nil
+	case IsNotFound(err):
+		return false, nil
+	}
+	return false, err
+}
+
+// List walks the dir which contains the prefix and pages through the matching keys in sorted order
+// the continuation token is the last key (or common prefix) of the previous page
+func (storage *Local) List(options ListOptions) (*Page, error) {
+	prefix := normalize(options.Prefix)
+	maxKeys := options.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxKeys
+	}
+
+	// only the dir which contains the prefix needs to be walked
+	dir := storage.Root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		if dir, err = storage.path(prefix[:i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(storage.Root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %v: %v", prefix, err)
+	}
+	sort.Strings(keys)
+
+	// roll up keys into common prefixes, and skip the entries up to and including the token
+	page := &Page{}
+	var last string
+	for _, key := range keys {
+		entry, isPrefix := key, false
+		if options.Delimiter != "" {
+			if i := strings.Index(key[len(prefix):], options.Delimiter); i >= 0 {
+				entry, isPrefix = key[:len(prefix)+i+len(options.Delimiter)], true
+			}
+		}
+		if entry == last || (options.Token != "" && entry <= options.Token) {
+			continue
+		}
+		if len(page.Objects)+len(page.Prefixes) == maxKeys {
+			page.Next = last
+			break
+		}
+		last = entry
+		if isPrefix {
+			page.Prefixes = append(page.Prefixes, entry)
+			continue
+		}
+		obj, err := storage.Stat(key)
+		if err != nil {
+			return nil, err
+		}
+		page.Objects = append(page.Objects, obj)
+	}
+	return page, nil
+}
+
+// Presign returns a file:// URL - there are no credentials to a local file, so the expiry is ignored
+func (storage *Local) Presign(key string, expiry time.Duration) (string, error) {
+	path, err := storage.path(key)
+	if err != nil {
+		return "", err
+	}
+	if _, err = storage.Stat(key); err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+}
+
+// err wraps an error from the filesystem - an error due to the file not existing wraps ErrNotFound
+func (storage *Local) err(op string, key string, err error) error {
+	if os.IsNotExist(err) {
+		return notFound(normalize(key))
+	}
+	return fmt.Errorf("failed to %v %v: %v", op, normalize(key), err)
+}
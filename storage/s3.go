@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3 stores objects in an s3 bucket
+// or in a bucket of an s3-compatible store, e.g., MinIO, if an endpoint is given
+type S3 struct {
+	Bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+// NewS3 returns the storage for the given bucket
+// if endpoint is not "", requests go to that endpoint (e.g., "http://minio:9000") with path-style addressing
+func NewS3(bucket string, config *aws.Config, endpoint string) (*S3, error) {
+	config = config.Copy()
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %v", err)
+	}
+	return &S3{
+		Bucket:   bucket,
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+// Get ..
+func (storage *S3) Get(key string) (io.ReadCloser, error) {
+	obj, err := storage.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(storage.Bucket),
+		Key:    aws.String(normalize(key)),
+	})
+	if err != nil {
+		return nil, storage.err("get", key, err)
+	}
+	return obj.Body, nil
+}
+
+// GetRange ..
+func (storage *S3) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(&emptyReader{}), nil
+	}
+	byteRange := fmt.Sprintf("bytes=%v-", offset)
+	if length > 0 {
+		byteRange += fmt.Sprint(offset + length - 1)
+	}
+	obj, err := storage.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(storage.Bucket),
+		Key:    aws.String(normalize(key)),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		return nil, storage.err("get", key, err)
+	}
+	return obj.Body, nil
+}
+
+// Put ..
+func (storage *S3) Put(key string, body io.Reader) error {
+	_, err := storage.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(storage.Bucket),
+		Key:    aws.String(normalize(key)),
+		Body:   body,
+	})
+	if err != nil {
+		return storage.err("put", key, err)
+	}
+	return nil
+}
+
+// Stat ..
+func (storage *S3) Stat(key string) (*Object, error) {
+	head, err := storage.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(storage.Bucket),
+		Key:    aws.String(normalize(key)),
+	})
+	if err != nil {
+		return nil, storage.err("head", key, err)
+	}
+	return &Object{
+		Key:          normalize(key),
+		Size:         aws.Int64Value(head.ContentLength),
+		ETag:         aws.StringValue(head.ETag),
+		LastModified: aws.TimeValue(head.LastModified),
+	}, nil
+}
+
+// Delete ..
+func (storage *S3) Delete(key string) error {
+	_, err := storage.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(storage.Bucket),
+		Key:    aws.String(normalize(key)),
+	})
+	if err != nil {
+		if err = storage.err("delete", key, err); !IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exists ..
+func (storage *S3) Exists(key string) (bool, error) {
+	_, err := storage.Stat(key)
+	switch {
+	case err == nil:
+		return true, nil
+	case IsNotFound(err):
+		return false, nil
+	}
+	return false, err
+}
+
+// List ..
+func (storage *S3) List(options ListOptions) (*Page, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(storage.Bucket),
+		Prefix: aws.String(normalize(options.Prefix)),
+	}
+	if options.Delimiter != "" {
+		input.Delimiter = aws.String(options.Delimiter)
+	}
+	if options.Token != "" {
+		input.ContinuationToken = aws.String(options.Token)
+	}
+	if options.MaxKeys > 0 {
+		input.MaxKeys = aws.Int64(int64(options.MaxKeys))
+	}
+	result, err := storage.client.ListObjectsV2(input)
+	if err != nil {
+		return nil, storage.err("list", options.Prefix, err)
+	}
+	page := &Page{}
+	for _, obj := range result.Contents {
+		page.Objects = append(page.Objects, &Object{
+			Key:          aws.StringValue(obj.Key),
+			Size:         aws.Int64Value(obj.Size),
+			ETag:         aws.StringValue(obj.ETag),
+			LastModified: aws.TimeValue(obj.LastModified),
+		})
+	}
+	for _, prefix := range result.CommonPrefixes {
+		page.Prefixes = append(page.Prefixes, aws.StringValue(prefix.Prefix))
+	}
+	if aws.BoolValue(result.IsTruncated) {
+		page.Next = aws.StringValue(result.NextContinuationToken)
+	}
+	return page, nil
+}
+
+// Presign ..
+func (storage *S3) Presign(key string, expiry time.Duration) (string, error) {
+	req, _ := storage.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(storage.Bucket),
+		Key:    aws.String(normalize(key)),
+	})
+	url, err := req.Presign(expiry)
+	if err != nil {
+		return "", storage.err("presign", key, err)
+	}
+	return url, nil
+}
+
+// err wraps an error from s3 - an error due to the object not existing wraps ErrNotFound
+func (storage *S3) err(op string, key string, err error) error {
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return notFound(fmt.Sprintf("s3://%v/%v", storage.Bucket, normalize(key)))
+	}
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
+		return notFound(fmt.Sprintf("s3://%v/%v", storage.Bucket, normalize(key)))
+	}
+	return fmt.Errorf("failed to %v s3://%v/%v: %v", op, storage.Bucket, normalize(key), err)
+}
+
+// emptyReader reads nothing
+type emptyReader struct{}
+
+func (*emptyReader) Read([]byte) (int, error) { return 0, io.EOF }
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// this package contains the storage backends of mariner - i.e., where run logs, requests and task working dirs live
+// 1. S3 - an s3 bucket, or a bucket of an s3-compatible store (e.g., MinIO) at a custom endpoint
+// 2. Local - a dir of the local filesystem, e.g., for running on-prem or offline
+//
+// keys are slash-separated paths, e.g., "userID/workflowRuns/runID/marinerLog.json"
+// a leading slash is ignored, so "/userID/..." and "userID/..." are the same key
+
+// Storage is a store of objects by key
+type Storage interface {
+	// Get returns the contents of the object with the given key
+	Get(key string) (io.ReadCloser, error)
+
+	// GetRange returns length bytes of the object, starting at offset - a negative length reads to the end of the object
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+
+	// Put writes the object with the given key, replacing any existing object
+	Put(key string, body io.Reader) error
+
+	// Stat returns the metadata of the object with the given key
+	Stat(key string) (*Object, error)
+
+	// Delete removes the object with the given key - removing an object which doesn't exist is not an error
+	Delete(key string) error
+
+	// Exists returns true if an object with exactly the given key exists
+	Exists(key string) (bool, error)
+
+	// List returns a page of the objects whose keys start with the given prefix, in lexicographic order of their keys
+	List(options ListOptions) (*Page, error)
+
+	// Presign returns a URL at which the object can be fetched without credentials, until it expires
+	Presign(key string, expiry time.Duration) (string, error)
+}
+
+// Object is the metadata of an object
+type Object struct {
+	Key          string
+	Size         int64
+	ETag         string // "" if not known
+	LastModified time.Time
+}
+
+// ListOptions ..
+type ListOptions struct {
+	Prefix    string
+	Delimiter string // if set, keys which contain the delimiter after the prefix are rolled up into Page.Prefixes
+	Token     string // continuation token, from the previous page
+	MaxKeys   int    // max number of objects and prefixes per page - default 1000
+}
+
+// Page is a page of a listing
+type Page struct {
+	Objects  []*Object
+	Prefixes []string // common prefixes, if a delimiter was given
+	Next     string   // continuation token for the next page, or "" if this is the last page
+}
+
+// default page size of a listing
+const defaultMaxKeys = 1000
+
+// ErrNotFound is returned when there is no object with the given key
+var ErrNotFound = errors.New("object not found")
+
+// IsNotFound returns true if the error is due to an object not existing
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+func notFound(key string) error {
+	return fmt.Errorf("%w: %v", ErrNotFound, key)
+}
+
+// normalize strips the leading slash of a key
+func normalize(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+// ReadAll returns the contents of the object with the given key
+func ReadAll(s Storage, key string) ([]byte, error) {
+	body, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// ListAll returns all the objects whose keys start with the given prefix, following continuation tokens
+func ListAll(s Storage, prefix string) ([]*Object, error) {
+	var objects []*Object
+	options := ListOptions{Prefix: prefix}
+	for {
+		page, err := s.List(options)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Objects...)
+		if page.Next == "" {
+			return objects, nil
+		}
+		options.Token = page.Next
+	}
+}
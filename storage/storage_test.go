@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestLocal(t *testing.T, keys ...string) *Local {
+	t.Helper()
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err = local.Put(key, strings.NewReader("contents of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return local
+}
+
+func TestLocalGetPut(t *testing.T) {
+	local := newTestLocal(t, "/user/run/marinerLog.json")
+
+	b, err := ReadAll(local, "user/run/marinerLog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "contents of /user/run/marinerLog.json" {
+		t.Errorf("unexpected contents: %q", b)
+	}
+
+	body, err := local.GetRange("user/run/marinerLog.json", 9, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if b, _ = ioutil.ReadAll(body); string(b) != "of /" {
+		t.Errorf("unexpected range: %q", b)
+	}
+
+	if _, err = local.Get("user/run/missing.json"); !IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if _, err = local.Get("user/run"); !IsNotFound(err) {
+		t.Errorf("expected not found for a dir, got %v", err)
+	}
+	if err = local.Put("../escape", strings.NewReader("")); err == nil {
+		t.Error("expected key outside of root to be rejected")
+	}
+}
+
+func TestLocalExists(t *testing.T) {
+	local := newTestLocal(t, "a/b.txt")
+	for key, want := range map[string]bool{"a/b.txt": true, "/a/b.txt": true, "a/b": false, "a": false} {
+		got, err := local.Exists(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Exists(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	local := newTestLocal(t, "a/b.txt", "a/c.txt")
+	if err := local.Delete("/a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := local.Exists("a/b.txt"); exists {
+		t.Error("expected a/b.txt to be deleted")
+	}
+	if exists, _ := local.Exists("a/c.txt"); !exists {
+		t.Error("expected a/c.txt to remain")
+	}
+	for _, key := range []string{"a/b.txt", "a/missing.txt", "a"} {
+		if err := local.Delete(key); err != nil {
+			t.Errorf("Delete(%q) = %v, want nil", key, err)
+		}
+	}
+	if exists, _ := local.Exists("a/c.txt"); !exists {
+		t.Error("expected deleting the dir a to be a no-op")
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	var keys []string
+	for i := 0; i < 5; i++ {
+		keys = append(keys, fmt.Sprintf("user/workflowRuns/run%v/marinerLog.json", i))
+	}
+	keys = append(keys, "user/workflowRuns/top.json", "user/other.json")
+	local := newTestLocal(t, keys...)
+
+	page, err := local.List(ListOptions{Prefix: "user/workflowRuns/", Delimiter: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPrefixes := []string{
+		"user/workflowRuns/run0/", "user/workflowRuns/run1/", "user/workflowRuns/run2/",
+		"user/workflowRuns/run3/", "user/workflowRuns/run4/",
+	}
+	if !reflect.DeepEqual(page.Prefixes, wantPrefixes) {
+		t.Errorf("unexpected prefixes: %v", page.Prefixes)
+	}
+	if len(page.Objects) != 1 || page.Objects[0].Key != "user/workflowRuns/top.json" {
+		t.Errorf("unexpected objects: %v", page.Objects)
+	}
+
+	// paginate
+	var listed []string
+	options := ListOptions{Prefix: "user/workflowRuns/run", MaxKeys: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		page, err = local.List(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range page.Objects {
+			listed = append(listed, obj.Key)
+		}
+		if page.Next == "" {
+			break
+		}
+		options.Token = page.Next
+	}
+	if !reflect.DeepEqual(listed, keys[:5]) {
+		t.Errorf("unexpected listing: %v", listed)
+	}
+
+	all, err := ListAll(local, "user/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(keys) {
+		t.Errorf("expected %v objects, got %v", len(keys), len(all))
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"wd/*.bam", "wd/a.bam", true},
+		{"wd/*.bam", "wd/x/a.bam", false},
+		{"wd/a.bam", "wd/a.bam.bai", false},
+		{"wd/**/*.bam", "wd/a.bam", true},
+		{"wd/**/*.bam", "wd/x/y/a.bam", true},
+		{"wd/**", "wd/x/y/a.bam", true},
+		{"wd/**/y", "wd/x/y", true},
+		{"wd/**/y", "wd/x/z", false},
+		{"wd/chr[0-9].vcf", "wd/chr7.vcf", true},
+		{"wd/chr[0-9].vcf", "wd/chrX.vcf", false},
+		{"wd/chr[^0-9].vcf", "wd/chrX.vcf", true},
+		{"wd/out?", "wd/out1", true},
+		{`wd/\*`, "wd/*", true},
+	}
+	for _, c := range cases {
+		got, err := Match(c.pattern, c.key)
+		if err != nil {
+			t.Fatalf("Match(%q, %q): %v", c.pattern, c.key, err)
+		}
+		if got != c.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.pattern, c.key, got, c.want)
+		}
+	}
+	if _, err := Match("wd/[a-", "wd/a"); err == nil {
+		t.Error("expected malformed pattern to be an error")
+	}
+}
+
+func TestGlobRoot(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"a/b/*/c.txt":   "a/b/",
+		"a/b/**":        "a/b/",
+		"a/b/c.txt":     "a/b/c.txt",
+		"*.txt":         "",
+		"/wd/chr[0-9]*": "/wd/",
+	} {
+		if got := GlobRoot(pattern); got != want {
+			t.Errorf("GlobRoot(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestDirs(t *testing.T) {
+	want := []string{"a/b/c", "a/b/c/d"}
+	if got := Dirs("a/b/", "a/b/c/d/e.txt"); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected dirs: %v", got)
+	}
+	if got := Dirs("a/b/", "a/b/e.txt"); len(got) != 0 {
+		t.Errorf("unexpected dirs: %v", got)
+	}
+}